@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/linux4life798/btrfs-optimize/fstools"
+	"github.com/spf13/cobra"
+)
+
+var alignCmd = &cobra.Command{
+	Use:   "align <file-path> [file-path...]",
+	Short: "Report extents whose boundaries are not block aligned",
+	Long: `Align is a subcommand that scans the extents of one or more files and
+reports any extent whose logical start, physical start, or length is not
+aligned to the filesystem block size. For each misaligned extent, the nearest
+block aligned offset and length that could be deduplicated is suggested.
+
+Deduplication requires block aligned offsets and lengths, so this helps
+explain why a dedupe may have returned EINVAL.`,
+	Args: cobra.MinimumNArgs(1),
+	Run:  runAlign,
+}
+
+func init() {
+	alignCmd.Flags().BoolP("sync", "s", false, "Sync the file to disk before requeting the extents map")
+	rootCmd.AddCommand(alignCmd)
+}
+
+func runAlign(cmd *cobra.Command, args []string) {
+	syncFirst, _ := cmd.Flags().GetBool("sync")
+
+	for _, filePath := range args {
+		if err := alignReport(filePath, syncFirst); err != nil {
+			printErrorf("Error checking alignment for %s: %v\n", filePath, err)
+		}
+		fmt.Fprintln(out)
+	}
+}
+
+func alignReport(filePath string, syncFirst bool) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return fmt.Errorf("failed to open file: %v", err)
+	}
+	defer file.Close()
+
+	blkSize, err := fstools.FileBlockSize(file)
+	if err != nil {
+		return fmt.Errorf("failed to get block size: %v", err)
+	}
+
+	var flags uint32
+	if syncFirst {
+		flags |= fstools.FIEMAP_FLAG_SYNC
+	}
+	extents, err := fstools.CollectExtents(file, flags)
+	if err != nil {
+		return fmt.Errorf("failed to walk fiemap: %v", err)
+	}
+
+	fmt.Fprintln(out, "File:", filePath)
+	fmt.Fprintf(out, "Block Size (Bytes): %d  <-- dedupe offsets and lengths must be multiples of this\n", blkSize)
+	fmt.Fprintln(out, "Start/Length Units: Bytes")
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "Extent-Index\tLogical-Start\tPhysical-Start\tLength\tSuggested-Offset\tSuggested-Length\tFlags")
+
+	var misaligned int
+	for i := range extents {
+		extent := &extents[i]
+		if fstools.ExtentIsAligned(extent, blkSize) {
+			continue
+		}
+		misaligned++
+
+		offset, length := fstools.AlignRange(extent.Logical, extent.Length, blkSize)
+		suggestedLength := fmt.Sprint(length)
+		if length == 0 {
+			suggestedLength = "none"
+		}
+		fmt.Fprintf(
+			w,
+			"%d\t%d\t%d\t%d\t%d\t%s\t%s\n",
+			i,
+			extent.Logical,
+			extent.Physical,
+			extent.Length,
+			offset,
+			suggestedLength,
+			strings.Join(fstools.FiemapExtentFlagsToStrings(extent.Flags), ","),
+		)
+	}
+	w.Flush()
+
+	fmt.Fprintf(out, "Misaligned extents: %d of %d\n", misaligned, len(extents))
+	return nil
+}
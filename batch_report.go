@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/csv"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// batchReportHeader names the columns of a batch report.
+var batchReportHeader = []string{
+	"source",
+	"targets",
+	"deduped_targets",
+	"skipped_targets",
+	"failed_targets",
+	"bytes_deduped",
+}
+
+// batchReportRow summarizes the dedupe of a group of targets against a
+// single source.
+type batchReportRow struct {
+	Source       string
+	Targets      int
+	Deduped      int
+	Skipped      int
+	Failed       int
+	BytesDeduped uint64
+}
+
+// batchReport writes one CSV row per dedupe group. Each row is flushed as
+// soon as it is added, so that an interrupted run still leaves a report of
+// the groups that completed.
+// All methods are no-ops on a nil *batchReport, and safe to call from
+// multiple goroutines.
+type batchReport struct {
+	mu sync.Mutex
+	f  *os.File
+	w  *csv.Writer
+}
+
+// openBatchReport creates the report at path and writes its header.
+func openBatchReport(path string) (*batchReport, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	r := &batchReport{f: f, w: csv.NewWriter(f)}
+	if err := r.write(batchReportHeader); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *batchReport) write(record []string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.w.Write(record)
+	r.w.Flush()
+	return r.w.Error()
+}
+
+// Add writes the row for a completed group.
+func (r *batchReport) Add(row batchReportRow) error {
+	if r == nil {
+		return nil
+	}
+	return r.write([]string{
+		row.Source,
+		strconv.Itoa(row.Targets),
+		strconv.Itoa(row.Deduped),
+		strconv.Itoa(row.Skipped),
+		strconv.Itoa(row.Failed),
+		strconv.FormatUint(row.BytesDeduped, 10),
+	})
+}
+
+// Close closes the report file.
+func (r *batchReport) Close() error {
+	if r == nil {
+		return nil
+	}
+	return r.f.Close()
+}
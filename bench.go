@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+
+	"github.com/linux4life798/btrfs-optimize/fstools"
+	"github.com/spf13/cobra"
+	"golang.org/x/sys/unix"
+)
+
+var benchCmd = &cobra.Command{
+	Use:   "bench [dir]",
+	Short: "Measure dedupe ioctl throughput on the filesystem of a directory",
+	Long: `Bench creates two identical temporary files of --size in dir (default is the
+current directory), dedupes them with FIDEDUPERANGE, and reports the time
+taken, the throughput, and the number of ioctl round trips needed. Filesystems
+cap how much a single ioctl dedupes (btrfs caps it at 1GiB), so the round
+trips reveal that cap. The files are deleted afterwards, unless --keep is
+given.
+
+The subcommands benchmark other operations, to help tune their options.`,
+	Args: cobra.MaximumNArgs(1),
+	Run:  runBench,
+}
+
+var benchDedupeCmd = &cobra.Command{
+	Use:   "dedupe <source-file> <target-file>",
+	Short: "Measure dedupe throughput across chunk sizes",
+	Long: `Bench dedupe dedupes a fresh copy of the target file against the source once
+for each chunk size, and reports the throughput of each run. This helps pick
+a --chunk-size for dedupe on a particular filesystem.
+
+The copy is created next to the target, so enough free space for one copy
+of the target is needed. It is deleted after each run.`,
+	Args: cobra.ExactArgs(2),
+	Run:  runBenchDedupe,
+}
+
+func init() {
+	benchCmd.Flags().String("size", "1GiB", "Size of each of the two files to dedupe (e.g. 4GiB)")
+	benchCmd.Flags().Bool("keep", false, "Keep the files instead of deleting them afterwards")
+	benchDedupeCmd.Flags().StringSlice("chunk-sizes", []string{"128KiB", "1MiB", "16MiB", "128MiB", "0"}, "Chunk sizes to measure, where 0 means no limit")
+	benchCmd.AddCommand(benchDedupeCmd)
+	rootCmd.AddCommand(benchCmd)
+}
+
+func runBench(cmd *cobra.Command, args []string) {
+	dir := "."
+	if len(args) > 0 {
+		dir = args[0]
+	}
+	sizeStr, _ := cmd.Flags().GetString("size")
+	keep, _ := cmd.Flags().GetBool("keep")
+	size, err := ParseSize(sizeStr)
+	if err != nil || size == 0 {
+		printErrorf("Error: invalid --size %q\n", sizeStr)
+		return
+	}
+
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+			if !keep {
+				os.Remove(f.Name())
+			}
+		}
+	}()
+	for i := 0; i < 2; i++ {
+		f, err := os.CreateTemp(dir, ".btrfs-optimize-bench-")
+		if err != nil {
+			printErrorf("Error creating benchmark file: %v\n", err)
+			return
+		}
+		files = append(files, f)
+	}
+	fmt.Fprintf(out, "Writing %s to %s and %s\n", FormatSize(size), files[0].Name(), files[1].Name())
+	if err := writeIdenticalFiles(cmd.Context(), files, size); err != nil {
+		printErrorf("Error writing benchmark files: %v\n", err)
+		return
+	}
+
+	var ioctls int
+	value := &unix.FileDedupeRange{
+		Src_length: size,
+		Info: []unix.FileDedupeRangeInfo{
+			{Dest_fd: int64(files[1].Fd())},
+		},
+	}
+	start := time.Now()
+	err = fstools.FileDedupeRangeFullWithOptions(cmd.Context(), int(files[0].Fd()), value, fstools.FileDedupeRangeOptions{
+		OnIoctl: func() { ioctls++ },
+	})
+	elapsed := time.Since(start)
+	if interrupted(err) {
+		printErrorf("Benchmark interrupted.\n")
+		return
+	}
+	if err != nil {
+		printErrorf("Error deduping: %v\n", err)
+		return
+	}
+	target := fstools.DedupeTargetResult{
+		BytesDeduped: value.Info[0].Bytes_deduped,
+		Status:       value.Info[0].Status,
+	}
+	if err := target.Err(); err != nil {
+		printErrorf("Error deduping: %v\n", err)
+		return
+	}
+
+	throughput := float64(target.BytesDeduped) / elapsed.Seconds()
+	fmt.Fprintln(out, "Deduped    (Bytes):", target.BytesDeduped)
+	fmt.Fprintln(out, "Elapsed           :", elapsed.Round(time.Millisecond))
+	fmt.Fprintf(out, "Throughput (MB/s) : %.1f\n", throughput/1e6)
+	fmt.Fprintln(out, "Ioctls            :", ioctls)
+	if ioctls > 0 {
+		fmt.Fprintln(out, "Per Ioctl  (Bytes):", target.BytesDeduped/uint64(ioctls))
+	}
+	if keep {
+		fmt.Fprintln(out, "Kept", files[0].Name(), "and", files[1].Name())
+	}
+}
+
+// writeIdenticalFiles writes the same size bytes of random data to each of
+// files, and syncs them, so that the data is on disk before it is deduped.
+// The data is generated in blocks, so that large files don't need to fit
+// in memory.
+func writeIdenticalFiles(ctx context.Context, files []*os.File, size uint64) error {
+	buf := make([]byte, Mebibyte)
+	for written := uint64(0); written < size; written += uint64(len(buf)) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		buf = buf[:min(uint64(len(buf)), size-written)]
+		if _, err := rand.Read(buf); err != nil {
+			return err
+		}
+		for _, f := range files {
+			if _, err := f.Write(buf); err != nil {
+				return err
+			}
+		}
+	}
+	for _, f := range files {
+		if err := f.Sync(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runBenchDedupe(cmd *cobra.Command, args []string) {
+	source, target := args[0], args[1]
+	sizeStrs, _ := cmd.Flags().GetStringSlice("chunk-sizes")
+
+	var chunkSizes []uint64
+	for _, s := range sizeStrs {
+		size, err := ParseSize(s)
+		if err != nil {
+			printErrorf("Error parsing --chunk-sizes: %v\n", err)
+			return
+		}
+		chunkSizes = append(chunkSizes, size)
+	}
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	defer w.Flush()
+	fmt.Fprintln(w, "CHUNK SIZE\tDEDUPED\tTIME\tTHROUGHPUT\tSTATUS")
+	for _, chunkSize := range chunkSizes {
+		copyPath, err := freshCopy(target)
+		if err != nil {
+			printErrorf("Error copying %s: %v\n", target, err)
+			return
+		}
+
+		start := time.Now()
+		result, err := fstools.DedupeFiles(source, []string{copyPath}, fstools.DedupeOptions{
+			ChunkSize: chunkSize,
+		})
+		elapsed := time.Since(start)
+		os.Remove(copyPath)
+		if err != nil {
+			printErrorf("Error deduping: %v\n", err)
+			return
+		}
+
+		t := result.Targets[0]
+		status := "ok"
+		if err := t.Err(); err != nil {
+			status = err.Error()
+		}
+		chunk := "none"
+		if chunkSize != 0 {
+			chunk = FormatSize(chunkSize)
+		}
+		throughput := uint64(float64(t.BytesDeduped) / elapsed.Seconds())
+		fmt.Fprintf(w, "%s\t%s\t%v\t%s/s\t%s\n",
+			chunk,
+			FormatSize(t.BytesDeduped),
+			elapsed.Round(time.Millisecond),
+			FormatSize(throughput),
+			status,
+		)
+	}
+}
+
+// freshCopy creates a copy of filePath in the same directory, which doesn't
+// share any extents with the original, and returns its path.
+func freshCopy(filePath string) (string, error) {
+	src, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	dst, err := os.CreateTemp(filepath.Dir(filePath), ".btrfs-optimize-bench-")
+	if err != nil {
+		return "", err
+	}
+	// Hide the files' types from io.Copy, so that it can't use
+	// copy_file_range, which reflinks on btrfs.
+	_, err = io.Copy(struct{ io.Writer }{dst}, struct{ io.Reader }{src})
+	if err == nil {
+		err = dst.Sync()
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dst.Name())
+		return "", err
+	}
+	return dst.Name(), nil
+}
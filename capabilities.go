@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"text/tabwriter"
+
+	"github.com/linux4life798/btrfs-optimize/fstools"
+	"github.com/spf13/cobra"
+)
+
+var capabilitiesCmd = &cobra.Command{
+	Use:   "capabilities [dir]",
+	Short: "Report which ioctls are supported by the filesystem",
+	Long: `Capabilities probes the FIEMAP, FIDEDUPERANGE, FICLONERANGE, and
+BTRFS_IOC_DEFRAG ioctls against temporary files created in dir (default is
+the current directory), and reports which are supported. This is intended
+for tools that wrap this CLI to decide which operations are safe to attempt.`,
+	Args:   cobra.MaximumNArgs(1),
+	Hidden: true,
+	Run:    runCapabilities,
+}
+
+func init() {
+	capabilitiesCmd.Flags().Bool("json", false, "Print the capabilities as JSON")
+	rootCmd.AddCommand(capabilitiesCmd)
+}
+
+func runCapabilities(cmd *cobra.Command, args []string) {
+	asJSON, _ := cmd.Flags().GetBool("json")
+	dir := "."
+	if len(args) > 0 {
+		dir = args[0]
+	}
+
+	caps, err := fstools.ProbeCapabilities(dir)
+	if err != nil {
+		printErrorf("Error probing capabilities in %s: %v\n", dir, err)
+		return
+	}
+
+	if asJSON {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(caps); err != nil {
+			printErrorf("Error encoding JSON: %v\n", err)
+		}
+		return
+	}
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "Ioctl\tStatus\tError")
+	for _, c := range caps {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", c.Name, c.Status, c.Error)
+	}
+	w.Flush()
+}
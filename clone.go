@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/linux4life798/btrfs-optimize/fstools"
+	"github.com/spf13/cobra"
+	"golang.org/x/sys/unix"
+)
+
+var cloneCmd = &cobra.Command{
+	Use:   "clone <source-file> <dest-file>",
+	Short: "Reflink a range of one file into another",
+	Long: `Clone makes a range of the destination file share the extents of a range of
+the source file, using the FICLONERANGE ioctl. By default, the whole source
+is cloned to the start of the destination.
+
+Unlike dedupe, clone replaces the destination range whatever its contents,
+so --force is required when the destination is not empty.
+
+The offsets and length must be multiples of the filesystem block size,
+except that the range may end at the end of the source.`,
+	Args: cobra.ExactArgs(2),
+	Run:  runClone,
+}
+
+func init() {
+	cloneCmd.Flags().String("src-offset", "0", "Offset in Bytes of the range in the source (e.g. 1MiB)")
+	cloneCmd.Flags().String("length", "0", "Length in Bytes of the range to clone, or 0 for up to the end of the source")
+	cloneCmd.Flags().String("dest-offset", "0", "Offset in Bytes to clone the range to in the destination")
+	cloneCmd.Flags().Bool("force", false, "Overwrite the range of a destination that is not empty")
+	cloneCmd.Flags().Bool("no-shared-check", false, "Always issue the clone, even when the range already shares the source's extents")
+	cloneCmd.Flags().BoolVar(&followSymlinks, "follow-symlinks", false, "Clone between the files that symlinked paths point to, instead of refusing them")
+	rootCmd.AddCommand(cloneCmd)
+}
+
+func runClone(cmd *cobra.Command, args []string) {
+	sourceFile, destFile := args[0], args[1]
+	force, _ := cmd.Flags().GetBool("force")
+
+	var offsets [3]uint64
+	for i, name := range []string{"src-offset", "length", "dest-offset"} {
+		str, _ := cmd.Flags().GetString(name)
+		n, err := ParseSize(str)
+		if err != nil {
+			printErrorf("Error parsing --%s: %v\n", name, err)
+			return
+		}
+		offsets[i] = n
+	}
+	srcOffset, length, destOffset := offsets[0], offsets[1], offsets[2]
+
+	srcFile, err := openSource(sourceFile)
+	if err != nil {
+		printErrorf("Error opening source file: %v\n", err)
+		return
+	}
+	defer srcFile.Close()
+
+	dest, err := openTarget(destFile, cloneTargetAccess)
+	if err != nil {
+		printErrorf("Error opening destination file: %v\n", err)
+		return
+	}
+	defer dest.Close()
+
+	srcInfo, err := srcFile.Stat()
+	if err != nil {
+		printErrorf("Error getting source file info: %v\n", err)
+		return
+	}
+	destInfo, err := dest.Stat()
+	if err != nil {
+		printErrorf("Error getting destination file info: %v\n", err)
+		return
+	}
+	if destInfo.Size() != 0 && !force {
+		printErrorf("Error: destination %s is not empty and cloning overwrites it; use --force\n", destFile)
+		return
+	}
+
+	blkSize, err := fstools.FileBlockSize(srcFile)
+	if err != nil {
+		printErrorf("Error getting source block size: %v\n", err)
+		return
+	}
+	srcSize := uint64(srcInfo.Size())
+	if length == 0 && srcOffset <= srcSize {
+		length = srcSize - srcOffset
+	}
+	if err := fstools.CheckRangeAlignment(srcOffset, destOffset, length, srcSize, blkSize); err != nil {
+		printErrorf("Error: %v\n", err)
+		return
+	}
+	if length == 0 {
+		fmt.Fprintln(out, "Nothing to clone.")
+		return
+	}
+
+	// Relinking a range that already shares the source's extents would
+	// only churn metadata. The check is skipped if the extents can't be
+	// read.
+	if noSharedCheck, _ := cmd.Flags().GetBool("no-shared-check"); !noSharedCheck {
+		srcExtents, srcErr := fstools.CollectExtents(srcFile, 0)
+		destExtents, destErr := fstools.CollectExtents(dest, 0)
+		if srcErr == nil && destErr == nil &&
+			fstools.AlreadySharedRange(srcExtents, srcOffset, destExtents, destOffset, length) {
+			fmt.Fprintf(out, "Destination %s already shares this range with the source, skipped.\n", destFile)
+			return
+		}
+	}
+
+	err = fstools.IoctlFileCloneRange(int(dest.Fd()), &unix.FileCloneRange{
+		Src_fd:      int64(srcFile.Fd()),
+		Src_offset:  srcOffset,
+		Src_length:  length,
+		Dest_offset: destOffset,
+	})
+	switch err {
+	case nil:
+	case unix.EOPNOTSUPP:
+		printErrorf("cloning not supported on this filesystem\n")
+		return
+	case unix.EINVAL:
+		// could be that the offsets are not block size aligned
+		printErrorf("arguments are incompatible or cloning not supported on this filesystem\n")
+		return
+	case unix.EXDEV:
+		printErrorf("source and destination must be on the same filesystem\n")
+		return
+	default:
+		printErrorf("Error during cloning: %v\n", err)
+		return
+	}
+	fmt.Fprintf(out, "Cloned %d Bytes from %s to %s.\n", length, sourceFile, destFile)
+}
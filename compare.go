@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/linux4life798/btrfs-optimize/fstools"
+	"github.com/spf13/cobra"
+)
+
+var compareCmd = &cobra.Command{
+	Use:   "compare <file-a> <file-b>",
+	Short: "Check whether two files are already identical in storage",
+	Long: `Compare checks whether two files have the same size and map every logical
+range to the same physical extent, which is what a reflink copy or a
+complete dedupe leaves behind. It only reads the extent maps, so it can
+confirm that a reflink or dedupe took effect without trusting its result.
+
+Prints "fully shared", "partially shared (N of M extents)", counting the
+extents of the first file, or "not shared". Use verify for a breakdown in
+bytes.
+
+Exits with a non-zero status unless the files are fully shared.`,
+	Args: cobra.ExactArgs(2),
+	Run:  runCompare,
+}
+
+func init() {
+	rootCmd.AddCommand(compareCmd)
+}
+
+func runCompare(cmd *cobra.Command, args []string) {
+	a, err := os.Open(args[0])
+	if err != nil {
+		printErrorf("Error opening %s: %v\n", args[0], err)
+		return
+	}
+	defer a.Close()
+	b, err := os.Open(args[1])
+	if err != nil {
+		printErrorf("Error opening %s: %v\n", args[1], err)
+		return
+	}
+	defer b.Close()
+
+	full, err := fstools.FilesShareAllExtents(a, b)
+	if err != nil {
+		printErrorf("Error comparing extents: %v\n", err)
+		return
+	}
+	if full {
+		fmt.Fprintln(out, "fully shared")
+		return
+	}
+	exitCode = 1
+
+	aExtents, err := fstools.CollectExtents(a, 0)
+	if err != nil {
+		printErrorf("Error reading extents of %s: %v\n", args[0], err)
+		return
+	}
+	bExtents, err := fstools.CollectExtents(b, 0)
+	if err != nil {
+		printErrorf("Error reading extents of %s: %v\n", args[1], err)
+		return
+	}
+	if n := fstools.CountSharedExtents(aExtents, bExtents); n > 0 {
+		fmt.Fprintf(out, "partially shared (%d of %d extents)\n", n, len(aExtents))
+	} else {
+		fmt.Fprintln(out, "not shared")
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/linux4life798/btrfs-optimize/fstools"
+	"github.com/spf13/cobra"
+	"golang.org/x/sys/unix"
+)
+
+var convertHardlinksCmd = &cobra.Command{
+	Use:   "convert-hardlinks <dir> [dir...]",
+	Short: "Replace hard links with reflinked copies that have their own inodes",
+	Long: `Convert-hardlinks finds the files under the given directories that are hard
+links to the same inode. The first path of each group, in sorted order, is
+kept, and every other path is replaced with a reflinked copy of it, made with
+FICLONE. The copies share the data, but have separate inodes, so their
+metadata can change independently.
+
+Each copy is cloned into a temporary file next to the link, given the same
+permissions, owner, and timestamps, and then renamed over the link, so the
+path never goes missing. Only links found under the given directories are
+converted.`,
+	Args: cobra.MinimumNArgs(1),
+	Run:  runConvertHardlinks,
+}
+
+func init() {
+	convertHardlinksCmd.Flags().Bool("dry-run", false, "List the links that would be converted, without converting them")
+	convertHardlinksCmd.Flags().Int("max-depth", -1, "Limit how many directories below each path is searched (0 = only top directory, -1 = unlimited)")
+	rootCmd.AddCommand(convertHardlinksCmd)
+}
+
+// inodeKey identifies an inode across the filesystems being walked.
+type inodeKey struct {
+	dev, ino uint64
+}
+
+func runConvertHardlinks(cmd *cobra.Command, args []string) {
+	dryRun, _ := cmd.Flags().GetBool("dry-run")
+	maxDepth, _ := cmd.Flags().GetInt("max-depth")
+
+	groups := make(map[inodeKey][]string)
+	// Overlapping directories, including a relative and an absolute path
+	// to the same directory, would otherwise list the same file twice,
+	// converting it into a copy of itself.
+	seen := make(map[string]bool)
+	for _, root := range args {
+		err := walkRegularFiles(cmd.Context(), root, maxDepth, func(path string) error {
+			var stat unix.Stat_t
+			if err := unix.Lstat(path, &stat); err != nil {
+				printErrorf("Error getting file info for %s: %v\n", path, err)
+				return nil
+			}
+			if stat.Nlink < 2 {
+				return nil
+			}
+			abs, err := filepath.Abs(path)
+			if err != nil {
+				printErrorf("Error resolving %s: %v\n", path, err)
+				return nil
+			}
+			if seen[abs] {
+				return nil
+			}
+			seen[abs] = true
+			key := inodeKey{uint64(stat.Dev), stat.Ino}
+			groups[key] = append(groups[key], path)
+			return nil
+		})
+		if interrupted(err) {
+			printErrorf("Conversion interrupted while searching for hard links.\n")
+			return
+		}
+		if err != nil {
+			printErrorf("Error walking %s: %v\n", root, err)
+		}
+	}
+
+	// Groups with a single path have their other links outside the
+	// given directories, so there is nothing to convert them to.
+	var linked [][]string
+	for _, paths := range groups {
+		if len(paths) < 2 {
+			continue
+		}
+		sort.Strings(paths)
+		linked = append(linked, paths)
+	}
+	sort.Slice(linked, func(i, j int) bool {
+		return linked[i][0] < linked[j][0]
+	})
+
+	var converted int
+	for _, paths := range linked {
+		keep := paths[0]
+		for _, path := range paths[1:] {
+			if err := cmd.Context().Err(); err != nil {
+				printErrorf("Conversion interrupted.\n")
+				fmt.Fprintf(out, "Converted %d hard links.\n", converted)
+				return
+			}
+			if dryRun {
+				fmt.Fprintf(out, "Would convert %s (linked to %s)\n", path, keep)
+				continue
+			}
+			if err := replaceWithReflink(keep, path); err != nil {
+				printErrorf("Error converting %s: %v\n", path, err)
+				continue
+			}
+			fmt.Fprintf(out, "Converted %s (linked to %s)\n", path, keep)
+			converted++
+		}
+	}
+
+	if dryRun {
+		fmt.Fprintf(out, "Found %d hard link groups.\n", len(linked))
+		return
+	}
+	fmt.Fprintf(out, "Converted %d hard links in %d groups.\n", converted, len(linked))
+}
+
+// replaceWithReflink replaces path, a hard link to the same inode as keep,
+// with a reflinked copy of keep that has the same permissions, owner, and
+// timestamps. The copy is made in a temporary file in path's directory and
+// renamed over path, so path always refers to one of the two.
+func replaceWithReflink(keep, path string) error {
+	src, err := openSource(keep)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %v", keep, err)
+	}
+	defer src.Close()
+
+	var stat unix.Stat_t
+	if err := unix.Fstat(int(src.Fd()), &stat); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".reflink-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %v", err)
+	}
+	tmpPath := tmp.Name()
+	renamed := false
+	defer func() {
+		tmp.Close()
+		if !renamed {
+			os.Remove(tmpPath)
+		}
+	}()
+
+	if err := fstools.CloneFile(tmp, src); err != nil {
+		return fmt.Errorf("failed to clone: %v", err)
+	}
+	if err := unix.Fchown(int(tmp.Fd()), int(stat.Uid), int(stat.Gid)); err != nil {
+		return fmt.Errorf("failed to set the owner: %v", err)
+	}
+	// The mode is set after the owner, since changing the owner clears the
+	// setuid and setgid bits.
+	if err := unix.Fchmod(int(tmp.Fd()), stat.Mode&07777); err != nil {
+		return fmt.Errorf("failed to set the permissions: %v", err)
+	}
+	times := []unix.Timespec{stat.Atim, stat.Mtim}
+	if err := unix.UtimesNano(tmpPath, times); err != nil {
+		return fmt.Errorf("failed to set the timestamps: %v", err)
+	}
+	// The copy is synced before the rename, so that a crash can't leave
+	// path replaced by a file that is missing its data or metadata.
+	if err := tmp.Sync(); err != nil {
+		return fmt.Errorf("failed to sync: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+	renamed = true
+	return nil
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/linux4life798/btrfs-optimize/fstools"
+	"github.com/linux4life798/btrfs-optimize/hashcache"
+	"github.com/schollz/progressbar/v3"
+)
+
+// contentKey identifies a group of files that are likely identical.
+type contentKey struct {
+	size int64
+	hash string
+}
+
+// runDedupeAuto hashes every regular file under roots, groups the files with
+// the same size and content hash, and dedupes each group against its first
+// member, in sorted order. The hash is only a prefilter, since the kernel
+// compares the bytes, so a target that turns out to differ, whether from a
+// hash collision or a change since hashing, is reported and left alone.
+//
+// The files are hashed with algorithm by up to workers goroutines at once,
+// to overlap the reads, while the groups are still deduped one at a time.
+// Unless cachePath is empty, the hashes of unchanged files are taken from
+// the hash cache there, and the new hashes are saved to it, even if the
+// run is interrupted.
+func runDedupeAuto(ctx context.Context, roots []string, algorithm, cachePath string, workers int, opts fstools.DedupeOptions, report *batchReport) {
+	var cache *hashcache.Cache
+	if cachePath != "" {
+		var err error
+		cache, err = hashcache.Load(cachePath, algorithm)
+		if err != nil {
+			printErrorf("Error loading hash cache: %v\n", err)
+			return
+		}
+	} else if _, err := fstools.NewHasher(algorithm); err != nil {
+		printErrorf("Error: %v\n", err)
+		return
+	}
+	files, _ := filterUniqueSizes(scanFiles(ctx, roots, -1))
+
+	groups := hashFileGroups(ctx, files, algorithm, cache, workers)
+	if cache != nil {
+		if err := cache.Save(); err != nil {
+			printErrorf("Error saving hash cache: %v\n", err)
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		printErrorf("Deduplication interrupted while hashing.\n")
+		return
+	}
+
+	var keys []contentKey
+	for key, paths := range groups {
+		if len(paths) > 1 {
+			sort.Strings(paths)
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return groups[keys[i]][0] < groups[keys[j]][0]
+	})
+
+	var processed, differs, failed int
+	var bytesDeduped uint64
+	for i, key := range keys {
+		paths := groups[key]
+		groupOpts := opts
+		if !quiet {
+			// The bar is only created once the dedupe starts, since a
+			// group whose targets are all skipped never reports progress.
+			var progressBar *progressbar.ProgressBar
+			groupOpts.Progress = func(deduped, length uint64, exit bool) {
+				if exit {
+					if progressBar != nil {
+						progressBar.Exit()
+					}
+					return
+				}
+				if progressBar == nil {
+					progressBar = progressbar.DefaultBytes(int64(length), fmt.Sprintf("group %d/%d", i+1, len(keys)))
+				}
+				progressBar.Set64(int64(deduped))
+			}
+		}
+
+		result, err := fstools.DedupeFilesContext(ctx, paths[0], paths[1:], groupOpts)
+		if interrupted(err) {
+			printErrorf("Deduplication interrupted at group %d of %d.\n", i+1, len(keys))
+			break
+		}
+		if err != nil {
+			printErrorf("Error deduping against %s: %v\n", paths[0], err)
+			failed += len(paths) - 1
+			continue
+		}
+		processed++
+
+		row := batchReportRow{Source: paths[0], Targets: len(result.Targets)}
+		for _, target := range result.Targets {
+			row.BytesDeduped += target.BytesDeduped
+			bytesDeduped += target.BytesDeduped
+			switch err := target.Err(); {
+			case target.Skipped != fstools.SkipNone:
+				row.Skipped++
+			case err == fstools.ErrDedupeDiffers:
+				fmt.Fprintf(out, "%s: content differs from %s despite the matching hash, skipped\n", target.Path, paths[0])
+				differs++
+				row.Skipped++
+			case err != nil:
+				printErrorf("Error deduping %s: %v\n", target.Path, err)
+				failed++
+				row.Failed++
+			default:
+				fmt.Fprintf(out, "%s: deduped %d Bytes\n", target.Path, target.BytesDeduped)
+				row.Deduped++
+			}
+		}
+		if err := report.Add(row); err != nil {
+			printErrorf("Error writing batch report: %v\n", err)
+		}
+	}
+
+	fmt.Fprintln(out, "Identical Groups :", len(keys))
+	fmt.Fprintln(out, "Groups Processed :", processed)
+	fmt.Fprintln(out, "Differs          :", differs)
+	fmt.Fprintln(out, "Failed           :", failed)
+	fmt.Fprintln(out, "Deduped   (Bytes):", bytesDeduped)
+}
+
+// hashFileGroups hashes files with algorithm, using up to workers
+// goroutines, and groups their paths by size and hash. Empty files are left
+// out, and files that can't be hashed are reported and skipped. If ctx is
+// cancelled, the remaining files are skipped.
+//
+// If cache isn't nil, the cached hashes of unchanged files are used instead
+// of hashing them, and the new hashes are added to it.
+func hashFileGroups(ctx context.Context, files []scannedFile, algorithm string, cache *hashcache.Cache, workers int) map[contentKey][]string {
+	var hashBar *progressbar.ProgressBar
+	if !quiet && isTerminal(os.Stdout) && len(files) > 0 {
+		hashBar = progressbar.Default(int64(len(files)), "hashing")
+		defer hashBar.Exit()
+	}
+
+	var mu sync.Mutex
+	groups := make(map[contentKey][]string)
+	paths := make(chan scannedFile)
+	var wg sync.WaitGroup
+	for range max(workers, 1) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for f := range paths {
+				if hashBar != nil {
+					hashBar.Add(1)
+				}
+				// Empty files have nothing to dedupe.
+				if f.info.Size() == 0 {
+					continue
+				}
+				hash, ok := "", false
+				if cache != nil {
+					hash, ok = cache.Lookup(f.path, f.info)
+				}
+				if !ok {
+					var err error
+					hash, err = hashcache.HashFile(f.path, algorithm)
+					if err != nil {
+						printErrorf("Error hashing %s: %v\n", f.path, err)
+						continue
+					}
+					if cache != nil {
+						cache.Put(f.path, f.info, hash)
+					}
+				}
+				key := contentKey{f.info.Size(), hash}
+				mu.Lock()
+				groups[key] = append(groups[key], f.path)
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, f := range files {
+		if ctx.Err() != nil {
+			break
+		}
+		paths <- f
+	}
+	close(paths)
+	wg.Wait()
+	return groups
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/linux4life798/btrfs-optimize/fstools"
+	"golang.org/x/sys/unix"
+)
+
+// checkpointInterval is how often the progress of a dedupe is saved to the
+// --checkpoint file, so that a crash or reboot loses at most this much work.
+const checkpointInterval = 30 * time.Second
+
+// checkpointFile identifies a file and the state it was in when the
+// checkpoint was taken, so that a resume can detect changed files.
+type checkpointFile struct {
+	Path    string `json:"path"`
+	Size    int64  `json:"size"`
+	MtimeNs int64  `json:"mtime_ns"`
+}
+
+// checkpointTarget is the dedupe progress of a single destination file.
+type checkpointTarget struct {
+	checkpointFile
+	DestOffset uint64 `json:"dest_offset"`
+	// DestEnd is where the range deduped in the target ends. The target is
+	// finished once DestOffset reaches it, which happens before the source
+	// range ends for a target shorter than the source.
+	DestEnd      uint64 `json:"dest_end"`
+	BytesDeduped uint64 `json:"bytes_deduped"`
+	Status       int32  `json:"status"`
+	// Skipped is why no dedupe was issued for the target, if any.
+	Skipped fstools.SkipReason `json:"skipped,omitempty"`
+}
+
+// dedupeCheckpoint records how far a dedupe got, so that it can be resumed
+// with the remaining range.
+type dedupeCheckpoint struct {
+	Source    checkpointFile     `json:"source"`
+	SrcOffset uint64             `json:"src_offset"`
+	SrcLength uint64             `json:"src_length"`
+	Targets   []checkpointTarget `json:"targets"`
+}
+
+// fdFileState returns the current size and mtime of the open file fd.
+func fdFileState(path string, fd int) (checkpointFile, error) {
+	var stat unix.Stat_t
+	if err := unix.Fstat(fd, &stat); err != nil {
+		return checkpointFile{}, err
+	}
+	return checkpointFile{
+		Path:    path,
+		Size:    stat.Size,
+		MtimeNs: stat.Mtim.Nano(),
+	}, nil
+}
+
+// matches returns an error if current does not describe the same, unchanged
+// file as c.
+func (c checkpointFile) matches(current checkpointFile) error {
+	if c.Path != current.Path {
+		return fmt.Errorf("checkpoint is for %s, not %s", c.Path, current.Path)
+	}
+	if c.Size != current.Size || c.MtimeNs != current.MtimeNs {
+		return fmt.Errorf("%s has changed since the checkpoint was taken", c.Path)
+	}
+	return nil
+}
+
+func loadDedupeCheckpoint(path string) (*dedupeCheckpoint, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var c dedupeCheckpoint
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("failed to parse checkpoint: %v", err)
+	}
+	return &c, nil
+}
+
+// save atomically writes the checkpoint to path.
+func (c *dedupeCheckpoint) save(path string) error {
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// update advances the checkpoint by the progress recorded in info, which
+// holds one entry per target listed in active, as returned by
+// FileDedupeRangeFullWithOptions. If skipped is not nil, it holds the
+// FileDedupeRangeOptions.BytesSkipped of each entry, which advance the
+// offsets, but aren't counted as deduped.
+func (c *dedupeCheckpoint) update(active []int, info []unix.FileDedupeRangeInfo, skipped []uint64) {
+	var srcProgress uint64
+	for i, index := range active {
+		t := &c.Targets[index]
+		t.DestOffset += info[i].Bytes_deduped
+		t.BytesDeduped += info[i].Bytes_deduped
+		if skipped != nil {
+			t.BytesDeduped -= skipped[i]
+		}
+		t.Status = info[i].Status
+		srcProgress = max(srcProgress, info[i].Bytes_deduped)
+	}
+	c.SrcOffset += srcProgress
+	c.SrcLength -= srcProgress
+}
+
+// advanced returns a copy of the checkpoint advanced by info, like update,
+// leaving c unchanged so that it can still be advanced by the final result.
+func (c *dedupeCheckpoint) advanced(active []int, info []unix.FileDedupeRangeInfo, skipped []uint64) *dedupeCheckpoint {
+	next := *c
+	next.Targets = slices.Clone(c.Targets)
+	next.update(active, info, skipped)
+	return &next
+}
+
+// periodicSaver returns a function for FileDedupeRangeOptions.Checkpoint
+// that saves c, advanced by value.Info and skipped, to path at most once
+// every checkpointInterval. A failed save is reported once and the dedupe
+// goes on.
+func (c *dedupeCheckpoint) periodicSaver(path string, active []int, value *unix.FileDedupeRange, skipped []uint64) func() {
+	lastSave := time.Now()
+	var failed bool
+	return func() {
+		if failed || time.Since(lastSave) < checkpointInterval {
+			return
+		}
+		lastSave = time.Now()
+		if err := c.advanced(active, value.Info, skipped).save(path); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: saving the checkpoint failed, continuing without it: %v\n", err)
+			failed = true
+		}
+	}
+}
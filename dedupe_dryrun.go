@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/linux4life798/btrfs-optimize/fstools"
+	"golang.org/x/sys/unix"
+)
+
+// printDryRun lists the predicted outcome of each destination of a dedupe
+// --dry-run. Destinations that would fail mark the run as failed, unless
+// they only differ and allowDiffers is set, as they would for the real
+// dedupe.
+func printDryRun(destinationFiles []string, targets []checkpointTarget, allowDiffers bool) {
+	var succeed, skipped, fail int
+	for i := range targets {
+		target := &targets[i]
+		switch {
+		case target.Skipped != fstools.SkipNone:
+			fmt.Fprintf(out, "Destination %s: would be skipped (%s)\n", destinationFiles[i], target.Skipped)
+			skipped++
+		case target.Status == unix.FILE_DEDUPE_RANGE_DIFFERS && allowDiffers:
+			fmt.Fprintf(out, "Destination %s: would be skipped (differs)\n", destinationFiles[i])
+			skipped++
+		case target.Status != unix.FILE_DEDUPE_RANGE_SAME:
+			printErrorf(
+				"Destination %s: would fail with %s\n",
+				destinationFiles[i],
+				fstools.FileDedupeRangeStatusToString(target.Status),
+			)
+			fail++
+		default:
+			fmt.Fprintf(out, "Destination %s: would succeed, deduping %d Bytes\n", destinationFiles[i], target.BytesDeduped)
+			succeed++
+		}
+	}
+	fmt.Fprintf(out, "Dry run: %d would succeed, %d would be skipped, %d would fail. Nothing was deduped.\n", succeed, skipped, fail)
+}
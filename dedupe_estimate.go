@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/linux4life798/btrfs-optimize/fstools"
+)
+
+// savingsEstimate is how much deduping a destination against a source could
+// save, assuming their contents match.
+type savingsEstimate struct {
+	// Unshared is the number of bytes mapped in both files, within their
+	// common length, that are not yet backed by the same storage.
+	Unshared uint64
+	// Reclaimable is the part of Unshared whose destination extents aren't
+	// flagged as shared with any other file, so it would actually be freed.
+	Reclaimable uint64
+}
+
+func (e *savingsEstimate) add(other savingsEstimate) {
+	e.Unshared += other.Unshared
+	e.Reclaimable += other.Reclaimable
+}
+
+// estimateSavings compares the extents of the source and destination paths
+// to estimate the savings of deduping them, without deduping anything.
+func estimateSavings(srcPath, destPath string) (savingsEstimate, error) {
+	src, err := openSource(srcPath)
+	if err != nil {
+		return savingsEstimate{}, err
+	}
+	defer src.Close()
+	dest, err := openTarget(destPath, dedupeTargetAccess)
+	if err != nil {
+		return savingsEstimate{}, err
+	}
+	defer dest.Close()
+	return estimateFileSavings(src, dest)
+}
+
+// estimateFileSavings is estimateSavings for files that are already open.
+func estimateFileSavings(src, dest *os.File) (savingsEstimate, error) {
+	srcInfo, err := src.Stat()
+	if err != nil {
+		return savingsEstimate{}, err
+	}
+	destInfo, err := dest.Stat()
+	if err != nil {
+		return savingsEstimate{}, err
+	}
+	srcExtents, err := fstools.CollectExtents(src, 0)
+	if err != nil {
+		return savingsEstimate{}, err
+	}
+	destExtents, err := fstools.CollectExtents(dest, 0)
+	if err != nil {
+		return savingsEstimate{}, err
+	}
+
+	// Only the common prefix of the files can be deduped, and only ranges
+	// that both map to different storage would change. A hole in either
+	// file has nothing to reclaim.
+	limit := uint64(min(srcInfo.Size(), destInfo.Size()))
+	var e savingsEstimate
+	for _, d := range fstools.DiffExtents(srcExtents, destExtents) {
+		if d.Kind != fstools.RangeDiffers || d.Logical >= limit {
+			continue
+		}
+		length := min(d.Length, limit-d.Logical)
+		e.Unshared += length
+		if d.BFlags&fstools.FIEMAP_EXTENT_SHARED == 0 {
+			e.Reclaimable += length
+		}
+	}
+	return e, nil
+}
+
+// runDedupeEstimate prints the estimated savings of deduping each of
+// destinationFiles against sourceFile, and their total.
+func runDedupeEstimate(sourceFile string, destinationFiles []string) {
+	var total savingsEstimate
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "DESTINATION\tUNSHARED\tRECLAIMABLE")
+	for _, destFile := range destinationFiles {
+		e, err := estimateSavings(sourceFile, destFile)
+		if err != nil {
+			w.Flush()
+			printErrorf("Error estimating savings for %s: %v\n", destFile, err)
+			continue
+		}
+		total.add(e)
+		fmt.Fprintf(w, "%s\t%d\t%d\n", destFile, e.Unshared, e.Reclaimable)
+	}
+	w.Flush()
+	printSavingsEstimate(total)
+}
+
+func printSavingsEstimate(e savingsEstimate) {
+	fmt.Fprintln(out, "Unshared              (Bytes):", e.Unshared)
+	fmt.Fprintln(out, "Estimated Reclaimable (Bytes):", e.Reclaimable)
+	fmt.Fprintln(out, "Estimates assume the contents match. Nothing was deduped.")
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/linux4life798/btrfs-optimize/fstools"
+	"github.com/schollz/progressbar/v3"
+	"golang.org/x/sys/unix"
+)
+
+// runDedupeLargestFirst dedupes each destination against the source one
+// matching range at a time, from the longest to the shortest, instead of
+// front to back. The matching ranges are found by comparing the blocks of
+// the files at the same offsets, so ranges that differ are never requested.
+// Deduping the long ranges first keeps them as whole shared extents, rather
+// than letting earlier small ranges split them into tiny reflinks.
+func runDedupeLargestFirst(ctx context.Context, sourceFile string, destinationFiles []string, opts fstools.FileDedupeRangeOptions) {
+	srcFile, err := openSource(sourceFile)
+	if err != nil {
+		printErrorf("Error opening source file: %v\n", err)
+		return
+	}
+	defer srcFile.Close()
+	if inline, err := fstools.HasInlineData(srcFile, 0); err == nil && inline {
+		printErrorf("Error: source %s: %v\n", sourceFile, fstools.ErrInlineData)
+		return
+	}
+
+	blkSize, err := fstools.FileBlockSize(srcFile)
+	if err != nil {
+		printErrorf("Error getting source block size: %v\n", err)
+		return
+	}
+
+	var errorSeen bool
+	for _, destFile := range destinationFiles {
+		err := dedupeLargestFirst(ctx, srcFile, destFile, blkSize, opts)
+		if interrupted(err) {
+			printErrorf("Deduplication interrupted.\n")
+			return
+		}
+		var noSpace *fstools.NoSpaceError
+		if errors.As(err, &noSpace) {
+			printErrorf("Error deduping %s: the filesystem ran out of space.\n%s\n", destFile, noSpaceHint)
+			return
+		}
+		if err != nil {
+			printErrorf("Error deduping %s: %v\n", destFile, err)
+			errorSeen = true
+		}
+	}
+	if !errorSeen {
+		fmt.Fprintln(out, "Deduplication completed successfully.")
+	}
+}
+
+// dedupeLargestFirst dedupes the ranges of destFile that match srcFile,
+// longest first, and reports the destination's extent count before and
+// after.
+func dedupeLargestFirst(ctx context.Context, srcFile *os.File, destFile string, blkSize uint64, opts fstools.FileDedupeRangeOptions) error {
+	dest, err := openTarget(destFile, dedupeTargetAccess)
+	if err != nil {
+		return fmt.Errorf("failed to open destination: %v", err)
+	}
+	defer dest.Close()
+
+	extentsBefore, err := fstools.FiemapExtentCount(dest, 0, fstools.FIEMAP_MAX_OFFSET, 0)
+	if err != nil {
+		return fmt.Errorf("failed to count extents: %v", err)
+	}
+
+	ranges, err := fstools.MatchingRanges(srcFile, dest, blkSize)
+	if err != nil {
+		return fmt.Errorf("failed to compare with the source: %v", err)
+	}
+	fstools.SortRangesBySize(ranges)
+
+	var total uint64
+	for _, r := range ranges {
+		total += r.Length
+	}
+	if !quiet && total > 0 {
+		progressBar := progressbar.DefaultBytes(int64(total), "deduping")
+		defer progressBar.Exit()
+		// Each range reports its own progress, so the lengths of the
+		// finished ranges are carried over.
+		var done, length uint64
+		opts.Progress = func(bytesDeduped, bytesLength uint64, exit bool) {
+			if exit {
+				done += length
+				return
+			}
+			length = bytesLength
+			progressBar.Set64(int64(done + bytesDeduped))
+		}
+	}
+
+	var deduped uint64
+	for _, r := range ranges {
+		value := &unix.FileDedupeRange{
+			Src_offset: r.Offset,
+			Src_length: r.Length,
+			Info: []unix.FileDedupeRangeInfo{
+				{
+					Dest_fd:     int64(dest.Fd()),
+					Dest_offset: r.Offset,
+				},
+			},
+		}
+		err := fstools.FileDedupeRangeFullWithOptions(ctx, int(srcFile.Fd()), value, opts)
+		deduped += value.Info[0].Bytes_deduped
+		if err != nil {
+			return err
+		}
+		// The files may have changed since they were compared.
+		if status := value.Info[0].Status; status != unix.FILE_DEDUPE_RANGE_SAME {
+			return fmt.Errorf(
+				"range at offset %d failed with %s",
+				r.Offset,
+				fstools.FileDedupeRangeStatusToString(status),
+			)
+		}
+	}
+
+	extentsAfter, err := fstools.FiemapExtentCount(dest, 0, fstools.FIEMAP_MAX_OFFSET, fstools.FIEMAP_FLAG_SYNC)
+	if err != nil {
+		return fmt.Errorf("failed to count extents: %v", err)
+	}
+	fmt.Fprintf(
+		out,
+		"Destination %s: deduped %d Bytes in %d ranges, largest first.\n",
+		destFile,
+		deduped,
+		len(ranges),
+	)
+	fmt.Fprintln(out, "Extents (Before):", extentsBefore)
+	fmt.Fprintln(out, "Extents (After) :", extentsAfter)
+	return nil
+}
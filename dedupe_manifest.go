@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/linux4life798/btrfs-optimize/fstools"
+	"golang.org/x/sys/unix"
+)
+
+// dedupeManifest is a list of ranges to dedupe, typically generated by an
+// external dedupe planner.
+type dedupeManifest struct {
+	Entries []dedupeManifestEntry `json:"entries"`
+}
+
+// dedupeManifestEntry dedupes Length bytes of Target at DestOffset against
+// Source at SrcOffset. A zero Length means until the end of the source.
+type dedupeManifestEntry struct {
+	Source     string `json:"source"`
+	Target     string `json:"target"`
+	SrcOffset  uint64 `json:"src_offset"`
+	DestOffset uint64 `json:"dest_offset"`
+	Length     uint64 `json:"length"`
+}
+
+func loadDedupeManifest(path string) (*dedupeManifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var m dedupeManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest: %v", err)
+	}
+	return &m, nil
+}
+
+// runDedupeManifest executes every entry of the manifest at manifestPath,
+// reporting the result of each.
+// If autoAlign is set, misaligned entries are shrunk to their block aligned
+// portion instead of being rejected.
+// Each entry is added to report as a group with a single target.
+func runDedupeManifest(ctx context.Context, manifestPath string, autoAlign bool, opts fstools.FileDedupeRangeOptions, report *batchReport) {
+	manifest, err := loadDedupeManifest(manifestPath)
+	if err != nil {
+		printErrorf("Error loading manifest %s: %v\n", manifestPath, err)
+		return
+	}
+
+	var totalDeduped, totalSkipped uint64
+	for i, entry := range manifest.Entries {
+		deduped, skipped, err := dedupeManifestRange(ctx, entry, autoAlign, opts)
+		totalSkipped += skipped
+		if interrupted(err) {
+			printErrorf("Deduplication interrupted at entry %d.\n", i)
+			return
+		}
+
+		row := batchReportRow{Source: entry.Source, Targets: 1, BytesDeduped: deduped}
+		switch {
+		case err != nil:
+			row.Failed = 1
+		case deduped == 0:
+			row.Skipped = 1
+		default:
+			row.Deduped = 1
+		}
+		if err := report.Add(row); err != nil {
+			printErrorf("Error writing batch report: %v\n", err)
+		}
+
+		if err != nil {
+			printErrorf(
+				"Entry %d (%s -> %s): %v\n",
+				i,
+				entry.Source,
+				entry.Target,
+				err,
+			)
+			continue
+		}
+		totalDeduped += deduped
+		fmt.Fprintf(
+			out,
+			"Entry %d (%s -> %s): deduped %d Bytes",
+			i,
+			entry.Source,
+			entry.Target,
+			deduped,
+		)
+		if skipped != 0 {
+			fmt.Fprintf(out, ", skipped %d Bytes at the edges due to alignment", skipped)
+		}
+		fmt.Fprintln(out)
+	}
+	fmt.Fprintf(out, "Deduped %d Bytes across %d entries.\n", totalDeduped, len(manifest.Entries))
+	if totalSkipped != 0 {
+		fmt.Fprintf(out, "Skipped %d Bytes due to alignment.\n", totalSkipped)
+	}
+}
+
+func dedupeManifestRange(ctx context.Context, entry dedupeManifestEntry, autoAlign bool, opts fstools.FileDedupeRangeOptions) (deduped, skipped uint64, err error) {
+	srcFile, err := openSource(entry.Source)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to open source: %v", err)
+	}
+	defer srcFile.Close()
+
+	destFile, err := openTarget(entry.Target, dedupeTargetAccess)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to open target: %v", err)
+	}
+	defer destFile.Close()
+
+	srcInfo, err := srcFile.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+	blkSize, err := fstools.FileBlockSize(srcFile)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	srcSize := uint64(srcInfo.Size())
+	srcOffset, destOffset, length := entry.SrcOffset, entry.DestOffset, entry.Length
+	if length == 0 && srcOffset <= srcSize {
+		length = srcSize - srcOffset
+	}
+	if autoAlign {
+		srcOffset, destOffset, length, skipped, err = fstools.AutoAlignRange(srcOffset, destOffset, length, srcSize, blkSize)
+		if err != nil {
+			return 0, 0, err
+		}
+		if length == 0 {
+			return 0, skipped, nil
+		}
+	}
+	if err := fstools.CheckRangeAlignment(srcOffset, destOffset, length, srcSize, blkSize); err != nil {
+		return 0, skipped, err
+	}
+
+	value := &unix.FileDedupeRange{
+		Src_offset: srcOffset,
+		Src_length: length,
+		Info: []unix.FileDedupeRangeInfo{
+			{
+				Dest_fd:     int64(destFile.Fd()),
+				Dest_offset: destOffset,
+			},
+		},
+	}
+	if err := fstools.FileDedupeRangeFullWithOptions(ctx, int(srcFile.Fd()), value, opts); err != nil {
+		return 0, skipped, err
+	}
+	if status := value.Info[0].Status; status != unix.FILE_DEDUPE_RANGE_SAME {
+		return value.Info[0].Bytes_deduped, skipped, fmt.Errorf("failed with %s", fstools.FileDedupeRangeStatusToString(status))
+	}
+	return value.Info[0].Bytes_deduped, skipped, nil
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/linux4life798/btrfs-optimize/fstools"
+	"github.com/schollz/progressbar/v3"
+)
+
+// mirrorCounts tallies the outcome of a mirrored dedupe.
+// It is updated through add, which is safe to call concurrently.
+type mirrorCounts struct {
+	mu sync.Mutex
+
+	Matched    int // destination exists with the same size
+	Deduped    int
+	Shared     int // already shared, so nothing was done
+	Mismatched int // size or content differs
+	Inline     int // data stored inline in the metadata, which can't be deduped
+	Missing    int
+	Failed     int
+	Bytes      uint64
+
+	// Estimate totals the savings estimated with --estimate, in which
+	// case nothing is deduped.
+	Estimate savingsEstimate
+}
+
+// add increments the count that field points into, while holding the lock.
+func (c *mirrorCounts) add(field *int) {
+	c.mu.Lock()
+	*field++
+	c.mu.Unlock()
+}
+
+// mirrorRun holds the settings shared by every pair of a mirrored dedupe.
+type mirrorRun struct {
+	ctx      context.Context
+	opts     fstools.DedupeOptions
+	estimate bool
+	report   *batchReport
+	counts   mirrorCounts
+
+	// progress shows a progress bar for each pair, described with the
+	// pair's position among total source files. It is only set when
+	// pairs are deduped one at a time.
+	progress bool
+	total    int
+}
+
+// runDedupeMirror dedupes every regular file under srcDir against the file
+// at the same relative path under dstDir, if one exists with the same size.
+// The kernel's byte comparison confirms the content, so no hashing is done.
+// Source files without a counterpart are skipped with a warning.
+//
+// If perDevice is positive, up to that many pairs are deduped at once for
+// each device the destinations are on, otherwise one pair at a time.
+// If estimate is set, the savings are only estimated, as with --estimate.
+func runDedupeMirror(ctx context.Context, srcDir, dstDir string, opts fstools.DedupeOptions, perDevice int, estimate bool, report *batchReport) {
+	run := &mirrorRun{
+		ctx:      ctx,
+		opts:     opts,
+		estimate: estimate,
+		report:   report,
+	}
+	var scheduler *deviceScheduler
+	if perDevice > 0 {
+		scheduler = newDeviceScheduler(perDevice)
+	}
+
+	// The source tree is listed up front, so that the overall position
+	// can be shown while deduping.
+	var srcPaths []string
+	err := walkRegularFiles(ctx, srcDir, -1, func(srcPath string) error {
+		srcPaths = append(srcPaths, srcPath)
+		return nil
+	})
+	run.total = len(srcPaths)
+	run.progress = !quiet && !estimate && scheduler == nil
+
+	for i, srcPath := range srcPaths {
+		if err != nil {
+			break
+		}
+		if err = ctx.Err(); err != nil {
+			break
+		}
+		var rel string
+		rel, err = filepath.Rel(srcDir, srcPath)
+		if err != nil {
+			break
+		}
+		dstPath := filepath.Join(dstDir, rel)
+		if scheduler == nil {
+			run.pair(i+1, srcPath, dstPath)
+			continue
+		}
+		scheduler.Go(deviceOf(dstPath), func() {
+			run.pair(i+1, srcPath, dstPath)
+		})
+	}
+	if scheduler != nil {
+		scheduler.Wait()
+	}
+	if interrupted(err) {
+		printErrorf("Deduplication interrupted.\n")
+	} else if err != nil {
+		printErrorf("Error walking %s: %v\n", srcDir, err)
+	}
+
+	counts := &run.counts
+	fmt.Fprintln(out, "Matched          :", counts.Matched)
+	if estimate {
+		fmt.Fprintln(out, "Mismatched       :", counts.Mismatched)
+		fmt.Fprintln(out, "Missing          :", counts.Missing)
+		fmt.Fprintln(out, "Failed           :", counts.Failed)
+		printSavingsEstimate(counts.Estimate)
+		return
+	}
+	fmt.Fprintln(out, "Deduped          :", counts.Deduped)
+	fmt.Fprintln(out, "Already Shared   :", counts.Shared)
+	fmt.Fprintln(out, "Mismatched       :", counts.Mismatched)
+	fmt.Fprintln(out, "Inline           :", counts.Inline)
+	fmt.Fprintln(out, "Missing          :", counts.Missing)
+	fmt.Fprintln(out, "Failed           :", counts.Failed)
+	fmt.Fprintln(out, "Deduped   (Bytes):", counts.Bytes)
+}
+
+// pair dedupes, or estimates the savings of deduping, dstPath against
+// srcPath, which is the n-th of the run's source files.
+// It is safe to call concurrently.
+func (run *mirrorRun) pair(n int, srcPath, dstPath string) {
+	counts := &run.counts
+	srcInfo, err := os.Stat(srcPath)
+	if err != nil {
+		printErrorf("Error getting source file info %s: %v\n", srcPath, err)
+		counts.add(&counts.Failed)
+		return
+	}
+	dstInfo, err := os.Lstat(dstPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		fmt.Fprintf(os.Stderr, "Warning: %s has no counterpart at %s, skipped.\n", srcPath, dstPath)
+		counts.add(&counts.Missing)
+		return
+	}
+	if err != nil {
+		printErrorf("Error getting destination file info %s: %v\n", dstPath, err)
+		counts.add(&counts.Failed)
+		return
+	}
+	if dstInfo.Mode()&fs.ModeSymlink != 0 && followSymlinks {
+		dstInfo, err = os.Stat(dstPath)
+		if err != nil {
+			printErrorf("Error getting destination file info %s: %v\n", dstPath, err)
+			counts.add(&counts.Failed)
+			return
+		}
+	}
+	if !dstInfo.Mode().IsRegular() || dstInfo.Size() != srcInfo.Size() {
+		counts.add(&counts.Mismatched)
+		return
+	}
+	counts.add(&counts.Matched)
+	if srcInfo.Size() == 0 {
+		return
+	}
+
+	if run.estimate {
+		e, err := estimateSavings(srcPath, dstPath)
+		if err != nil {
+			printErrorf("Error estimating savings for %s: %v\n", dstPath, err)
+			counts.add(&counts.Failed)
+			return
+		}
+		counts.mu.Lock()
+		counts.Estimate.add(e)
+		counts.mu.Unlock()
+		return
+	}
+
+	row := batchReportRow{Source: srcPath, Targets: 1}
+	defer func() {
+		if err := run.report.Add(row); err != nil {
+			printErrorf("Error writing batch report: %v\n", err)
+		}
+	}()
+
+	opts := run.opts
+	if run.progress {
+		// The bar is only created once the dedupe starts, since targets
+		// that are skipped never report progress.
+		var progressBar *progressbar.ProgressBar
+		opts.Progress = func(bytesDeduped, bytesLength uint64, exit bool) {
+			if exit {
+				if progressBar != nil {
+					progressBar.Exit()
+				}
+				return
+			}
+			if progressBar == nil {
+				progressBar = progressbar.DefaultBytes(int64(bytesLength), fmt.Sprintf("file %d/%d", n, run.total))
+			}
+			progressBar.Set64(int64(bytesDeduped))
+		}
+	}
+	result, err := fstools.DedupeFilesContext(run.ctx, srcPath, []string{dstPath}, opts)
+	if errors.Is(err, fstools.ErrInlineData) {
+		counts.add(&counts.Inline)
+		row.Skipped = 1
+		return
+	}
+	if err != nil {
+		printErrorf("Error deduping %s: %v\n", dstPath, err)
+		counts.add(&counts.Failed)
+		row.Failed = 1
+		return
+	}
+	target := result.Targets[0]
+	row.BytesDeduped = target.BytesDeduped
+	counts.mu.Lock()
+	counts.Bytes += target.BytesDeduped
+	counts.mu.Unlock()
+	switch err := target.Err(); {
+	case target.Skipped == fstools.SkipInline:
+		counts.add(&counts.Inline)
+		row.Skipped = 1
+	case target.Skipped != fstools.SkipNone:
+		counts.add(&counts.Shared)
+		row.Skipped = 1
+	case err == fstools.ErrDedupeDiffers:
+		fmt.Fprintf(out, "%s: content differs from %s\n", dstPath, srcPath)
+		counts.add(&counts.Mismatched)
+		row.Skipped = 1
+	case err != nil:
+		printErrorf("Error deduping %s: %v\n", dstPath, err)
+		counts.add(&counts.Failed)
+		row.Failed = 1
+	default:
+		fmt.Fprintf(out, "%s: deduped %d Bytes\n", dstPath, target.BytesDeduped)
+		counts.add(&counts.Deduped)
+		row.Deduped = 1
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+
+	"github.com/linux4life798/btrfs-optimize/fstools"
+)
+
+// sharingChange is how many bytes of a destination were physically shared
+// with the source before and after deduping it.
+type sharingChange struct {
+	Path         string `json:"path"`
+	SharedBefore uint64 `json:"shared_before_bytes"`
+	SharedAfter  uint64 `json:"shared_after_bytes"`
+}
+
+// sharedBytes returns the number of bytes of dest that are backed by the
+// same physical storage as src.
+func sharedBytes(src, dest *os.File) (uint64, error) {
+	srcExtents, err := fstools.CollectExtents(src, 0)
+	if err != nil {
+		return 0, err
+	}
+	destExtents, err := fstools.CollectExtents(dest, 0)
+	if err != nil {
+		return 0, err
+	}
+	return fstools.CompareSharing(srcExtents, destExtents).TotalShared(), nil
+}
+
+// measureSharing records the bytes each of dests shares with src, as the
+// before value if after is false, otherwise as the after value.
+func measureSharing(changes []sharingChange, src *os.File, dests []*os.File, after bool) {
+	for i, dest := range dests {
+		shared, err := sharedBytes(src, dest)
+		if err != nil {
+			printErrorf("Error measuring sharing of %s: %v\n", changes[i].Path, err)
+			continue
+		}
+		if after {
+			changes[i].SharedAfter = shared
+		} else {
+			changes[i].SharedBefore = shared
+		}
+	}
+}
+
+// printSharingChanges prints the change in sharing of each destination as
+// a table, or as JSON if asJSON is set.
+func printSharingChanges(w io.Writer, changes []sharingChange, asJSON bool) {
+	if asJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(changes); err != nil {
+			printErrorf("Error encoding JSON: %v\n", err)
+		}
+		return
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "DESTINATION\tSHARED-BEFORE\tSHARED-AFTER\tGAINED")
+	for _, c := range changes {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\n", c.Path, c.SharedBefore, c.SharedAfter, int64(c.SharedAfter)-int64(c.SharedBefore))
+	}
+	tw.Flush()
+}
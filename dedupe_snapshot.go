@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/linux4life798/btrfs-optimize/fstools"
+)
+
+// createSourceSnapshot creates a temporary read-only snapshot of the
+// subvolume subvol, next to it in its parent directory, and returns the path
+// of sourcePath within the snapshot. The returned cleanup function deletes
+// the snapshot.
+func createSourceSnapshot(subvol, sourcePath string) (string, func(), error) {
+	subvolAbs, err := filepath.Abs(subvol)
+	if err != nil {
+		return "", nil, err
+	}
+	sourceAbs, err := filepath.Abs(sourcePath)
+	if err != nil {
+		return "", nil, err
+	}
+	rel, err := filepath.Rel(subvolAbs, sourceAbs)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", nil, fmt.Errorf("source %s is not inside subvolume %s", sourcePath, subvol)
+	}
+
+	parent := filepath.Dir(subvolAbs)
+	name := fmt.Sprintf(".btrfs-optimize-snapshot-%d", os.Getpid())
+	if err := fstools.BtrfsSnapshotCreate(subvolAbs, parent, name, true); err != nil {
+		return "", nil, fmt.Errorf("failed to create snapshot of %s: %v", subvol, err)
+	}
+
+	snapshotPath := filepath.Join(parent, name)
+	cleanup := func() {
+		if err := fstools.BtrfsSnapshotDestroy(parent, name); err != nil {
+			printErrorf("Error deleting snapshot %s: %v\n", snapshotPath, err)
+		}
+	}
+	return filepath.Join(snapshotPath, rel), cleanup, nil
+}
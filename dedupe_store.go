@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/linux4life798/btrfs-optimize/fstools"
+)
+
+// runDedupeStore dedupes every file in filePaths against the holding file at
+// storePath, appending unique blocks to the store as needed.
+func runDedupeStore(storePath string, blockSize uint64, filePaths []string) {
+	store, err := fstools.OpenDedupeStore(storePath, blockSize)
+	if err != nil {
+		printErrorf("Error opening store %s: %v\n", storePath, err)
+		return
+	}
+	defer store.Close()
+
+	storeAbs, _ := filepath.Abs(storePath)
+
+	var totalReflinked uint64
+	for _, filePath := range filePaths {
+		if abs, _ := filepath.Abs(filePath); abs == storeAbs {
+			printErrorf("Error: skipping %s, since it is the store itself\n", filePath)
+			continue
+		}
+
+		file, err := os.Open(filePath)
+		if err != nil {
+			printErrorf("Error opening file %s: %v\n", filePath, err)
+			continue
+		}
+		result, err := store.AddFile(file)
+		file.Close()
+		if err != nil {
+			printErrorf("Error adding %s to store: %v\n", filePath, err)
+			continue
+		}
+
+		for _, failure := range result.Failed {
+			printErrorf(
+				"Error deduping %s: %d Bytes at offset %d failed with %s\n",
+				filePath,
+				failure.Length,
+				failure.Offset,
+				fstools.FileDedupeRangeStatusToString(failure.Status),
+			)
+		}
+
+		totalReflinked += result.BytesReflinked
+		fmt.Fprintf(
+			out,
+			"%s: reflinked %d Bytes, appended %d Bytes to store\n",
+			filePath,
+			result.BytesReflinked,
+			result.BytesAppended,
+		)
+	}
+
+	fmt.Fprintln(out, "Store Size      (Bytes):", store.Size())
+	fmt.Fprintln(out, "Total Reflinked (Bytes):", totalReflinked)
+}
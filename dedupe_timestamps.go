@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// fileTimes holds the access and modification times of a file, so that they
+// can be restored after it was deduped.
+type fileTimes struct {
+	path  string
+	times [2]unix.Timespec // atime, mtime
+}
+
+// saveFileTimes records the current access and modification times of each
+// of paths.
+func saveFileTimes(paths []string) ([]fileTimes, error) {
+	saved := make([]fileTimes, 0, len(paths))
+	for _, path := range paths {
+		var stat unix.Stat_t
+		if err := unix.Stat(path, &stat); err != nil {
+			return nil, fmt.Errorf("failed to stat %s: %v", path, err)
+		}
+		saved = append(saved, fileTimes{
+			path:  path,
+			times: [2]unix.Timespec{stat.Atim, stat.Mtim},
+		})
+	}
+	return saved, nil
+}
+
+// restoreFileTimes sets the access and modification times of each file back
+// to what was saved, reporting any file that couldn't be restored.
+// Files that were deleted in the meantime are skipped.
+func restoreFileTimes(saved []fileTimes) {
+	for _, f := range saved {
+		err := unix.UtimesNano(f.path, f.times[:])
+		if err == unix.ENOENT {
+			continue
+		}
+		if err != nil {
+			printErrorf("Error restoring the timestamps of %s: %v\n", f.path, err)
+		}
+	}
+}
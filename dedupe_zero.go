@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/linux4life798/btrfs-optimize/fstools"
+)
+
+// punchZeroRanges finds the block aligned zero filled ranges of the file at
+// filePath and punches holes over them, returning the number of bytes
+// deallocated.
+func punchZeroRanges(filePath string) (uint64, error) {
+	file, err := openTarget(filePath, os.O_RDWR)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	blkSize, err := fstools.FileBlockSize(file)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get block size: %v", err)
+	}
+	ranges, err := fstools.ZeroRanges(file, blkSize)
+	if err != nil {
+		return 0, fmt.Errorf("failed to scan for zeros: %v", err)
+	}
+
+	var punched uint64
+	for _, r := range ranges {
+		if err := fstools.PunchHole(int(file.Fd()), r.Offset, r.Length); err != nil {
+			return punched, fmt.Errorf("failed to punch hole at %d: %v", r.Offset, err)
+		}
+		punched += r.Length
+	}
+	return punched, nil
+}
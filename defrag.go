@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"text/tabwriter"
+
+	"github.com/linux4life798/btrfs-optimize/fstools"
+	"github.com/spf13/cobra"
+	"golang.org/x/sys/unix"
+)
+
+var defragCmd = &cobra.Command{
+	Use:   "defrag <file-path1> [file-path2...]",
+	Short: "Defragment files that are above a fragmentation threshold",
+	Long: `Defrag computes a fragmentation score for each file and defragments the
+files scoring above the threshold using BTRFS_IOC_DEFRAG.
+
+The score is the number of physically contiguous runs of extents divided by
+the fewest runs the file could be stored in, so a perfectly laid out file
+scores 1.
+
+Use --dry-run to only list the files that would be defragmented.
+
+Defragmenting rewrites a file's data into new extents, so any extents it
+shared with other files through snapshots, reflinks, or deduplication are
+unshared and take up space again. With --warn-shared, files with shared
+extents are skipped with a warning. With --preserve-sharing, the extents
+each file shares with the other given files are recorded first, and those
+files are deduped against the defragmented file afterwards, so the sharing
+is restored. Extents shared with files that weren't given are still
+unshared, which is warned about.
+
+The --target-extent-size and --compress options match the -t and -c options
+of "btrfs filesystem defragment".`,
+	Args: cobra.MinimumNArgs(1),
+	Run:  runDefrag,
+}
+
+func init() {
+	defragCmd.Flags().Bool("dry-run", false, "List the files that would be defragmented, without defragmenting them")
+	defragCmd.Flags().Float64("threshold", 1, "Only consider files with a fragmentation score above this value")
+	defragCmd.Flags().String("target-extent-size", "", "Leave extents of at least this size alone, like 32M (default is the kernel's)")
+	defragCmd.Flags().String("compress", "", "Recompress the data while defragmenting: zlib, lzo, zstd, or none")
+	defragCmd.Flags().Bool("warn-shared", false, "Skip files with shared extents, with a warning, instead of unsharing them")
+	defragCmd.Flags().Bool("preserve-sharing", false, "Dedupe the other given files that shared extents with each file against it after defragmenting")
+	defragCmd.Flags().Bool("json", false, "Print the candidate files as JSON")
+	defragCmd.Flags().BoolP("sync", "s", false, "Sync the files to disk before requeting the extents map")
+	defragCmd.Flags().BoolP("recursive", "r", false, "Descend into directories")
+	defragCmd.Flags().Int("max-depth", -1, "Limit how deep --recursive descends, or -1 for no limit")
+	rootCmd.AddCommand(defragCmd)
+}
+
+// defragCandidate is a file whose fragmentation score is above the
+// threshold.
+type defragCandidate struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+	fstools.Fragmentation
+}
+
+func runDefrag(cmd *cobra.Command, args []string) {
+	dryRun, _ := cmd.Flags().GetBool("dry-run")
+	threshold, _ := cmd.Flags().GetFloat64("threshold")
+	asJSON, _ := cmd.Flags().GetBool("json")
+	syncFirst, _ := cmd.Flags().GetBool("sync")
+	recursive, _ := cmd.Flags().GetBool("recursive")
+	maxDepth, _ := cmd.Flags().GetInt("max-depth")
+	warnShared, _ := cmd.Flags().GetBool("warn-shared")
+	preserveSharing, _ := cmd.Flags().GetBool("preserve-sharing")
+	if warnShared && preserveSharing {
+		printErrorf("Error: --warn-shared and --preserve-sharing can't be used together\n")
+		return
+	}
+
+	var flags uint32
+	if syncFirst {
+		flags |= fstools.FIEMAP_FLAG_SYNC
+	}
+
+	rangeArgs, err := defragRangeArgs(cmd)
+	if err != nil {
+		printErrorf("Error: %v\n", err)
+		return
+	}
+
+	paths, err := expandPaths(cmd.Context(), args, recursive, maxDepth)
+	if err != nil {
+		printErrorf("Error walking directory: %v\n", err)
+		return
+	}
+
+	var candidates []defragCandidate
+	// shared holds the extents of every file with shared extents, for
+	// finding sharing partners with --preserve-sharing.
+	shared := make(map[string][]fstools.FiemapExtent)
+	for _, filePath := range paths {
+		info, err := os.Stat(filePath)
+		if err != nil {
+			printErrorf("Error getting file info for %s: %v\n", filePath, err)
+			continue
+		}
+		extents, err := collectFileExtents(filePath, flags)
+		if err != nil {
+			printErrorf("Error reading extents of %s: %v\n", filePath, err)
+			continue
+		}
+		if preserveSharing && sharedExtentBytes(extents) > 0 {
+			shared[filePath] = extents
+		}
+		frag := fstools.FragmentationScore(extents)
+		if frag.Score <= threshold {
+			continue
+		}
+		if n := sharedExtentBytes(extents); warnShared && n > 0 {
+			fmt.Fprintf(os.Stderr, "Warning: %s has %d Bytes in shared extents, which defragmenting would unshare, skipped.\n", filePath, n)
+			continue
+		}
+		candidates = append(candidates, defragCandidate{
+			Path:          filePath,
+			Size:          info.Size(),
+			Fragmentation: frag,
+		})
+	}
+
+	if asJSON {
+		if candidates == nil {
+			candidates = []defragCandidate{}
+		}
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(candidates); err != nil {
+			printErrorf("Error encoding JSON: %v\n", err)
+		}
+	} else {
+		w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "SCORE\tFRAGMENTS\tEXTENTS\tSIZE\tPATH")
+		for _, c := range candidates {
+			fmt.Fprintf(w, "%.2f\t%d\t%d\t%d\t%s\n", c.Score, c.Fragments, c.Extents, c.Size, c.Path)
+		}
+		w.Flush()
+	}
+
+	if dryRun {
+		return
+	}
+	for i, c := range candidates {
+		if err := cmd.Context().Err(); err != nil {
+			printErrorf("Defragmentation interrupted after %d of %d files.\n", i, len(candidates))
+			return
+		}
+		var partners []sharingPartner
+		if _, ok := shared[c.Path]; ok {
+			partners = findSharingPartners(c.Path, shared)
+			if lost := sharedExtentBytes(shared[c.Path]) - linkedBytes(partners); lost > 0 {
+				fmt.Fprintf(os.Stderr, "Warning: %s has %d Bytes shared with files that weren't given, which will be unshared.\n", c.Path, lost)
+			}
+		}
+		if err := defragFile(c.Path, rangeArgs); err != nil {
+			printErrorf("Error defragmenting %s: %v\n", c.Path, err)
+			continue
+		}
+		if !asJSON {
+			fmt.Fprintf(out, "Defragmented %s\n", c.Path)
+		}
+		if len(partners) == 0 {
+			continue
+		}
+		reshared, err := reshare(cmd.Context(), c.Path, partners)
+		if err != nil {
+			printErrorf("Error resharing %s: %v\n", c.Path, err)
+		}
+		if !asJSON {
+			fmt.Fprintf(out, "Reshared %d Bytes of %s with %d files\n", reshared, c.Path, len(partners))
+		}
+	}
+}
+
+// defragRangeArgs builds the defrag range arguments from the
+// --target-extent-size and --compress flags, covering the whole file.
+func defragRangeArgs(cmd *cobra.Command) (fstools.BtrfsDefragRangeArgs, error) {
+	targetExtentSize, _ := cmd.Flags().GetString("target-extent-size")
+	compress, _ := cmd.Flags().GetString("compress")
+
+	args := fstools.BtrfsDefragRangeArgs{Len: math.MaxUint64}
+	if targetExtentSize != "" {
+		size, err := ParseSize(targetExtentSize)
+		if err != nil {
+			return args, fmt.Errorf("invalid --target-extent-size: %v", err)
+		}
+		if size > math.MaxUint32 {
+			return args, fmt.Errorf("--target-extent-size must be less than 4GiB")
+		}
+		args.ExtentThresh = uint32(size)
+	}
+
+	switch compress {
+	case "":
+	case "zlib":
+		args.Flags |= fstools.BTRFS_DEFRAG_RANGE_COMPRESS
+		args.CompressType = fstools.BTRFS_COMPRESS_ZLIB
+	case "lzo":
+		args.Flags |= fstools.BTRFS_DEFRAG_RANGE_COMPRESS
+		args.CompressType = fstools.BTRFS_COMPRESS_LZO
+	case "zstd":
+		args.Flags |= fstools.BTRFS_DEFRAG_RANGE_COMPRESS
+		args.CompressType = fstools.BTRFS_COMPRESS_ZSTD
+	case "none":
+		args.Flags |= fstools.BTRFS_DEFRAG_RANGE_NOCOMPRESS
+	default:
+		return args, fmt.Errorf("invalid --compress %q, must be zlib, lzo, zstd, or none", compress)
+	}
+	return args, nil
+}
+
+func defragFile(filePath string, args fstools.BtrfsDefragRangeArgs) error {
+	file, err := os.OpenFile(filePath, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	err = fstools.BtrfsDefragRange(int(file.Fd()), &args)
+	if err == unix.EINVAL && args.Flags&fstools.BTRFS_DEFRAG_RANGE_NOCOMPRESS != 0 {
+		return fmt.Errorf("%v (--compress=none requires a newer kernel)", err)
+	}
+	return err
+}
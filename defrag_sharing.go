@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/linux4life798/btrfs-optimize/fstools"
+)
+
+// sharingPartner is another file that shares physical extents with a file
+// that is about to be defragmented.
+type sharingPartner struct {
+	path  string
+	links []fstools.SharedLink
+}
+
+// sharedExtentBytes returns the number of bytes of extents flagged with
+// FIEMAP_EXTENT_SHARED.
+func sharedExtentBytes(extents []fstools.FiemapExtent) uint64 {
+	var n uint64
+	for _, e := range extents {
+		if e.Flags&fstools.FIEMAP_EXTENT_SHARED != 0 {
+			n += e.Length
+		}
+	}
+	return n
+}
+
+// findSharingPartners returns the files among extents, which maps each path
+// to its extents, that share physical extents with the file at path.
+// Only the given files can be found, since btrfs has no cheap way to list
+// every file referencing an extent.
+func findSharingPartners(path string, extents map[string][]fstools.FiemapExtent) []sharingPartner {
+	var partners []sharingPartner
+	for other, otherExtents := range extents {
+		if other == path {
+			continue
+		}
+		if links := fstools.SharedLinks(extents[path], otherExtents); len(links) > 0 {
+			partners = append(partners, sharingPartner{path: other, links: links})
+		}
+	}
+	sort.Slice(partners, func(i, j int) bool {
+		return partners[i].path < partners[j].path
+	})
+	return partners
+}
+
+// linkedBytes returns the number of bytes of the file covered by at least
+// one of the partners' links, counting overlapping links once.
+func linkedBytes(partners []sharingPartner) uint64 {
+	var ranges []fstools.Range
+	for _, p := range partners {
+		for _, l := range p.links {
+			ranges = append(ranges, fstools.Range{Offset: l.AOffset, Length: l.Length})
+		}
+	}
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i].Offset < ranges[j].Offset
+	})
+	var n, end uint64
+	for _, r := range ranges {
+		if r.End() <= end {
+			continue
+		}
+		n += r.End() - max(r.Offset, end)
+		end = r.End()
+	}
+	return n
+}
+
+// reshare dedupes each partner's linked ranges against the same data in the
+// file at path, which has just been defragmented, so that the partners
+// share its new extents. It returns the number of bytes deduped.
+// Ranges whose content no longer matches are reported and left alone.
+func reshare(ctx context.Context, path string, partners []sharingPartner) (uint64, error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+
+	var total uint64
+	for _, p := range partners {
+		dst, err := os.Open(p.path)
+		if err != nil {
+			printErrorf("Error opening %s: %v\n", p.path, err)
+			continue
+		}
+		for _, l := range p.links {
+			result, err := fstools.DedupeFdsContext(ctx, int(src.Fd()), l.AOffset, l.Length, []fstools.DedupeTarget{
+				{Fd: int(dst.Fd()), Offset: l.BOffset},
+			})
+			if result != nil {
+				total += result.Targets[0].BytesDeduped
+			}
+			if err != nil {
+				dst.Close()
+				return total, err
+			}
+			if err := result.Targets[0].Err(); err == fstools.ErrDedupeDiffers {
+				fmt.Fprintf(os.Stderr, "Warning: %s at offset %d no longer matches %s, not reshared.\n", p.path, l.BOffset, path)
+			} else if err != nil {
+				printErrorf("Error resharing %s at offset %d: %v\n", p.path, l.BOffset, err)
+			}
+		}
+		dst.Close()
+	}
+	return total, nil
+}
@@ -0,0 +1,107 @@
+package fstools
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// FileBlockSize returns the block size reported by fstat for the given file.
+// This is the granularity that FIDEDUPERANGE and FICLONERANGE expect offsets
+// and lengths to be aligned to.
+func FileBlockSize(file *os.File) (uint64, error) {
+	sysStat := new(syscall.Stat_t)
+	if err := syscall.Fstat(int(file.Fd()), sysStat); err != nil {
+		return 0, err
+	}
+	return uint64(sysStat.Blksize), nil
+}
+
+// IsAligned reports whether value is a multiple of blockSize.
+func IsAligned(value, blockSize uint64) bool {
+	return value%blockSize == 0
+}
+
+// AlignDown rounds value down to the nearest multiple of blockSize.
+func AlignDown(value, blockSize uint64) uint64 {
+	return value - value%blockSize
+}
+
+// AlignUp rounds value up to the nearest multiple of blockSize.
+// If rounding up would overflow, the largest aligned value is returned.
+func AlignUp(value, blockSize uint64) uint64 {
+	if IsAligned(value, blockSize) {
+		return value
+	}
+	aligned := AlignDown(value, blockSize)
+	if aligned+blockSize < aligned {
+		return aligned
+	}
+	return aligned + blockSize
+}
+
+// ExtentIsAligned reports whether the logical start, physical start, and
+// length of the extent are all multiples of blockSize.
+func ExtentIsAligned(extent *FiemapExtent, blockSize uint64) bool {
+	return IsAligned(extent.Logical, blockSize) &&
+		IsAligned(extent.Physical, blockSize) &&
+		IsAligned(extent.Length, blockSize)
+}
+
+// AlignRange shrinks the range [offset, offset+length) to the largest block
+// aligned range contained within it. The returned length is zero if no whole
+// block fits inside the range.
+func AlignRange(offset, length, blockSize uint64) (alignedOffset, alignedLength uint64) {
+	alignedOffset = AlignUp(offset, blockSize)
+	end := AlignDown(offset+length, blockSize)
+	if end <= alignedOffset {
+		return alignedOffset, 0
+	}
+	return alignedOffset, end - alignedOffset
+}
+
+// CheckRangeAlignment verifies that a dedupe or clone request is block
+// aligned, as required by the FIDEDUPERANGE and FICLONERANGE ioctls.
+// The offsets must always be aligned, but the length may be unaligned when
+// the range ends at the end of the source file, whose size is srcSize.
+func CheckRangeAlignment(srcOffset, destOffset, length, srcSize, blockSize uint64) error {
+	if !IsAligned(srcOffset, blockSize) {
+		return fmt.Errorf("source offset %d is not a multiple of the block size %d", srcOffset, blockSize)
+	}
+	if !IsAligned(destOffset, blockSize) {
+		return fmt.Errorf("destination offset %d is not a multiple of the block size %d", destOffset, blockSize)
+	}
+	if srcOffset > srcSize || length > srcSize-srcOffset {
+		return fmt.Errorf("range [%d, %d+%d) extends beyond the source size %d", srcOffset, srcOffset, length, srcSize)
+	}
+	if !IsAligned(length, blockSize) && srcOffset+length != srcSize {
+		return fmt.Errorf("length %d is not a multiple of the block size %d and does not end at the end of the source", length, blockSize)
+	}
+	return nil
+}
+
+// AutoAlignRange shrinks a dedupe or clone request to the largest block
+// aligned request contained within it. The source offset is rounded up, the
+// destination offset is moved by the same amount, and the length is rounded
+// down, unless the range ends at the end of the source, whose size is
+// srcSize. The number of bytes dropped from the edges is returned as skipped.
+//
+// An error is returned if the source and destination offsets are misaligned
+// by different amounts, since no shift can align both.
+func AutoAlignRange(srcOffset, destOffset, length, srcSize, blockSize uint64) (newSrcOffset, newDestOffset, newLength, skipped uint64, err error) {
+	if srcOffset%blockSize != destOffset%blockSize {
+		return 0, 0, 0, 0, fmt.Errorf("source offset %d and destination offset %d are misaligned by different amounts", srcOffset, destOffset)
+	}
+
+	shift := AlignUp(srcOffset, blockSize) - srcOffset
+	if shift >= length {
+		return srcOffset + shift, destOffset + shift, 0, length, nil
+	}
+	newSrcOffset = srcOffset + shift
+	newDestOffset = destOffset + shift
+	newLength = length - shift
+	if newSrcOffset+newLength != srcSize {
+		newLength = AlignDown(newLength, blockSize)
+	}
+	return newSrcOffset, newDestOffset, newLength, length - newLength, nil
+}
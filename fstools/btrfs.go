@@ -0,0 +1,579 @@
+package fstools
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"runtime"
+	"sort"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// https://github.com/torvalds/linux/blob/master/include/uapi/linux/btrfs.h
+// https://github.com/torvalds/linux/blob/master/include/uapi/linux/btrfs_tree.h
+
+const (
+	BTRFS_IOC_TREE_SEARCH = 0xD0009411 // _IOWR(0x94, 17, struct btrfs_ioctl_search_args)
+	BTRFS_IOC_DEV_INFO    = 0xD000941E // _IOWR(0x94, 30, struct btrfs_ioctl_dev_info_args)
+	BTRFS_IOC_FS_INFO     = 0x8400941F // _IOR(0x94, 31, struct btrfs_ioctl_fs_info_args)
+
+	BTRFS_IOC_DEFRAG         = 0x50009402 // _IOW(0x94, 2, struct btrfs_ioctl_vol_args)
+	BTRFS_IOC_SNAP_DESTROY   = 0x5000940F // _IOW(0x94, 15, struct btrfs_ioctl_vol_args)
+	BTRFS_IOC_SNAP_CREATE_V2 = 0x50009417 // _IOW(0x94, 23, struct btrfs_ioctl_vol_args_v2)
+	BTRFS_IOC_DEFRAG_RANGE   = 0x40309410 // _IOW(0x94, 16, struct btrfs_ioctl_defrag_range_args)
+
+	BTRFS_IOC_LOGICAL_INO    = 0xC0389424 // _IOWR(0x94, 36, struct btrfs_ioctl_logical_ino_args)
+	BTRFS_IOC_LOGICAL_INO_V2 = 0xC038943B // _IOWR(0x94, 59, struct btrfs_ioctl_logical_ino_args)
+)
+
+const (
+	// BTRFS_LOGICAL_INO_ARGS_IGNORE_OFFSET returns every reference to the
+	// extent containing the address, instead of only those that reference
+	// the exact address.
+	BTRFS_LOGICAL_INO_ARGS_IGNORE_OFFSET = 1 << 0
+)
+
+const (
+	BTRFS_SUBVOL_RDONLY = 1 << 1
+)
+
+// Flags for BtrfsDefragRangeArgs.Flags.
+const (
+	BTRFS_DEFRAG_RANGE_COMPRESS   = 1 << 0 // Recompress with CompressType.
+	BTRFS_DEFRAG_RANGE_START_IO   = 1 << 1 // Start writeback of the defragmented range.
+	BTRFS_DEFRAG_RANGE_NOCOMPRESS = 1 << 2 // Rewrite uncompressed. Requires a recent kernel.
+)
+
+// Compression types for BtrfsDefragRangeArgs.CompressType.
+const (
+	BTRFS_COMPRESS_NONE = 0
+	BTRFS_COMPRESS_ZLIB = 1
+	BTRFS_COMPRESS_LZO  = 2
+	BTRFS_COMPRESS_ZSTD = 3
+)
+
+const (
+	BTRFS_CHUNK_TREE_OBJECTID       = 3
+	BTRFS_FIRST_CHUNK_TREE_OBJECTID = 256
+	BTRFS_CHUNK_ITEM_KEY            = 228
+)
+
+// Block group profile flags from uapi/linux/btrfs_tree.h.
+const (
+	BTRFS_BLOCK_GROUP_DATA     = 1 << 0
+	BTRFS_BLOCK_GROUP_SYSTEM   = 1 << 1
+	BTRFS_BLOCK_GROUP_METADATA = 1 << 2
+	BTRFS_BLOCK_GROUP_RAID0    = 1 << 3
+	BTRFS_BLOCK_GROUP_RAID1    = 1 << 4
+	BTRFS_BLOCK_GROUP_DUP      = 1 << 5
+	BTRFS_BLOCK_GROUP_RAID10   = 1 << 6
+	BTRFS_BLOCK_GROUP_RAID5    = 1 << 7
+	BTRFS_BLOCK_GROUP_RAID6    = 1 << 8
+	BTRFS_BLOCK_GROUP_RAID1C3  = 1 << 9
+	BTRFS_BLOCK_GROUP_RAID1C4  = 1 << 10
+)
+
+const (
+	sizeofBtrfsSearchKey    = 104
+	sizeofBtrfsSearchArgs   = 4096
+	sizeofBtrfsSearchHeader = 32
+	sizeofBtrfsChunk        = 48
+	sizeofBtrfsStripe       = 32
+	sizeofBtrfsDevInfoArgs  = 4096
+	sizeofBtrfsFsInfoArgs   = 1024
+	sizeofBtrfsVolArgs      = 4096
+	sizeofBtrfsVolArgsV2    = 4096
+	sizeofBtrfsDefragRange  = 48
+	sizeofBtrfsLogicalIno   = 56
+
+	// sizeofBtrfsDataContainer is the size of the struct
+	// btrfs_data_container header, which precedes its values.
+	sizeofBtrfsDataContainer = 16
+	// btrfsLogicalInoMaxSize is the largest result buffer the kernel
+	// accepts from BTRFS_IOC_LOGICAL_INO_V2, and
+	// btrfsLogicalInoV1MaxSize from BTRFS_IOC_LOGICAL_INO.
+	btrfsLogicalInoMaxSize   = 16 * 1024 * 1024
+	btrfsLogicalInoV1MaxSize = 64 * 1024
+
+	// btrfsSearchMaxItems is the number of items requested per tree search,
+	// matching btrfs-progs.
+	btrfsSearchMaxItems = 4096
+)
+
+// BtrfsSearchKey mirrors struct btrfs_ioctl_search_key.
+type BtrfsSearchKey struct {
+	TreeID      uint64
+	MinObjectID uint64
+	MaxObjectID uint64
+	MinOffset   uint64
+	MaxOffset   uint64
+	MinTransID  uint64
+	MaxTransID  uint64
+	MinType     uint32
+	MaxType     uint32
+	NrItems     uint32
+	unused      uint32
+	unused1     uint64
+	unused2     uint64
+	unused3     uint64
+	unused4     uint64
+}
+
+type rawBtrfsSearchArgs struct {
+	Key BtrfsSearchKey
+	Buf [sizeofBtrfsSearchArgs - sizeofBtrfsSearchKey]byte
+}
+
+// BtrfsSearchHeader mirrors struct btrfs_ioctl_search_header.
+type BtrfsSearchHeader struct {
+	TransID  uint64
+	ObjectID uint64
+	Offset   uint64
+	Type     uint32
+	Len      uint32
+}
+
+// BtrfsSearchItem is one item returned by the tree search ioctl.
+type BtrfsSearchItem struct {
+	Header BtrfsSearchHeader
+	Data   []byte
+}
+
+// BtrfsTreeSearch performs BTRFS_IOC_TREE_SEARCH repeatedly, calling the
+// callback for every item matching key, until all items have been visited.
+// This ioctl requires CAP_SYS_ADMIN.
+//
+// The search advances by offset, so it is only suitable for keys where the
+// objectid and type are fixed.
+func BtrfsTreeSearch(fd int, key BtrfsSearchKey, callback func(item BtrfsSearchItem) error) error {
+	var args rawBtrfsSearchArgs
+	for {
+		args.Key = key
+		args.Key.NrItems = btrfsSearchMaxItems
+		if err := ioctlPtr(fd, BTRFS_IOC_TREE_SEARCH, unsafe.Pointer(&args)); err != nil {
+			return err
+		}
+		if args.Key.NrItems == 0 {
+			return nil
+		}
+
+		var last BtrfsSearchHeader
+		pos := 0
+		for i := uint32(0); i < args.Key.NrItems; i++ {
+			if pos+sizeofBtrfsSearchHeader > len(args.Buf) {
+				return fmt.Errorf("tree search result truncated")
+			}
+			var hdr BtrfsSearchHeader
+			binary.Read(bytes.NewReader(args.Buf[pos:pos+sizeofBtrfsSearchHeader]), binary.NativeEndian, &hdr)
+			pos += sizeofBtrfsSearchHeader
+			if pos+int(hdr.Len) > len(args.Buf) {
+				return fmt.Errorf("tree search item truncated")
+			}
+			if err := callback(BtrfsSearchItem{Header: hdr, Data: args.Buf[pos : pos+int(hdr.Len)]}); err != nil {
+				return err
+			}
+			pos += int(hdr.Len)
+			last = hdr
+		}
+
+		if last.Offset == math.MaxUint64 {
+			return nil
+		}
+		key.MinOffset = last.Offset + 1
+	}
+}
+
+// BtrfsStripe is one device stripe of a chunk.
+type BtrfsStripe struct {
+	DevID  uint64
+	Offset uint64
+}
+
+// BtrfsChunk maps a range of the btrfs logical address space, which is what
+// FIEMAP reports as the physical offset, to stripes on the backing devices.
+type BtrfsChunk struct {
+	Logical    uint64
+	Length     uint64
+	StripeLen  uint64
+	Type       uint64
+	SubStripes uint16
+	Stripes    []BtrfsStripe
+}
+
+// BtrfsDeviceLocation is a location on a specific btrfs device.
+type BtrfsDeviceLocation struct {
+	DevID  uint64
+	Offset uint64
+}
+
+// Contains reports whether the logical address falls inside the chunk.
+func (c *BtrfsChunk) Contains(logical uint64) bool {
+	return logical >= c.Logical && logical-c.Logical < c.Length
+}
+
+// Map translates a btrfs logical address within the chunk to all device
+// locations holding a copy of it.
+// The parity profiles RAID5 and RAID6 are not supported.
+func (c *BtrfsChunk) Map(logical uint64) ([]BtrfsDeviceLocation, error) {
+	if !c.Contains(logical) {
+		return nil, fmt.Errorf("logical address %d is outside of chunk", logical)
+	}
+	if len(c.Stripes) == 0 {
+		return nil, fmt.Errorf("chunk has no stripes")
+	}
+	offset := logical - c.Logical
+
+	switch {
+	case c.Type&(BTRFS_BLOCK_GROUP_RAID5|BTRFS_BLOCK_GROUP_RAID6) != 0:
+		return nil, fmt.Errorf("raid5/6 chunks are not supported")
+	case c.Type&(BTRFS_BLOCK_GROUP_RAID0|BTRFS_BLOCK_GROUP_RAID10) != 0:
+		if c.StripeLen == 0 {
+			return nil, fmt.Errorf("chunk has zero stripe length")
+		}
+		mirrors := 1
+		if c.Type&BTRFS_BLOCK_GROUP_RAID10 != 0 {
+			mirrors = int(c.SubStripes)
+		}
+		if mirrors == 0 || len(c.Stripes)%mirrors != 0 {
+			return nil, fmt.Errorf("chunk has invalid sub stripes")
+		}
+		factor := uint64(len(c.Stripes) / mirrors)
+		stripeNr := offset / c.StripeLen
+		stripeOffset := offset % c.StripeLen
+		index := int(stripeNr%factor) * mirrors
+		stripeNr /= factor
+
+		locations := make([]BtrfsDeviceLocation, 0, mirrors)
+		for i := index; i < index+mirrors; i++ {
+			locations = append(locations, BtrfsDeviceLocation{
+				DevID:  c.Stripes[i].DevID,
+				Offset: c.Stripes[i].Offset + stripeNr*c.StripeLen + stripeOffset,
+			})
+		}
+		return locations, nil
+	default:
+		// Single, DUP, and RAID1 variants keep a full copy on every stripe.
+		locations := make([]BtrfsDeviceLocation, 0, len(c.Stripes))
+		for _, stripe := range c.Stripes {
+			locations = append(locations, BtrfsDeviceLocation{
+				DevID:  stripe.DevID,
+				Offset: stripe.Offset + offset,
+			})
+		}
+		return locations, nil
+	}
+}
+
+// BtrfsChunks returns all chunks of the btrfs filesystem containing the open
+// file fd, sorted by logical address.
+// This requires CAP_SYS_ADMIN.
+func BtrfsChunks(fd int) ([]BtrfsChunk, error) {
+	key := BtrfsSearchKey{
+		TreeID:      BTRFS_CHUNK_TREE_OBJECTID,
+		MinObjectID: BTRFS_FIRST_CHUNK_TREE_OBJECTID,
+		MaxObjectID: BTRFS_FIRST_CHUNK_TREE_OBJECTID,
+		MinType:     BTRFS_CHUNK_ITEM_KEY,
+		MaxType:     BTRFS_CHUNK_ITEM_KEY,
+		MaxOffset:   math.MaxUint64,
+		MaxTransID:  math.MaxUint64,
+	}
+
+	var chunks []BtrfsChunk
+	err := BtrfsTreeSearch(fd, key, func(item BtrfsSearchItem) error {
+		if item.Header.Type != BTRFS_CHUNK_ITEM_KEY {
+			return nil
+		}
+		data := item.Data
+		if len(data) < sizeofBtrfsChunk {
+			return fmt.Errorf("chunk item too short")
+		}
+		le := binary.LittleEndian
+		chunk := BtrfsChunk{
+			Logical:    item.Header.Offset,
+			Length:     le.Uint64(data[0:]),
+			StripeLen:  le.Uint64(data[16:]),
+			Type:       le.Uint64(data[24:]),
+			SubStripes: le.Uint16(data[46:]),
+		}
+		numStripes := int(le.Uint16(data[44:]))
+		if len(data) < sizeofBtrfsChunk+numStripes*sizeofBtrfsStripe {
+			return fmt.Errorf("chunk item stripes truncated")
+		}
+		for i := 0; i < numStripes; i++ {
+			stripe := data[sizeofBtrfsChunk+i*sizeofBtrfsStripe:]
+			chunk.Stripes = append(chunk.Stripes, BtrfsStripe{
+				DevID:  le.Uint64(stripe[0:]),
+				Offset: le.Uint64(stripe[8:]),
+			})
+		}
+		chunks = append(chunks, chunk)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(chunks, func(i, j int) bool { return chunks[i].Logical < chunks[j].Logical })
+	return chunks, nil
+}
+
+// BtrfsFindChunk returns the chunk containing the logical address, or nil if
+// none of the chunks, which must be sorted by logical address, contain it.
+func BtrfsFindChunk(chunks []BtrfsChunk, logical uint64) *BtrfsChunk {
+	i := sort.Search(len(chunks), func(i int) bool {
+		return chunks[i].Logical+chunks[i].Length > logical
+	})
+	if i < len(chunks) && chunks[i].Contains(logical) {
+		return &chunks[i]
+	}
+	return nil
+}
+
+type rawBtrfsDevInfoArgs struct {
+	DevID      uint64
+	UUID       [16]byte
+	BytesUsed  uint64
+	TotalBytes uint64
+	FSID       [16]byte
+	unused     [377]uint64
+	Path       [1024]byte
+}
+
+// BtrfsDevicePath returns the path of the device devid that backs the btrfs
+// filesystem containing the open file fd.
+func BtrfsDevicePath(fd int, devid uint64) (string, error) {
+	var args rawBtrfsDevInfoArgs
+	args.DevID = devid
+	if err := ioctlPtr(fd, BTRFS_IOC_DEV_INFO, unsafe.Pointer(&args)); err != nil {
+		return "", err
+	}
+	return unix.ByteSliceToString(args.Path[:]), nil
+}
+
+type rawBtrfsFsInfoArgs struct {
+	MaxID          uint64
+	NumDevices     uint64
+	FSID           [16]byte
+	NodeSize       uint32
+	SectorSize     uint32
+	CloneAlignment uint32
+	CsumType       uint16
+	CsumSize       uint16
+	Flags          uint64
+	Generation     uint64
+	MetadataUUID   [16]byte
+	reserved       [944]byte
+}
+
+// BtrfsFsInfo is the subset of struct btrfs_ioctl_fs_info_args that is useful
+// to callers.
+type BtrfsFsInfo struct {
+	MaxID      uint64
+	NumDevices uint64
+	NodeSize   uint32
+	SectorSize uint32
+}
+
+// BtrfsGetFsInfo returns information about the btrfs filesystem containing
+// the open file fd.
+func BtrfsGetFsInfo(fd int) (BtrfsFsInfo, error) {
+	var args rawBtrfsFsInfoArgs
+	if err := ioctlPtr(fd, BTRFS_IOC_FS_INFO, unsafe.Pointer(&args)); err != nil {
+		return BtrfsFsInfo{}, err
+	}
+	return BtrfsFsInfo{
+		MaxID:      args.MaxID,
+		NumDevices: args.NumDevices,
+		NodeSize:   args.NodeSize,
+		SectorSize: args.SectorSize,
+	}, nil
+}
+
+type rawBtrfsVolArgs struct {
+	Fd   int64
+	Name [4088]byte
+}
+
+type rawBtrfsVolArgsV2 struct {
+	Fd      int64
+	TransID uint64
+	Flags   uint64
+	unused  [4]uint64
+	Name    [4040]byte
+}
+
+// BtrfsSnapshotCreate creates a snapshot of the subvolume at subvolPath,
+// named name inside the directory destDir, which must be on the same btrfs
+// filesystem. If readOnly is set, the snapshot is created read-only.
+func BtrfsSnapshotCreate(subvolPath, destDir, name string, readOnly bool) error {
+	var args rawBtrfsVolArgsV2
+	if len(name) >= len(args.Name) {
+		return fmt.Errorf("snapshot name is too long")
+	}
+	copy(args.Name[:], name)
+	if readOnly {
+		args.Flags |= BTRFS_SUBVOL_RDONLY
+	}
+
+	subvol, err := os.Open(subvolPath)
+	if err != nil {
+		return err
+	}
+	defer subvol.Close()
+	dest, err := os.Open(destDir)
+	if err != nil {
+		return err
+	}
+	defer dest.Close()
+
+	args.Fd = int64(subvol.Fd())
+	return ioctlPtr(int(dest.Fd()), BTRFS_IOC_SNAP_CREATE_V2, unsafe.Pointer(&args))
+}
+
+// BtrfsSnapshotDestroy deletes the subvolume or snapshot named name inside
+// the directory parentDir.
+func BtrfsSnapshotDestroy(parentDir, name string) error {
+	var args rawBtrfsVolArgs
+	if len(name) >= len(args.Name) {
+		return fmt.Errorf("snapshot name is too long")
+	}
+	copy(args.Name[:], name)
+
+	parent, err := os.Open(parentDir)
+	if err != nil {
+		return err
+	}
+	defer parent.Close()
+	return ioctlPtr(int(parent.Fd()), BTRFS_IOC_SNAP_DESTROY, unsafe.Pointer(&args))
+}
+
+// BtrfsDefrag defragments the entire file open as fd using BTRFS_IOC_DEFRAG.
+// The fd must be open for writing, unless the caller has CAP_SYS_ADMIN.
+func BtrfsDefrag(fd int) error {
+	return ioctlPtr(fd, BTRFS_IOC_DEFRAG, nil)
+}
+
+// BtrfsDefragRangeArgs mirrors struct btrfs_ioctl_defrag_range_args.
+type BtrfsDefragRangeArgs struct {
+	Start uint64 // logical offset to start defragmenting at
+	Len   uint64 // number of bytes to defragment, or math.MaxUint64 for all
+	Flags uint64 // BTRFS_DEFRAG_RANGE_* flags
+	// ExtentThresh is the target extent size. Extents that are at least
+	// this large are left alone. Zero selects the kernel's default.
+	ExtentThresh uint32
+	// CompressType is one of the BTRFS_COMPRESS_* types, used when
+	// BTRFS_DEFRAG_RANGE_COMPRESS is set.
+	CompressType uint32
+	unused       [4]uint32
+}
+
+// BtrfsDefragRange defragments the range of the file open as fd described by
+// args using BTRFS_IOC_DEFRAG_RANGE.
+// The fd must be open for writing, unless the caller has CAP_SYS_ADMIN.
+func BtrfsDefragRange(fd int, args *BtrfsDefragRangeArgs) error {
+	return ioctlPtr(fd, BTRFS_IOC_DEFRAG_RANGE, unsafe.Pointer(args))
+}
+
+type rawBtrfsLogicalInoArgs struct {
+	Logical  uint64
+	Size     uint64
+	Reserved [3]uint64
+	Flags    uint64
+	Inodes   uint64 // address of a struct btrfs_data_container
+}
+
+// BtrfsInodeRef is a reference from a file to an extent, as returned by
+// BtrfsLogicalIno.
+type BtrfsInodeRef struct {
+	Inode  uint64 // inode number of the file
+	Offset uint64 // offset within the file
+	Root   uint64 // subvolume the file is in
+}
+
+// BtrfsLogicalIno returns all references to the extent that contains the
+// btrfs logical address, which is the physical offset reported by FIEMAP.
+// Any file on the filesystem can be used as fd.
+//
+// BTRFS_IOC_LOGICAL_INO_V2 is used when available, otherwise the result
+// only includes the references to the exact address given.
+// This requires CAP_SYS_ADMIN.
+func BtrfsLogicalIno(fd int, logical uint64) ([]BtrfsInodeRef, error) {
+	req := uint(BTRFS_IOC_LOGICAL_INO_V2)
+	size := uint64(btrfsLogicalInoV1MaxSize)
+	for {
+		buf := make([]byte, size)
+		args := rawBtrfsLogicalInoArgs{
+			Logical: logical,
+			Size:    size,
+			Inodes:  uint64(uintptr(unsafe.Pointer(&buf[0]))),
+		}
+		if req == BTRFS_IOC_LOGICAL_INO_V2 {
+			args.Flags = BTRFS_LOGICAL_INO_ARGS_IGNORE_OFFSET
+		}
+		err := ioctlPtr(fd, req, unsafe.Pointer(&args))
+		runtime.KeepAlive(buf)
+		if err == unix.ENOTTY && req == BTRFS_IOC_LOGICAL_INO_V2 {
+			req = BTRFS_IOC_LOGICAL_INO
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		le := binary.NativeEndian
+		bytesMissing := le.Uint32(buf[4:])
+		elemCnt := le.Uint32(buf[8:])
+		if bytesMissing > 0 && req == BTRFS_IOC_LOGICAL_INO_V2 && size < btrfsLogicalInoMaxSize {
+			size = min(size+uint64(bytesMissing), btrfsLogicalInoMaxSize)
+			continue
+		}
+
+		vals := buf[sizeofBtrfsDataContainer:]
+		refs := make([]BtrfsInodeRef, 0, elemCnt/3)
+		for i := 0; i+2 < int(elemCnt); i += 3 {
+			refs = append(refs, BtrfsInodeRef{
+				Inode:  le.Uint64(vals[i*8:]),
+				Offset: le.Uint64(vals[(i+1)*8:]),
+				Root:   le.Uint64(vals[(i+2)*8:]),
+			})
+		}
+		return refs, nil
+	}
+}
+
+// IsBtrfs reports whether the file resides on a btrfs filesystem.
+func IsBtrfs(file *os.File) (bool, error) {
+	var stat unix.Statfs_t
+	if err := unix.Fstatfs(int(file.Fd()), &stat); err != nil {
+		return false, err
+	}
+	// f_type is a signed 32 bit field on 32 bit architectures, where the magic
+	// number would overflow it.
+	return uint32(stat.Type) == unix.BTRFS_SUPER_MAGIC, nil
+}
+
+// Compile time checks that the ioctl structs match the kernel's sizes.
+var (
+	_ [unsafe.Sizeof(BtrfsSearchKey{}) - sizeofBtrfsSearchKey]byte
+	_ [sizeofBtrfsSearchKey - unsafe.Sizeof(BtrfsSearchKey{})]byte
+	_ [unsafe.Sizeof(rawBtrfsSearchArgs{}) - sizeofBtrfsSearchArgs]byte
+	_ [sizeofBtrfsSearchArgs - unsafe.Sizeof(rawBtrfsSearchArgs{})]byte
+	_ [unsafe.Sizeof(BtrfsSearchHeader{}) - sizeofBtrfsSearchHeader]byte
+	_ [sizeofBtrfsSearchHeader - unsafe.Sizeof(BtrfsSearchHeader{})]byte
+	_ [unsafe.Sizeof(rawBtrfsDevInfoArgs{}) - sizeofBtrfsDevInfoArgs]byte
+	_ [sizeofBtrfsDevInfoArgs - unsafe.Sizeof(rawBtrfsDevInfoArgs{})]byte
+	_ [unsafe.Sizeof(rawBtrfsFsInfoArgs{}) - sizeofBtrfsFsInfoArgs]byte
+	_ [sizeofBtrfsFsInfoArgs - unsafe.Sizeof(rawBtrfsFsInfoArgs{})]byte
+	_ [unsafe.Sizeof(rawBtrfsVolArgs{}) - sizeofBtrfsVolArgs]byte
+	_ [sizeofBtrfsVolArgs - unsafe.Sizeof(rawBtrfsVolArgs{})]byte
+	_ [unsafe.Sizeof(rawBtrfsVolArgsV2{}) - sizeofBtrfsVolArgsV2]byte
+	_ [sizeofBtrfsVolArgsV2 - unsafe.Sizeof(rawBtrfsVolArgsV2{})]byte
+	_ [unsafe.Sizeof(BtrfsDefragRangeArgs{}) - sizeofBtrfsDefragRange]byte
+	_ [sizeofBtrfsDefragRange - unsafe.Sizeof(BtrfsDefragRangeArgs{})]byte
+	_ [unsafe.Sizeof(rawBtrfsLogicalInoArgs{}) - sizeofBtrfsLogicalIno]byte
+	_ [sizeofBtrfsLogicalIno - unsafe.Sizeof(rawBtrfsLogicalInoArgs{})]byte
+)
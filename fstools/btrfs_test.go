@@ -0,0 +1,31 @@
+package fstools
+
+import (
+	"testing"
+	"unsafe"
+)
+
+// iowr encodes an _IOWR ioctl number, as the kernel's asm-generic ioctl.h
+// does.
+func iowr(typ, nr, size uintptr) uint {
+	return uint(3<<30 | size<<16 | typ<<8 | nr)
+}
+
+func TestBtrfsLogicalInoIoctlNumbers(t *testing.T) {
+	size := unsafe.Sizeof(rawBtrfsLogicalInoArgs{})
+	if size != 56 {
+		t.Errorf("got struct btrfs_ioctl_logical_ino_args size %d, want 56", size)
+	}
+	if want := iowr(0x94, 36, size); BTRFS_IOC_LOGICAL_INO != want {
+		t.Errorf("got BTRFS_IOC_LOGICAL_INO %#x, want %#x", BTRFS_IOC_LOGICAL_INO, want)
+	}
+	if want := iowr(0x94, 59, size); BTRFS_IOC_LOGICAL_INO_V2 != want {
+		t.Errorf("got BTRFS_IOC_LOGICAL_INO_V2 %#x, want %#x", BTRFS_IOC_LOGICAL_INO_V2, want)
+	}
+	if off := unsafe.Offsetof(rawBtrfsLogicalInoArgs{}.Flags); off != 40 {
+		t.Errorf("got flags at offset %d, want 40", off)
+	}
+	if off := unsafe.Offsetof(rawBtrfsLogicalInoArgs{}.Inodes); off != 48 {
+		t.Errorf("got inodes at offset %d, want 48", off)
+	}
+}
@@ -0,0 +1,31 @@
+package fstools
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// CloneFile makes dst share all of src's extents using the FICLONE ioctl,
+// replacing the whole contents of dst, which must be open for writing.
+// Both files must be on the same filesystem, which must support reflinks.
+func CloneFile(dst, src *os.File) error {
+	return unix.IoctlFileClone(int(dst.Fd()), int(src.Fd()))
+}
+
+// IoctlFileCloneRange issues the FICLONERANGE ioctl on destFd, which makes
+// value.Src_length bytes of destFd at value.Dest_offset share the extents of
+// value.Src_fd at value.Src_offset. A zero length clones to the end of the
+// source. Unlike FIDEDUPERANGE, the destination range is overwritten
+// whatever its contents, so destFd must be open for writing.
+//
+// The offsets and length must be block aligned, except that the range may
+// end unaligned at the end of the source. The call is logged if an
+// IoctlLogger is set.
+func IoctlFileCloneRange(destFd int, value *unix.FileCloneRange) error {
+	err := unix.IoctlFileCloneRange(destFd, value)
+	if l := ioctlLogger; l != nil {
+		l.logClone(destFd, value, err)
+	}
+	return err
+}
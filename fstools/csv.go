@@ -0,0 +1,67 @@
+package fstools
+
+import (
+	"encoding/csv"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ExtentCSVHeader is the header row of the rows written by WriteExtentCSV.
+var ExtentCSVHeader = []string{"file", "extent_index", "logical", "physical", "length", "flags", "unit"}
+
+// WriteExtentCSV writes a row for each extent of file that overlaps the
+// logical range [start, start+length), given in bytes, selecting the same
+// extents as FileFragDumpExtentsWindow. Every row starts with path, so the
+// rows of several files can be concatenated under one ExtentCSVHeader.
+//
+// Offsets and lengths are plain integers in blocks, unless useBytes is set.
+// Like the extent table, extents that aren't block aligned are written in
+// bytes. The unit column of each row says which one it uses, "blocks" or
+// "bytes". The flag names are joined by "|".
+//
+// If match is not zero, only the extents with any of the FIEMAP_EXTENT_*
+// flags in match set are written, keeping their original indices.
+//
+// The flags value is passed directly to FiemapWalk.
+func WriteExtentCSV(w *csv.Writer, file *os.File, path string, start, length uint64, head, tail int, useBytes bool, match, flags uint32) error {
+	window, err := newExtentWindow(file, start, length, flags)
+	if err != nil {
+		return err
+	}
+	sel, err := newExtentSelection(head, tail, window.count)
+	if err != nil {
+		return err
+	}
+	walk := window.walk
+	if match != 0 {
+		walk = walkMatching(walk, match)
+	}
+	blkSize := window.blkSize
+	if useBytes {
+		blkSize = 1
+	}
+
+	// Write errors are sticky in csv.Writer, so they are checked once at
+	// the end.
+	err = sel.walk(walk, func(index int, extent *FiemapExtent) {
+		unitSize, unit := blkSize, "blocks"
+		if unitSize == 1 || !ExtentIsAligned(extent, unitSize) {
+			unitSize, unit = 1, "bytes"
+		}
+		w.Write([]string{
+			path,
+			strconv.Itoa(index),
+			strconv.FormatUint(extent.Logical/unitSize, 10),
+			strconv.FormatUint(extent.Physical/unitSize, 10),
+			strconv.FormatUint(extent.Length/unitSize, 10),
+			strings.Join(FiemapExtentFlagsToStrings(extent.Flags), "|"),
+			unit,
+		})
+	})
+	if err != nil {
+		return err
+	}
+	w.Flush()
+	return w.Error()
+}
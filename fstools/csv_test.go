@@ -0,0 +1,57 @@
+package fstools
+
+import (
+	"bytes"
+	"encoding/csv"
+	"testing"
+)
+
+func TestWriteExtentCSV(t *testing.T) {
+	fakeFiemap(t, fiemapOf([]FiemapExtent{
+		{Logical: 0, Physical: 8192, Length: 4096},
+		{Logical: 4096, Physical: 20000, Length: 100, Flags: FIEMAP_EXTENT_LAST | FIEMAP_EXTENT_NOT_ALIGNED},
+	}))
+	file := tempFile(t)
+	blkSize, err := FileBlockSize(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if blkSize != 4096 {
+		t.Skipf("extents are laid out for 4096 byte blocks, not %d", blkSize)
+	}
+
+	tests := []struct {
+		name     string
+		useBytes bool
+		want     string
+	}{
+		{
+			// The unaligned extent is written in bytes, like the extent
+			// table does.
+			"blocks", false,
+			"f,0,0,2,1,,blocks\n" +
+				"f,1,4096,20000,100,last|not_aligned,bytes\n",
+		},
+		{
+			"bytes", true,
+			"f,0,0,8192,4096,,bytes\n" +
+				"f,1,4096,20000,100,last|not_aligned,bytes\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			w := csv.NewWriter(&buf)
+			if err := w.Write(ExtentCSVHeader); err != nil {
+				t.Fatal(err)
+			}
+			if err := WriteExtentCSV(w, file, "f", 0, 1<<20, 0, 0, tt.useBytes, 0, 0); err != nil {
+				t.Fatal(err)
+			}
+			want := "file,extent_index,logical,physical,length,flags,unit\n" + tt.want
+			if got := buf.String(); got != want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, want)
+			}
+		})
+	}
+}
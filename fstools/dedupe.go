@@ -0,0 +1,314 @@
+package fstools
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// ErrDedupeDiffers is returned by DedupeTargetResult.Err when the target's
+// content differs from the source.
+var ErrDedupeDiffers = errors.New("range differs")
+
+// ErrInlineData is returned when a file's data is stored inline in the btrfs
+// metadata, which FIDEDUPERANGE refuses with a generic EINVAL.
+var ErrInlineData = errors.New("file data is inline; cannot be deduped (file too small / below block size)")
+
+// NoSpaceError is returned when a dedupe fails with ENOSPC. Even though
+// deduping frees data space, btrfs needs metadata space to record the new
+// extent references, so this usually means metadata space is exhausted.
+// It unwraps to unix.ENOSPC.
+type NoSpaceError struct {
+	// Deduped is the number of source bytes deduped before the failure.
+	Deduped uint64
+}
+
+func (e *NoSpaceError) Error() string {
+	return fmt.Sprintf("no space left on device after deduping %d bytes", e.Deduped)
+}
+
+func (e *NoSpaceError) Unwrap() error {
+	return unix.ENOSPC
+}
+
+// SkipReason records why a dedupe target was skipped.
+type SkipReason int
+
+const (
+	// SkipNone means the target was not skipped.
+	SkipNone SkipReason = iota
+	// SkipAlreadyShared means every extent of the target was already
+	// shared with the source.
+	SkipAlreadyShared
+	// SkipDiffers means the target's content differs from the source and
+	// the caller chose not to treat that as a failure.
+	SkipDiffers
+	// SkipPreviouslyFailed means the target failed in an earlier run that
+	// is being resumed, so it was not retried.
+	SkipPreviouslyFailed
+	// SkipTooRecent means the target was modified too recently, so it may
+	// still be being written to.
+	SkipTooRecent
+	// SkipLowSavings means deduping the target was estimated to reclaim
+	// too little space to be worth the extra metadata.
+	SkipLowSavings
+	// SkipInline means the target's data is stored inline in the metadata,
+	// so it can't be deduped.
+	SkipInline
+)
+
+var skipReasonNames = []string{
+	SkipNone:             "",
+	SkipAlreadyShared:    "already_shared",
+	SkipDiffers:          "differs",
+	SkipPreviouslyFailed: "previously_failed",
+	SkipTooRecent:        "too_recent",
+	SkipLowSavings:       "low_savings",
+	SkipInline:           "inline",
+}
+
+// String returns the name of the reason, which is empty for SkipNone.
+func (r SkipReason) String() string {
+	if r < 0 || int(r) >= len(skipReasonNames) {
+		return fmt.Sprintf("SkipReason(%d)", int(r))
+	}
+	return skipReasonNames[r]
+}
+
+// MarshalText encodes the reason by name.
+func (r SkipReason) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+// UnmarshalText decodes a reason encoded with MarshalText.
+func (r *SkipReason) UnmarshalText(text []byte) error {
+	for i, name := range skipReasonNames {
+		if name == string(text) {
+			*r = SkipReason(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown skip reason %q", text)
+}
+
+// DedupeOptions holds the optional settings for DedupeFiles.
+// The zero value dedupes the full source file against each target.
+type DedupeOptions struct {
+	// Offset is the offset, in both the source and the targets, to start
+	// deduping at.
+	Offset uint64
+	// Length is the number of bytes to dedupe. Zero means up to the end of
+	// the source file.
+	Length uint64
+
+	// Progress is called after every ioctl to report progress, if not nil.
+	Progress FileDedupeRangeFullProgress
+	// MaxRate limits the average dedupe throughput to this many bytes per
+	// second. Zero means unlimited.
+	MaxRate uint64
+	// ChunkSize limits the number of bytes requested by each ioctl.
+	// Zero means no limit.
+	ChunkSize uint64
+	// NoSharedCheck disables skipping targets whose extents are all
+	// already shared with the source.
+	NoSharedCheck bool
+}
+
+// DedupeResult reports the outcome of DedupeFiles.
+type DedupeResult struct {
+	Source  string
+	Offset  uint64
+	Length  uint64
+	Targets []DedupeTargetResult
+}
+
+// DedupeTargetResult reports the outcome of deduping a single target.
+type DedupeTargetResult struct {
+	Path         string
+	BytesDeduped uint64
+	// Status is the FileDedupeRangeInfo.Status of the target's last ioctl.
+	Status int32
+	// Skipped is the reason no dedupe was issued for the target, if any.
+	Skipped SkipReason
+}
+
+// Err returns nil if the target was deduped successfully, ErrDedupeDiffers
+// if its content differs from the source, or the errno that stopped it.
+func (t DedupeTargetResult) Err() error {
+	switch {
+	case t.Status == unix.FILE_DEDUPE_RANGE_SAME:
+		return nil
+	case t.Status == unix.FILE_DEDUPE_RANGE_DIFFERS:
+		return ErrDedupeDiffers
+	case t.Status < 0 && t.Status != math.MinInt32:
+		return unix.Errno(-t.Status)
+	default:
+		return fmt.Errorf("unknown dedupe status %d", t.Status)
+	}
+}
+
+// DedupeFiles dedupes the targets against the source file, so that they
+// share the source's extents wherever their content is identical.
+//
+// An error is returned if the files can't be opened or the dedupe can't be
+// issued at all. The outcome of each target is reported in the result.
+func DedupeFiles(source string, targets []string, opts DedupeOptions) (*DedupeResult, error) {
+	return DedupeFilesContext(context.Background(), source, targets, opts)
+}
+
+// DedupeFilesContext is DedupeFiles with a context that is checked between
+// each ioctl. If it is cancelled, ctx.Err() is returned along with the
+// partial result.
+func DedupeFilesContext(ctx context.Context, source string, targets []string, opts DedupeOptions) (*DedupeResult, error) {
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("no targets given")
+	}
+
+	srcFile, err := os.Open(source)
+	if err != nil {
+		return nil, err
+	}
+	defer srcFile.Close()
+	if inline, err := HasInlineData(srcFile, 0); err == nil && inline {
+		return nil, fmt.Errorf("%s: %w", source, ErrInlineData)
+	}
+
+	length := opts.Length
+	if length == 0 {
+		info, err := srcFile.Stat()
+		if err != nil {
+			return nil, err
+		}
+		if uint64(info.Size()) <= opts.Offset {
+			return nil, fmt.Errorf("offset %d is beyond the end of %s", opts.Offset, source)
+		}
+		length = uint64(info.Size()) - opts.Offset
+	}
+
+	result := &DedupeResult{
+		Source: source,
+		Offset: opts.Offset,
+		Length: length,
+	}
+	var srcExtents []FiemapExtent
+	if !opts.NoSharedCheck {
+		// The check is only an optimization, so it is silently skipped
+		// if the extents can't be read.
+		srcExtents, _ = CollectExtents(srcFile, 0)
+	}
+
+	value := &unix.FileDedupeRange{
+		Src_offset: opts.Offset,
+		Src_length: length,
+	}
+	// The active list maps each entry of value.Info back to its index in
+	// result.Targets, since skipped targets have no entry.
+	var active []int
+	for i, target := range targets {
+		result.Targets = append(result.Targets, DedupeTargetResult{Path: target})
+
+		// Only read access is needed to dedupe into a file.
+		f, err := os.Open(target)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		if inline, err := HasInlineData(f, 0); err == nil && inline {
+			result.Targets[i].Skipped = SkipInline
+			continue
+		}
+		if srcExtents != nil {
+			if extents, err := CollectExtents(f, 0); err == nil && AlreadyShared(srcExtents, extents) {
+				result.Targets[i].Skipped = SkipAlreadyShared
+				continue
+			}
+		}
+
+		active = append(active, i)
+		value.Info = append(value.Info, unix.FileDedupeRangeInfo{
+			Dest_fd:     int64(f.Fd()),
+			Dest_offset: opts.Offset,
+		})
+	}
+	if len(value.Info) == 0 {
+		return result, nil
+	}
+
+	err = FileDedupeRangeFullWithOptions(ctx, int(srcFile.Fd()), value, FileDedupeRangeOptions{
+		Progress:  opts.Progress,
+		MaxRate:   opts.MaxRate,
+		ChunkSize: opts.ChunkSize,
+	})
+	for i, info := range value.Info {
+		result.Targets[active[i]].BytesDeduped = info.Bytes_deduped
+		result.Targets[active[i]].Status = info.Status
+	}
+	return result, err
+}
+
+// DedupeTarget is a destination of DedupeFds, given as an open file
+// descriptor and the offset in it to dedupe at.
+type DedupeTarget struct {
+	Fd     int
+	Offset uint64
+}
+
+// DedupeFds is like DedupeFiles, but works on file descriptors the caller
+// already has open. The caller keeps ownership of every fd, which must stay
+// open until DedupeFds returns, and is never closed by it.
+//
+// Length bytes of srcFd starting at srcOffset are deduped against each
+// target at its offset. A zero length means up to the end of the source.
+// Targets are never skipped as already shared, and the Path of each target
+// result is left empty.
+func DedupeFds(srcFd int, srcOffset, length uint64, targets []DedupeTarget) (*DedupeResult, error) {
+	return DedupeFdsContext(context.Background(), srcFd, srcOffset, length, targets)
+}
+
+// DedupeFdsContext is DedupeFds with a context that is checked between each
+// ioctl. If it is cancelled, ctx.Err() is returned along with the partial
+// result.
+func DedupeFdsContext(ctx context.Context, srcFd int, srcOffset, length uint64, targets []DedupeTarget) (*DedupeResult, error) {
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("no targets given")
+	}
+	if length == 0 {
+		var stat unix.Stat_t
+		if err := unix.Fstat(srcFd, &stat); err != nil {
+			return nil, err
+		}
+		if uint64(stat.Size) <= srcOffset {
+			return nil, fmt.Errorf("offset %d is beyond the end of the source", srcOffset)
+		}
+		length = uint64(stat.Size) - srcOffset
+	}
+
+	result := &DedupeResult{
+		Offset:  srcOffset,
+		Length:  length,
+		Targets: make([]DedupeTargetResult, len(targets)),
+	}
+	value := &unix.FileDedupeRange{
+		Src_offset: srcOffset,
+		Src_length: length,
+		Info:       make([]unix.FileDedupeRangeInfo, len(targets)),
+	}
+	for i, t := range targets {
+		value.Info[i] = unix.FileDedupeRangeInfo{
+			Dest_fd:     int64(t.Fd),
+			Dest_offset: t.Offset,
+		}
+	}
+
+	err := FileDedupeRangeFullWithOptions(ctx, srcFd, value, FileDedupeRangeOptions{})
+	for i, info := range value.Info {
+		result.Targets[i].BytesDeduped = info.Bytes_deduped
+		result.Targets[i].Status = info.Status
+	}
+	return result, err
+}
@@ -0,0 +1,75 @@
+package fstools
+
+import (
+	"bytes"
+
+	"golang.org/x/sys/unix"
+)
+
+// dryRunMaxLength is the most a simulated dedupe request covers per call,
+// matching the 1GiB that btrfs dedupes per FIDEDUPERANGE ioctl, so that a
+// dry run takes the same steps as the real dedupe.
+const dryRunMaxLength = 1024 * 1024 * 1024
+
+// dryRunBufferSize is the amount of data compared at once by a dry run.
+const dryRunBufferSize = 1024 * 1024
+
+// compareFileDedupeRange fills in value.Info like the FIDEDUPERANGE ioctl
+// would, by comparing the source and destination ranges in user space,
+// without deduping anything. Every destination that matches reports the
+// full, possibly capped, length as deduped, and every other one reports
+// FILE_DEDUPE_RANGE_DIFFERS or the errno of a failed read.
+func compareFileDedupeRange(srcFd int, value *unix.FileDedupeRange) error {
+	length := min(value.Src_length, dryRunMaxLength)
+	srcBuf := make([]byte, min(length, dryRunBufferSize))
+	destBuf := make([]byte, len(srcBuf))
+
+	for i := range value.Info {
+		info := &value.Info[i]
+		info.Status = unix.FILE_DEDUPE_RANGE_SAME
+		info.Bytes_deduped = length
+		for done := uint64(0); done < length; {
+			n := min(uint64(len(srcBuf)), length-done)
+			if err := preadFull(srcFd, srcBuf[:n], value.Src_offset+done); err != nil {
+				return err
+			}
+			if err := preadFull(int(info.Dest_fd), destBuf[:n], info.Dest_offset+done); err != nil {
+				if errno, ok := err.(unix.Errno); ok {
+					info.Status = -int32(errno)
+				} else {
+					info.Status = unix.FILE_DEDUPE_RANGE_DIFFERS
+				}
+				info.Bytes_deduped = 0
+				break
+			}
+			if !bytes.Equal(srcBuf[:n], destBuf[:n]) {
+				info.Status = unix.FILE_DEDUPE_RANGE_DIFFERS
+				info.Bytes_deduped = 0
+				break
+			}
+			done += n
+		}
+	}
+	return nil
+}
+
+// preadFull reads len(buf) bytes of fd at offset. Reading past the end of
+// the file is reported as EINVAL, which is what the kernel returns for a
+// dedupe range beyond the end of a file.
+func preadFull(fd int, buf []byte, offset uint64) error {
+	for len(buf) > 0 {
+		n, err := unix.Pread(fd, buf, int64(offset))
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return unix.EINVAL
+		}
+		buf = buf[n:]
+		offset += uint64(n)
+	}
+	return nil
+}
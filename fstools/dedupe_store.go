@@ -0,0 +1,196 @@
+package fstools
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// DedupeStore is a content addressed holding file that accumulates one copy
+// of every unique block added to it. Files added to the store have each of
+// their blocks deduped against the store's copy, so that all files end up
+// sharing extents with the store rather than with each other.
+//
+// Only whole blocks are stored. A trailing partial block of a file is left
+// untouched, since the dedupe ioctl would reject the unaligned length.
+type DedupeStore struct {
+	file      *os.File
+	blockSize uint64
+	size      uint64
+	index     map[[sha256.Size]byte]uint64
+}
+
+// DedupeStoreResult summarizes the outcome of adding one file to the store.
+type DedupeStoreResult struct {
+	// BytesReflinked is the number of bytes of the file that now share
+	// extents with the store.
+	BytesReflinked uint64
+	// BytesAppended is the number of bytes of new unique blocks that were
+	// appended to the store to hold this file's data.
+	BytesAppended uint64
+	// Failed lists the ranges of the file that the kernel refused to
+	// dedupe against the store.
+	Failed []DedupeStoreFailure
+}
+
+// DedupeStoreFailure is a range of a file added to the store that was not
+// deduped, along with the status the kernel returned for it.
+type DedupeStoreFailure struct {
+	Offset uint64
+	Length uint64
+	Status int32
+}
+
+// OpenDedupeStore opens or creates the store at path using the given block
+// size, which must be a multiple of the filesystem block size.
+// If the store already exists, its blocks are hashed to rebuild the index.
+func OpenDedupeStore(path string, blockSize uint64) (*DedupeStore, error) {
+	if blockSize == 0 {
+		return nil, fmt.Errorf("block size must be non-zero")
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	fsBlockSize, err := FileBlockSize(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if !IsAligned(blockSize, fsBlockSize) {
+		file.Close()
+		return nil, fmt.Errorf("block size %d is not a multiple of the filesystem block size %d", blockSize, fsBlockSize)
+	}
+
+	s := &DedupeStore{
+		file:      file,
+		blockSize: blockSize,
+		index:     make(map[[sha256.Size]byte]uint64),
+	}
+	if err := s.load(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *DedupeStore) load() error {
+	info, err := s.file.Stat()
+	if err != nil {
+		return err
+	}
+	size := uint64(info.Size())
+	if size%s.blockSize != 0 {
+		return fmt.Errorf("store size %d is not a multiple of the block size %d", size, s.blockSize)
+	}
+
+	buf := make([]byte, s.blockSize)
+	for offset := uint64(0); offset < size; offset += s.blockSize {
+		if _, err := s.file.ReadAt(buf, int64(offset)); err != nil {
+			return fmt.Errorf("failed to read store block at %d: %v", offset, err)
+		}
+		sum := sha256.Sum256(buf)
+		if _, ok := s.index[sum]; !ok {
+			s.index[sum] = offset
+		}
+	}
+	s.size = size
+	return nil
+}
+
+// Size returns the current size of the store in bytes.
+func (s *DedupeStore) Size() uint64 {
+	return s.size
+}
+
+// Close closes the underlying store file.
+func (s *DedupeStore) Close() error {
+	return s.file.Close()
+}
+
+// AddFile appends any blocks of file not already present in the store, then
+// dedupes every whole block of file against its copy in the store.
+// The file only needs to be opened for reading. Ranges the kernel refuses to
+// dedupe are listed in the result's Failed, rather than returned as an error.
+func (s *DedupeStore) AddFile(file *os.File) (DedupeStoreResult, error) {
+	var result DedupeStoreResult
+
+	// Consecutive blocks that map to consecutive store offsets are
+	// collected into a single run, to keep the number of ioctls down.
+	var runFileOffset, runStoreOffset, runLength uint64
+	flush := func() error {
+		if runLength == 0 {
+			return nil
+		}
+		value := &unix.FileDedupeRange{
+			Src_offset: runStoreOffset,
+			Src_length: runLength,
+			Info: []unix.FileDedupeRangeInfo{
+				{
+					Dest_fd:     int64(file.Fd()),
+					Dest_offset: runFileOffset,
+				},
+			},
+		}
+		failure := DedupeStoreFailure{Offset: runFileOffset, Length: runLength}
+		runLength = 0
+		if err := FileDedupeRangeFull(int(s.file.Fd()), value, nil); err != nil {
+			return err
+		}
+		// The run may have been deduped in part before failing.
+		deduped := value.Info[0].Bytes_deduped
+		result.BytesReflinked += deduped
+		if status := value.Info[0].Status; status != unix.FILE_DEDUPE_RANGE_SAME {
+			failure.Offset += deduped
+			failure.Length -= deduped
+			failure.Status = status
+			result.Failed = append(result.Failed, failure)
+		}
+		return nil
+	}
+
+	buf := make([]byte, s.blockSize)
+	for offset := uint64(0); ; offset += s.blockSize {
+		n, err := file.ReadAt(buf, int64(offset))
+		if err != nil && err != io.EOF {
+			return result, err
+		}
+		if uint64(n) < s.blockSize {
+			break
+		}
+
+		sum := sha256.Sum256(buf)
+		storeOffset, ok := s.index[sum]
+		if !ok {
+			storeOffset = s.size
+			if _, err := s.file.WriteAt(buf, int64(storeOffset)); err != nil {
+				return result, fmt.Errorf("failed to append to store: %v", err)
+			}
+			s.index[sum] = storeOffset
+			s.size += s.blockSize
+			result.BytesAppended += s.blockSize
+		}
+
+		if runLength != 0 &&
+			offset == runFileOffset+runLength &&
+			storeOffset == runStoreOffset+runLength {
+			runLength += s.blockSize
+			continue
+		}
+		if err := flush(); err != nil {
+			return result, err
+		}
+		runFileOffset = offset
+		runStoreOffset = storeOffset
+		runLength = s.blockSize
+	}
+
+	if err := flush(); err != nil {
+		return result, err
+	}
+	return result, nil
+}
@@ -0,0 +1,65 @@
+package fstools
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestOpenDedupeStoreMisalignedBlockSize(t *testing.T) {
+	dir := t.TempDir()
+	fsBlockSize, err := FileBlockSize(tempFile(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenDedupeStore(filepath.Join(dir, "store"), fsBlockSize+1); err == nil {
+		t.Fatalf("opened a store with block size %d, want an error", fsBlockSize+1)
+	}
+}
+
+func TestDedupeStoreAddFileFailed(t *testing.T) {
+	dir := t.TempDir()
+	fsBlockSize, err := FileBlockSize(tempFile(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := OpenDedupeStore(filepath.Join(dir, "store"), fsBlockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	// Both zero blocks map to the same store block, so they are deduped by
+	// separate ioctls, the second of which differs.
+	file, err := os.Open(writeTempFile(t, dir, "file", 2*int(fsBlockSize)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var calls int
+	fakeDedupeRange(t, func(srcFd int, value *unix.FileDedupeRange) error {
+		calls++
+		if calls == 1 {
+			value.Info[0].Status = unix.FILE_DEDUPE_RANGE_SAME
+			value.Info[0].Bytes_deduped = value.Src_length
+		} else {
+			value.Info[0].Status = unix.FILE_DEDUPE_RANGE_DIFFERS
+			value.Info[0].Bytes_deduped = 0
+		}
+		return nil
+	})
+
+	result, err := store.AddFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.BytesReflinked != fsBlockSize {
+		t.Errorf("got %d bytes reflinked, want %d", result.BytesReflinked, fsBlockSize)
+	}
+	want := DedupeStoreFailure{Offset: fsBlockSize, Length: fsBlockSize, Status: unix.FILE_DEDUPE_RANGE_DIFFERS}
+	if len(result.Failed) != 1 || result.Failed[0] != want {
+		t.Errorf("got failures %+v, want [%+v]", result.Failed, want)
+	}
+}
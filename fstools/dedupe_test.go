@@ -0,0 +1,69 @@
+package fstools
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// writeTempFile creates a file named name in dir holding size bytes.
+func writeTempFile(t *testing.T, dir, name string, size int) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, make([]byte, size), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestDedupeFilesSourceUnlinked(t *testing.T) {
+	const size, chunk = 3 * 4096, 4096
+	dir := t.TempDir()
+	src := writeTempFile(t, dir, "src", size)
+	dst := writeTempFile(t, dir, "dst", size)
+
+	fakeFiemap(t, fiemapOf(nil))
+	var calls int
+	fakeDedupeRange(t, func(srcFd int, value *unix.FileDedupeRange) error {
+		calls++
+		if calls == 1 {
+			if err := os.Remove(src); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// The dedupe must keep working on the open fd, not the path.
+		var stat unix.Stat_t
+		if err := unix.Fstat(srcFd, &stat); err != nil {
+			t.Fatalf("source fd unusable after unlink: %v", err)
+		}
+		if stat.Nlink != 0 {
+			t.Errorf("got %d links to the source, want 0", stat.Nlink)
+		}
+		for i := range value.Info {
+			value.Info[i].Status = unix.FILE_DEDUPE_RANGE_SAME
+			value.Info[i].Bytes_deduped = min(value.Src_length, chunk)
+		}
+		return nil
+	})
+
+	result, err := DedupeFilesContext(context.Background(), src, []string{dst}, DedupeOptions{
+		ChunkSize:     chunk,
+		NoSharedCheck: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != size/chunk {
+		t.Errorf("got %d ioctls, want %d", calls, size/chunk)
+	}
+	target := result.Targets[0]
+	if err := target.Err(); err != nil {
+		t.Errorf("got target error %v", err)
+	}
+	if target.BytesDeduped != size || result.Length != size {
+		t.Errorf("deduped %d of %d Bytes, want %d", target.BytesDeduped, result.Length, size)
+	}
+}
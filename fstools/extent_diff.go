@@ -0,0 +1,119 @@
+package fstools
+
+import "math"
+
+// RangeKind classifies a logical range when comparing the extents of two
+// files.
+type RangeKind int
+
+const (
+	// RangeShared is mapped in both files to the same physical offset.
+	RangeShared RangeKind = iota
+	// RangeDiffers is mapped in both files, but to different physical
+	// offsets, or to one without a known location.
+	RangeDiffers
+	// RangeOnlyA is only mapped in the first file, so it is a hole in the
+	// second.
+	RangeOnlyA
+	// RangeOnlyB is only mapped in the second file, so it is a hole in the
+	// first.
+	RangeOnlyB
+)
+
+var rangeKindNames = map[RangeKind]string{
+	RangeShared:  "shared",
+	RangeDiffers: "differs",
+	RangeOnlyA:   "only_a",
+	RangeOnlyB:   "only_b",
+}
+
+func (k RangeKind) String() string {
+	return rangeKindNames[k]
+}
+
+// RangeDiff is a logical range of two files, classified by how the two
+// files map it. AFlags and BFlags are the FIEMAP_EXTENT_* flags of the
+// extent covering the range in each file, or zero for a hole.
+type RangeDiff struct {
+	Logical uint64
+	Length  uint64
+	Kind    RangeKind
+	AFlags  uint32
+	BFlags  uint32
+}
+
+// DiffExtents compares the extents of two files, both sorted by logical
+// offset, and returns the logical ranges mapped in either file, in order.
+// Ranges that are holes in both files are omitted. Adjacent ranges of the
+// same kind and flags are merged into a single run.
+func DiffExtents(a, b []FiemapExtent) []RangeDiff {
+	var diffs []RangeDiff
+	emit := func(d RangeDiff) {
+		if n := len(diffs); n > 0 {
+			last := &diffs[n-1]
+			if last.Logical+last.Length == d.Logical &&
+				last.Kind == d.Kind &&
+				last.AFlags == d.AFlags &&
+				last.BFlags == d.BFlags {
+				last.Length += d.Length
+				return
+			}
+		}
+		diffs = append(diffs, d)
+	}
+
+	// pos is the logical offset that everything before has been emitted
+	// for, so only the part of each extent at or after pos is considered.
+	var pos uint64
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		var ea, eb *FiemapExtent
+		aLo, aHi := uint64(math.MaxUint64), uint64(math.MaxUint64)
+		bLo, bHi := uint64(math.MaxUint64), uint64(math.MaxUint64)
+		if i < len(a) {
+			ea = &a[i]
+			aLo, aHi = max(ea.Logical, pos), ea.Logical+ea.Length
+			if aHi <= aLo {
+				i++
+				continue
+			}
+		}
+		if j < len(b) {
+			eb = &b[j]
+			bLo, bHi = max(eb.Logical, pos), eb.Logical+eb.Length
+			if bHi <= bLo {
+				j++
+				continue
+			}
+		}
+
+		lo := min(aLo, bLo)
+		inA, inB := ea != nil && aLo == lo, eb != nil && bLo == lo
+		var hi uint64
+		switch {
+		case inA && inB:
+			hi = min(aHi, bHi)
+			kind := RangeDiffers
+			if extentHasLocation(ea) && extentHasLocation(eb) &&
+				ea.Physical+(lo-ea.Logical) == eb.Physical+(lo-eb.Logical) {
+				kind = RangeShared
+			}
+			emit(RangeDiff{Logical: lo, Length: hi - lo, Kind: kind, AFlags: ea.Flags, BFlags: eb.Flags})
+		case inA:
+			hi = min(aHi, bLo)
+			emit(RangeDiff{Logical: lo, Length: hi - lo, Kind: RangeOnlyA, AFlags: ea.Flags})
+		default:
+			hi = min(bHi, aLo)
+			emit(RangeDiff{Logical: lo, Length: hi - lo, Kind: RangeOnlyB, BFlags: eb.Flags})
+		}
+
+		pos = hi
+		if ea != nil && aHi <= pos {
+			i++
+		}
+		if eb != nil && bHi <= pos {
+			j++
+		}
+	}
+	return diffs
+}
@@ -0,0 +1,116 @@
+package fstools
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiffExtents(t *testing.T) {
+	const p = 1 << 20 // an arbitrary physical offset
+	tests := []struct {
+		name string
+		a, b []FiemapExtent
+		want []RangeDiff
+	}{
+		{
+			name: "both empty",
+		},
+		{
+			name: "shared",
+			a:    []FiemapExtent{{Logical: 0, Physical: p, Length: 8192}},
+			b:    []FiemapExtent{{Logical: 0, Physical: p, Length: 8192}},
+			want: []RangeDiff{{Logical: 0, Length: 8192, Kind: RangeShared}},
+		},
+		{
+			name: "differs",
+			a:    []FiemapExtent{{Logical: 0, Physical: p, Length: 8192}},
+			b:    []FiemapExtent{{Logical: 0, Physical: 2 * p, Length: 8192}},
+			want: []RangeDiff{{Logical: 0, Length: 8192, Kind: RangeDiffers}},
+		},
+		{
+			name: "hole in b",
+			a:    []FiemapExtent{{Logical: 4096, Physical: p, Length: 4096, Flags: FIEMAP_EXTENT_LAST}},
+			want: []RangeDiff{{Logical: 4096, Length: 4096, Kind: RangeOnlyA, AFlags: FIEMAP_EXTENT_LAST}},
+		},
+		{
+			name: "hole in a",
+			b:    []FiemapExtent{{Logical: 0, Physical: p, Length: 4096}},
+			want: []RangeDiff{{Logical: 0, Length: 4096, Kind: RangeOnlyB}},
+		},
+		{
+			name: "partial overlap",
+			a:    []FiemapExtent{{Logical: 0, Physical: p, Length: 8192}},
+			b:    []FiemapExtent{{Logical: 4096, Physical: p + 4096, Length: 8192}},
+			want: []RangeDiff{
+				{Logical: 0, Length: 4096, Kind: RangeOnlyA},
+				{Logical: 4096, Length: 4096, Kind: RangeShared},
+				{Logical: 8192, Length: 4096, Kind: RangeOnlyB},
+			},
+		},
+		{
+			name: "split extents merge into one run",
+			a: []FiemapExtent{
+				{Logical: 0, Physical: p, Length: 4096},
+				{Logical: 4096, Physical: p + 4096, Length: 4096},
+			},
+			b:    []FiemapExtent{{Logical: 0, Physical: p, Length: 8192}},
+			want: []RangeDiff{{Logical: 0, Length: 8192, Kind: RangeShared}},
+		},
+		{
+			name: "different flags aren't merged",
+			a: []FiemapExtent{
+				{Logical: 0, Physical: p, Length: 4096},
+				{Logical: 4096, Physical: p + 4096, Length: 4096, Flags: FIEMAP_EXTENT_LAST},
+			},
+			b: []FiemapExtent{{Logical: 0, Physical: p, Length: 8192, Flags: FIEMAP_EXTENT_LAST}},
+			want: []RangeDiff{
+				{Logical: 0, Length: 4096, Kind: RangeShared, BFlags: FIEMAP_EXTENT_LAST},
+				{Logical: 4096, Length: 4096, Kind: RangeShared, AFlags: FIEMAP_EXTENT_LAST, BFlags: FIEMAP_EXTENT_LAST},
+			},
+		},
+		{
+			name: "physical offset shifted within the overlap",
+			a:    []FiemapExtent{{Logical: 0, Physical: p, Length: 8192}},
+			b: []FiemapExtent{
+				{Logical: 0, Physical: 2 * p, Length: 4096},
+				{Logical: 4096, Physical: p + 4096, Length: 4096},
+			},
+			want: []RangeDiff{
+				{Logical: 0, Length: 4096, Kind: RangeDiffers},
+				{Logical: 4096, Length: 4096, Kind: RangeShared},
+			},
+		},
+		{
+			name: "unknown location never shares",
+			a:    []FiemapExtent{{Logical: 0, Physical: 0, Length: 4096, Flags: FIEMAP_EXTENT_UNKNOWN}},
+			b:    []FiemapExtent{{Logical: 0, Physical: 0, Length: 4096, Flags: FIEMAP_EXTENT_UNKNOWN}},
+			want: []RangeDiff{{
+				Logical: 0, Length: 4096, Kind: RangeDiffers,
+				AFlags: FIEMAP_EXTENT_UNKNOWN, BFlags: FIEMAP_EXTENT_UNKNOWN,
+			}},
+		},
+		{
+			name: "holes in both are omitted",
+			a: []FiemapExtent{
+				{Logical: 0, Physical: p, Length: 4096},
+				{Logical: 16384, Physical: p + 16384, Length: 4096},
+			},
+			b: []FiemapExtent{
+				{Logical: 0, Physical: p, Length: 4096},
+				{Logical: 16384, Physical: p + 16384, Length: 4096},
+			},
+			want: []RangeDiff{
+				{Logical: 0, Length: 4096, Kind: RangeShared},
+				{Logical: 16384, Length: 4096, Kind: RangeShared},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := DiffExtents(tt.a, tt.b)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
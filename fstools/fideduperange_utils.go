@@ -1,13 +1,85 @@
 package fstools
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"math"
+	"sort"
 
 	"golang.org/x/sys/unix"
 )
 
+// ErrDedupeNoProgress is returned by FileDedupeRangeFullWithOptions when the
+// kernel reports a destination as matching, but dedupes zero bytes, so the
+// dedupe can't make progress. This can happen near compressed or inline
+// extents. The returned error wraps it with the source offset reached.
+var ErrDedupeNoProgress = errors.New("dedupe made no progress")
+
+// fileDedupeRangeIoctl issues a single FIDEDUPERANGE request. It is a
+// variable, so that tests can stand in for the kernel.
+var fileDedupeRangeIoctl = ioctlFileDedupeRange
+
 type FileDedupeRangeFullProgress func(bytesDeduped, bytesLength uint64, exit bool)
 
+// rateLimitChunkAlignment is the granularity used when splitting requests
+// into smaller chunks for rate limiting. It is a multiple of any reasonable
+// filesystem block size.
+const rateLimitChunkAlignment = 1024 * 1024
+
+// FileDedupeRangeOptions holds the optional settings for
+// FileDedupeRangeFullWithOptions. The zero value is the default behavior.
+type FileDedupeRangeOptions struct {
+	// Progress is called after every ioctl to report progress, if not nil.
+	Progress FileDedupeRangeFullProgress
+
+	// MaxRate limits the average dedupe throughput to this many bytes per
+	// second, by splitting the request into smaller chunks and sleeping
+	// between them. Zero means unlimited.
+	MaxRate uint64
+
+	// ChunkSize limits the number of bytes requested by each ioctl.
+	// Zero requests everything remaining, leaving the split to the kernel.
+	// It is rounded down to a multiple of the source's block size, but no
+	// less than one block, so that every request after the first stays
+	// aligned.
+	ChunkSize uint64
+
+	// DestLengths, if not nil, holds the number of bytes to dedupe for each
+	// entry of value.Info, which may be less than value.Src_length when a
+	// destination is shorter than the source. A destination is finished,
+	// with a status of FILE_DEDUPE_RANGE_SAME, once its length is reached.
+	DestLengths []uint64
+
+	// DataRanges, if not nil, holds the sorted ranges of the source that
+	// hold data, as returned by DataRanges. The parts of the request that
+	// fall outside of them are skipped without an ioctl, but counted in
+	// Bytes_deduped like the kernel counts holes it dedupes, so that the
+	// source offset reached is still given by Bytes_deduped. The
+	// destinations are not compared over the skipped parts.
+	DataRanges []Range
+
+	// BytesSkipped, if not nil, holds an entry for each entry of
+	// value.Info, to which the bytes skipped for that destination because
+	// of DataRanges are added. Subtracting them from Bytes_deduped gives
+	// the bytes that were actually deduped.
+	BytesSkipped []uint64
+
+	// Checkpoint, if not nil, is called after every ioctl, once value.Info
+	// reflects the progress made so far, so that the caller can save it.
+	Checkpoint func()
+
+	// OnIoctl, if not nil, is called once for every FIDEDUPERANGE ioctl
+	// issued, whatever its result. Holes skipped because of DataRanges and
+	// the comparisons made for DryRun don't issue one.
+	OnIoctl func()
+
+	// DryRun compares the source and destination ranges in user space
+	// instead of issuing FIDEDUPERANGE, taking the same steps and reporting
+	// the statuses the dedupe would, without changing any file.
+	DryRun bool
+}
+
 // FileDedupeRangeFull is a wrapper around IoctlFileDedupeRange that is able
 // to fulfill deduping full file lengths and is resilient to destination file
 // dedupe failures.
@@ -23,6 +95,26 @@ func FileDedupeRangeFull(
 	value *unix.FileDedupeRange,
 	progress FileDedupeRangeFullProgress,
 ) error {
+	return FileDedupeRangeFullWithOptions(context.Background(), srcFd, value, FileDedupeRangeOptions{
+		Progress: progress,
+	})
+}
+
+// FileDedupeRangeFullWithOptions is FileDedupeRangeFull with additional
+// options, like rate limiting.
+//
+// The ctx is checked between each ioctl. If it is cancelled, ctx.Err() is
+// returned and value.Info reflects the progress made so far, so that the
+// dedupe can be continued later. Since all destinations that are still being
+// deduped progress together, the source offset reached is value.Src_offset
+// plus the largest Bytes_deduped among the destinations.
+func FileDedupeRangeFullWithOptions(
+	ctx context.Context,
+	srcFd int,
+	value *unix.FileDedupeRange,
+	opts FileDedupeRangeOptions,
+) error {
+	progress := opts.Progress
 	if progress != nil {
 		defer progress(0, 0, true)
 	}
@@ -33,6 +125,12 @@ func FileDedupeRangeFull(
 	if len(value.Info) == 0 {
 		panic("value.Info array empty")
 	}
+	if opts.DestLengths != nil && len(opts.DestLengths) != len(value.Info) {
+		panic("opts.DestLengths and value.Info have different lengths")
+	}
+	if opts.BytesSkipped != nil && len(opts.BytesSkipped) != len(value.Info) {
+		panic("opts.BytesSkipped and value.Info have different lengths")
+	}
 
 	// Copy the value into the local requect variable, since we may need to
 	// make multiple subsequent requests to cover the full Src_length and we
@@ -63,8 +161,8 @@ func FileDedupeRangeFull(
 		}
 		dropIndex := 0
 		dstIndex := 0
-		for srcIndex := range value.Info {
-			if srcIndex == dropList[dropIndex] {
+		for srcIndex := range req.Info {
+			if dropIndex < len(dropList) && srcIndex == dropList[dropIndex] {
 				dropIndex++
 				continue
 			}
@@ -78,11 +176,96 @@ func FileDedupeRangeFull(
 		indices = indices[:dstIndex]
 	}
 
+	var limiter *rateLimiter
+	chunkSize := opts.ChunkSize
+	if chunkSize != 0 {
+		var stat unix.Stat_t
+		if err := unix.Fstat(srcFd, &stat); err != nil {
+			return err
+		}
+		blockSize := uint64(stat.Blksize)
+		chunkSize = max(AlignDown(chunkSize, blockSize), blockSize)
+	}
+	if opts.MaxRate != 0 {
+		rateChunkSize := opts.MaxRate - opts.MaxRate%rateLimitChunkAlignment
+		if rateChunkSize == 0 {
+			rateChunkSize = rateLimitChunkAlignment
+		}
+		if chunkSize == 0 || rateChunkSize < chunkSize {
+			chunkSize = rateChunkSize
+		}
+		limiter = newRateLimiter(opts.MaxRate, rateChunkSize)
+	}
+
+	dedupeRange := fileDedupeRangeIoctl
+	if opts.DryRun {
+		dedupeRange = compareFileDedupeRange
+	}
+
 	if progress != nil {
 		progress(0, value.Src_length, false)
 	}
+	remaining := value.Src_length
 	for {
-		if err := unix.IoctlFileDedupeRange(srcFd, req); err != nil {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		req.Src_length = remaining
+		if chunkSize != 0 && req.Src_length > chunkSize {
+			req.Src_length = chunkSize
+		}
+		if opts.DestLengths != nil {
+			// Finish the destinations that reached their length, and
+			// don't request past the end of the shortest one left.
+			done := req.Src_offset - value.Src_offset
+			var finished []int
+			for i, index := range indices {
+				if opts.DestLengths[index] <= done {
+					value.Info[index].Status = unix.FILE_DEDUPE_RANGE_SAME
+					finished = append(finished, i)
+					continue
+				}
+				req.Src_length = min(req.Src_length, opts.DestLengths[index]-done)
+			}
+			drop(finished)
+			if len(req.Info) == 0 {
+				return nil
+			}
+		}
+
+		if opts.DataRanges != nil {
+			hole, data := dataRangeAt(opts.DataRanges, req.Src_offset)
+			if hole > 0 {
+				skip := min(hole, req.Src_length)
+				req.Src_offset += skip
+				remaining -= skip
+				for i, index := range indices {
+					req.Info[i].Dest_offset += skip
+					value.Info[index].Bytes_deduped += skip
+					if opts.BytesSkipped != nil {
+						opts.BytesSkipped[index] += skip
+					}
+				}
+				if progress != nil {
+					progress(req.Src_offset-value.Src_offset, value.Src_length, false)
+				}
+				if remaining == 0 {
+					return nil
+				}
+				continue
+			}
+			req.Src_length = min(req.Src_length, data)
+		}
+
+		err := dedupeRange(srcFd, req)
+		if opts.OnIoctl != nil && !opts.DryRun {
+			opts.OnIoctl()
+		}
+		if err != nil {
+			if err == unix.ENOSPC {
+				return &NoSpaceError{Deduped: req.Src_offset - value.Src_offset}
+			}
 			return err
 		}
 
@@ -110,12 +293,26 @@ func FileDedupeRangeFull(
 		if dedupeBytes > req.Src_length {
 			panic("deduped more bytes than requested")
 		}
+		// A destination that matched without deduping anything would
+		// otherwise have the same request issued again forever, since
+		// neither the offsets nor the drop list would change.
+		if dedupeBytesValid && dedupeBytes == 0 && req.Src_length > 0 {
+			return fmt.Errorf(
+				"%w at source offset %d with %d bytes requested (possibly a compressed or inline extent)",
+				ErrDedupeNoProgress,
+				req.Src_offset,
+				req.Src_length,
+			)
+		}
 
 		req.Src_offset += dedupeBytes
-		req.Src_length -= dedupeBytes
+		remaining -= dedupeBytes
 
 		if progress != nil {
-			progress(req.Src_offset, value.Src_length, false)
+			progress(req.Src_offset-value.Src_offset, value.Src_length, false)
+		}
+		if limiter != nil {
+			limiter.Wait(dedupeBytes)
 		}
 
 		var dropList = make([]int, 0, len(req.Info))
@@ -129,7 +326,10 @@ func FileDedupeRangeFull(
 				dropList = append(dropList, i)
 			}
 		}
-		if req.Src_length == 0 {
+		if opts.Checkpoint != nil {
+			opts.Checkpoint()
+		}
+		if remaining == 0 {
 			return nil
 		}
 		drop(dropList)
@@ -142,8 +342,11 @@ func FileDedupeRangeFull(
 
 // FileDedupeRangeStatusToString converts a FileDedupeRangeInfo.Status to a
 // human-readable string.
+//
+// Negative statuses are errnos, except math.MinInt32, which can't be negated
+// and is reported as unknown like any other invalid status.
 func FileDedupeRangeStatusToString(status int32) string {
-	if status < 0 {
+	if status < 0 && status != math.MinInt32 {
 		return "errno " + unix.Errno(-status).Error()
 	}
 	switch status {
@@ -155,3 +358,19 @@ func FileDedupeRangeStatusToString(status int32) string {
 		return fmt.Sprintf("unknown status(%d)", status)
 	}
 }
+
+// dataRangeAt returns the number of bytes from offset to the start of the
+// next of ranges, if offset is in a hole, or else the number of bytes left
+// in the range holding offset. Past the last range, the hole is endless.
+func dataRangeAt(ranges []Range, offset uint64) (hole, data uint64) {
+	i := sort.Search(len(ranges), func(i int) bool {
+		return ranges[i].End() > offset
+	})
+	if i == len(ranges) {
+		return math.MaxUint64, 0
+	}
+	if ranges[i].Offset > offset {
+		return ranges[i].Offset - offset, 0
+	}
+	return 0, ranges[i].End() - offset
+}
@@ -0,0 +1,172 @@
+package fstools
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// fakeDedupeRange replaces the FIDEDUPERANGE ioctl with fn for the rest of
+// the test.
+func fakeDedupeRange(t *testing.T, fn func(srcFd int, value *unix.FileDedupeRange) error) {
+	t.Helper()
+	orig := fileDedupeRangeIoctl
+	fileDedupeRangeIoctl = fn
+	t.Cleanup(func() { fileDedupeRangeIoctl = orig })
+}
+
+func TestFileDedupeRangeFullNoProgress(t *testing.T) {
+	var calls int
+	fakeDedupeRange(t, func(srcFd int, value *unix.FileDedupeRange) error {
+		calls++
+		if calls > 1 {
+			t.Fatalf("ioctl issued again after a response with no progress")
+		}
+		for i := range value.Info {
+			value.Info[i].Status = unix.FILE_DEDUPE_RANGE_SAME
+			value.Info[i].Bytes_deduped = 0
+		}
+		return nil
+	})
+
+	value := &unix.FileDedupeRange{
+		Src_length: 4096,
+		Info:       []unix.FileDedupeRangeInfo{{Dest_fd: 1}},
+	}
+	err := FileDedupeRangeFullWithOptions(context.Background(), 0, value, FileDedupeRangeOptions{})
+	if !errors.Is(err, ErrDedupeNoProgress) {
+		t.Fatalf("got error %v, want ErrDedupeNoProgress", err)
+	}
+	if calls != 1 {
+		t.Errorf("got %d ioctls, want 1", calls)
+	}
+}
+
+func TestFileDedupeRangeBytesSkipped(t *testing.T) {
+	var requested []uint64
+	fakeDedupeRange(t, func(srcFd int, value *unix.FileDedupeRange) error {
+		requested = append(requested, value.Src_offset, value.Src_length)
+		for i := range value.Info {
+			value.Info[i].Status = unix.FILE_DEDUPE_RANGE_SAME
+			value.Info[i].Bytes_deduped = value.Src_length
+		}
+		return nil
+	})
+
+	// Data in [4096, 8192), holes before and after it.
+	value := &unix.FileDedupeRange{
+		Src_length: 12288,
+		Info:       []unix.FileDedupeRangeInfo{{Dest_fd: 1}, {Dest_fd: 2}},
+	}
+	opts := FileDedupeRangeOptions{
+		DataRanges:   []Range{{Offset: 4096, Length: 4096}},
+		BytesSkipped: make([]uint64, 2),
+	}
+	if err := FileDedupeRangeFullWithOptions(context.Background(), 0, value, opts); err != nil {
+		t.Fatal(err)
+	}
+	if want := []uint64{4096, 4096}; fmt.Sprint(requested) != fmt.Sprint(want) {
+		t.Errorf("got ioctls for (offset, length) %v, want %v", requested, want)
+	}
+	for i, info := range value.Info {
+		if info.Bytes_deduped != 12288 {
+			t.Errorf("destination %d: got %d bytes deduped, want 12288", i, info.Bytes_deduped)
+		}
+		if opts.BytesSkipped[i] != 8192 {
+			t.Errorf("destination %d: got %d bytes skipped, want 8192", i, opts.BytesSkipped[i])
+		}
+	}
+}
+
+func TestFileDedupeRangeChunkSizeAligned(t *testing.T) {
+	src := tempFile(t)
+	blockSize, err := FileBlockSize(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lengths []uint64
+	fakeDedupeRange(t, func(srcFd int, value *unix.FileDedupeRange) error {
+		lengths = append(lengths, value.Src_length)
+		for i := range value.Info {
+			value.Info[i].Status = unix.FILE_DEDUPE_RANGE_SAME
+			value.Info[i].Bytes_deduped = value.Src_length
+		}
+		return nil
+	})
+
+	for _, chunkSize := range []uint64{1, blockSize + 1, 2*blockSize - 1} {
+		lengths = nil
+		value := &unix.FileDedupeRange{
+			Src_length: 4 * blockSize,
+			Info:       []unix.FileDedupeRangeInfo{{Dest_fd: 1}},
+		}
+		opts := FileDedupeRangeOptions{ChunkSize: chunkSize}
+		if err := FileDedupeRangeFullWithOptions(context.Background(), int(src.Fd()), value, opts); err != nil {
+			t.Fatal(err)
+		}
+		for _, length := range lengths {
+			if length != blockSize {
+				t.Errorf("chunk size %d: got request of %d bytes, want %d", chunkSize, length, blockSize)
+			}
+		}
+	}
+}
+
+func TestFileDedupeRangeOnIoctl(t *testing.T) {
+	var calls int
+	fakeDedupeRange(t, func(srcFd int, value *unix.FileDedupeRange) error {
+		calls++
+		for i := range value.Info {
+			value.Info[i].Status = unix.FILE_DEDUPE_RANGE_SAME
+			value.Info[i].Bytes_deduped = min(value.Src_length, 4096)
+		}
+		return nil
+	})
+
+	// The hole at the start is skipped without an ioctl, and the kernel
+	// dedupes one block of the data at a time.
+	value := &unix.FileDedupeRange{
+		Src_length: 4 * 4096,
+		Info:       []unix.FileDedupeRangeInfo{{Dest_fd: 1}},
+	}
+	var ioctls int
+	opts := FileDedupeRangeOptions{
+		DataRanges: []Range{{Offset: 4096, Length: 3 * 4096}},
+		OnIoctl:    func() { ioctls++ },
+	}
+	if err := FileDedupeRangeFullWithOptions(context.Background(), 0, value, opts); err != nil {
+		t.Fatal(err)
+	}
+	if ioctls != calls || ioctls != 3 {
+		t.Errorf("got %d OnIoctl calls for %d ioctls, want 3", ioctls, calls)
+	}
+}
+
+func FuzzFileDedupeRangeStatusToString(f *testing.F) {
+	f.Add(int32(unix.FILE_DEDUPE_RANGE_SAME))
+	f.Add(int32(unix.FILE_DEDUPE_RANGE_DIFFERS))
+	f.Add(-int32(unix.EINVAL))
+	f.Add(int32(math.MinInt32))
+	f.Add(int32(math.MaxInt32))
+	f.Fuzz(func(t *testing.T, status int32) {
+		s := FileDedupeRangeStatusToString(status)
+		var want string
+		switch {
+		case status == unix.FILE_DEDUPE_RANGE_SAME:
+			want = "range same"
+		case status == unix.FILE_DEDUPE_RANGE_DIFFERS:
+			want = "range differs"
+		case status < 0 && status != math.MinInt32:
+			want = "errno " + unix.Errno(-status).Error()
+		default:
+			want = fmt.Sprintf("unknown status(%d)", status)
+		}
+		if s != want {
+			t.Fatalf("status %d: got %q, want %q", status, s, want)
+		}
+	})
+}
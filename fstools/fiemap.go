@@ -1,4 +1,4 @@
-//go:build amd64 && linux
+//go:build linux
 
 // Package fstools provides access to low level syscalls for advanced filesystem
 // functionality.
@@ -14,6 +14,9 @@ import (
 // https://github.com/torvalds/linux/blob/master/include/uapi/linux/fs.h
 // https://git.kernel.org/pub/scm/fs/ext2/e2fsprogs.git/tree/misc/filefrag.c
 
+// FS_IOC_FIEMAP is _IOWR('f', 11, struct fiemap). Since struct fiemap is 32
+// bytes on every architecture, and the read/write direction bits encode the
+// same on all of them, the request number is the same everywhere.
 const (
 	FS_IOC_FIEMAP = 0xC020660B
 )
@@ -83,24 +86,38 @@ type FiemapExtent struct {
 //
 // We choose to use the value.Extents field as purley as the output array to
 // allow reuse on the calller side.
-func IoctlFiemap(fd int, value *Fiemap) error {
-	buf := make([]byte, SizeofRawFiemap+len(value.Extents)*SizeofRawFiemapExtent)
-	bufPtr := unsafe.Pointer(&buf[0])
-
-	// The make function seems to always allocate 8 byte aligned on amd64.
-	if uintptr(bufPtr)%8 != 0 {
-		panic("buffer for fiemap ioctl is not 64 bit aligned")
+//
+// The kernel requires reserved fields to be zero on input, so
+// value.Reserved and value.Mapped_extents, along with any contents of
+// value.Extents, are never passed to the kernel. The reserved fields
+// returned in value and its extents carry no meaning and should be ignored.
+func IoctlFiemap(fd int, value *Fiemap) (err error) {
+	if l := ioctlLogger; l != nil {
+		in := *value
+		defer func() { l.logFiemap(fd, in, value, err) }()
 	}
 
+	// The buffer is allocated as uint64s, so that it is 64 bit aligned even
+	// on 32 bit architectures.
+	size := SizeofRawFiemap + len(value.Extents)*SizeofRawFiemapExtent
+	buf := make([]uint64, size/8)
+	bufPtr := unsafe.Pointer(&buf[0])
+
 	rawFm := (*rawFiemap)(bufPtr)
 	rawFm.Start = value.Start
 	rawFm.Length = value.Length
 	rawFm.Flags = value.Flags
-	rawFm.Mapped_extents = value.Mapped_extents
+	// The buffer is freshly zeroed, which covers fm_mapped_extents,
+	// fm_reserved, and every reserved field of the extent array.
 	rawFm.Extent_count = uint32(len(value.Extents))
-	rawFm.Reserved = value.Reserved
 
-	err := ioctlPtr(fd, FS_IOC_FIEMAP, bufPtr)
+	// FIEMAP only reads, so it is safe to retry when interrupted. The
+	// kernel writes the header back even on failure, so it is reset first.
+	err = retryEINTR(func() error {
+		rawFm.Flags = value.Flags
+		rawFm.Mapped_extents = 0
+		return ioctlPtr(fd, FS_IOC_FIEMAP, bufPtr)
+	})
 
 	// Output
 	for i := range value.Extents {
@@ -114,3 +131,14 @@ func IoctlFiemap(fd int, value *Fiemap) error {
 
 	return err
 }
+
+// Compile time checks that the ioctl structs match the kernel's sizes, which
+// are multiples of 8, as the buffer allocation in IoctlFiemap relies on.
+var (
+	_ [unsafe.Sizeof(rawFiemap{}) - SizeofRawFiemap]byte
+	_ [SizeofRawFiemap - unsafe.Sizeof(rawFiemap{})]byte
+	_ [unsafe.Sizeof(rawFiemapExtent{}) - SizeofRawFiemapExtent]byte
+	_ [SizeofRawFiemapExtent - unsafe.Sizeof(rawFiemapExtent{})]byte
+	_ [-(SizeofRawFiemap % 8)]byte
+	_ [-(SizeofRawFiemapExtent % 8)]byte
+)
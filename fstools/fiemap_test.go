@@ -0,0 +1,107 @@
+package fstools
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// TestFiemapWalkBatches walks more extents than fit in a single FIEMAP
+// request through the seam, so it runs the same on every GOARCH.
+func TestFiemapWalkBatches(t *testing.T) {
+	const n = 700
+	extents := make([]FiemapExtent, n)
+	for i := range extents {
+		extents[i] = FiemapExtent{
+			Logical:  uint64(i) * 8192,
+			Physical: uint64(n-i) * 1 << 20,
+			Length:   4096,
+		}
+	}
+	extents[n-1].Flags = FIEMAP_EXTENT_LAST
+
+	fake := fiemapOf(extents)
+	var starts []uint64
+	fakeFiemap(t, func(fd int, value *Fiemap) error {
+		starts = append(starts, value.Start)
+		return fake(fd, value)
+	})
+	var got []FiemapExtent
+	err := FiemapWalk(tempFile(t), 0, func(index int, extent *FiemapExtent) bool {
+		if index != len(got) {
+			t.Fatalf("got index %d, want %d", index, len(got))
+		}
+		got = append(got, *extent)
+		return false
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != n {
+		t.Fatalf("visited %d extents, want %d", len(got), n)
+	}
+	for i := range got {
+		if got[i] != extents[i] {
+			t.Fatalf("extent %d: got %+v, want %+v", i, got[i], extents[i])
+		}
+	}
+	// Each request continues right after the last extent of the previous.
+	perRequest := (fiemapIoctlBufferSize - SizeofRawFiemap) / SizeofRawFiemapExtent
+	if want := (n + perRequest - 1) / perRequest; len(starts) != want {
+		t.Fatalf("got %d requests, want %d", len(starts), want)
+	}
+	for i, start := range starts[1:] {
+		last := extents[(i+1)*perRequest-1]
+		if start != last.Logical+last.Length {
+			t.Errorf("request %d starts at %d, want %d", i+1, start, last.Logical+last.Length)
+		}
+	}
+}
+
+// TestIoctlFiemap maps a real file with the kernel, which checks the raw
+// structure layout on whichever architecture the test runs on. It is
+// skipped on filesystems without FIEMAP support, like tmpfs.
+func TestIoctlFiemap(t *testing.T) {
+	const size = 3 * 4096
+	path := filepath.Join(t.TempDir(), "file")
+	// Zeros could be left as holes or unwritten extents by some
+	// filesystems, so the data isn't zero.
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	extents, err := CollectExtents(f, FIEMAP_FLAG_SYNC)
+	if errors.Is(err, syscall.EOPNOTSUPP) || errors.Is(err, syscall.ENOTTY) {
+		t.Skipf("FIEMAP not supported here: %v", err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(extents) == 0 {
+		t.Fatal("got no extents for a synced file")
+	}
+	var mapped uint64
+	for i, e := range extents {
+		if e.Reserved64 != [2]uint64{} || e.Reserved != [3]uint32{} {
+			t.Errorf("extent %d: reserved fields set, layout may be wrong: %+v", i, e)
+		}
+		mapped += e.Length
+	}
+	if mapped < size {
+		t.Errorf("mapped %d Bytes, want at least %d", mapped, size)
+	}
+	if last := extents[len(extents)-1]; last.Flags&FIEMAP_EXTENT_LAST == 0 {
+		t.Errorf("last extent not flagged last: %+v", last)
+	}
+}
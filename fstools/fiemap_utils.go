@@ -2,8 +2,10 @@ package fstools
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
+	"math/bits"
 	"os"
 	"strings"
 	"syscall"
@@ -16,6 +18,10 @@ const (
 	fiemapIoctlBufferSize = 2048 * 8
 )
 
+// fiemapIoctl issues a single FIEMAP request. It is a variable, so that tests
+// can stand in for the kernel.
+var fiemapIoctl = IoctlFiemap
+
 // FiemapExtentFlagsToStrings converts FIEMAP extent flags to human-readable strings.
 func FiemapExtentFlagsToStrings(flags uint32) []string {
 	flagDefs := []struct {
@@ -51,30 +57,64 @@ func FiemapExtentFlagsToStrings(flags uint32) []string {
 	return result
 }
 
+// ErrBlockDevice is returned when the extents of a block device are
+// requested, since FIEMAP only maps the contents of files.
+var ErrBlockDevice = errors.New("not supported for block devices")
+
+// CheckFiemapMode returns an error describing why the extents of a file with
+// the given mode can't be mapped, or nil for regular files.
+func CheckFiemapMode(mode os.FileMode) error {
+	switch {
+	case mode.IsRegular():
+		return nil
+	case mode&os.ModeDevice != 0 && mode&os.ModeCharDevice == 0:
+		return ErrBlockDevice
+	case mode.IsDir():
+		return errors.New("is a directory")
+	default:
+		return errors.New("not a regular file")
+	}
+}
+
 // FiemapWalkCallback defines the callback signature for FiemapWalk.
 type FiemapWalkCallback func(index int, extent *FiemapExtent) (finished bool)
 
 // FiemapWalk iterates over all extents that back the given file,
 // calling the provided callback for each extent.
+// It is the same as FiemapWalkRange over the range [0, FIEMAP_MAX_OFFSET).
 //
 // The flags value can 0 as the defualt, otherwise, you can set it to the
 // bitwise or of FIEMAP_FLAG_SYNC, FIEMAP_FLAG_XATTR, or FIEMAP_FLAG_CACHE.
 func FiemapWalk(file *os.File, flags uint32, callback FiemapWalkCallback) error {
+	return FiemapWalkRange(file, 0, FIEMAP_MAX_OFFSET, flags, callback)
+}
+
+// FiemapWalkRange is FiemapWalk, but only walks the extents that overlap the
+// logical range [start, start+length). The callback is not invoked for
+// extents that start at or beyond the end of the range, and an extent that
+// runs past the end has its Length clipped to the end of the range.
+// The first extent is not clipped, so it may start before start.
+func FiemapWalkRange(file *os.File, start, length uint64, flags uint32, callback FiemapWalkCallback) error {
+	end, carry := bits.Add64(start, length, 0)
+	if carry != 0 {
+		end = FIEMAP_MAX_OFFSET
+	}
+
 	// Calculate the number of extents based on the overall ioctl request
 	// buffer size, specifically as done in filefrag command.
 	numExtents := (fiemapIoctlBufferSize - SizeofRawFiemap) / SizeofRawFiemapExtent
 	fmExtents := make([]FiemapExtent, numExtents)
 
 	var nextExtentIndexOffset int
-	var nextLogicalStart uint64
-	for {
+	nextLogicalStart := start
+	for nextLogicalStart < end {
 		fm := Fiemap{
 			Start:   nextLogicalStart,
-			Length:  FIEMAP_MAX_OFFSET,
+			Length:  end - nextLogicalStart,
 			Flags:   flags,
 			Extents: fmExtents,
 		}
-		if err := IoctlFiemap(int(file.Fd()), &fm); err != nil {
+		if err := fiemapIoctl(int(file.Fd()), &fm); err != nil {
 			return err
 		}
 
@@ -85,6 +125,12 @@ func FiemapWalk(file *os.File, flags uint32, callback FiemapWalkCallback) error
 		for i := 0; i < int(fm.Mapped_extents); i++ {
 			index := nextExtentIndexOffset + i
 			extent := &fm.Extents[i]
+			if extent.Logical >= end {
+				return nil
+			}
+			if extent.Logical+extent.Length > end {
+				extent.Length = end - extent.Logical
+			}
 			if callback(index, extent) {
 				return nil
 			}
@@ -93,8 +139,50 @@ func FiemapWalk(file *os.File, flags uint32, callback FiemapWalkCallback) error
 			}
 		}
 		nextExtentIndexOffset += int(fm.Mapped_extents)
-		nextLogicalStart = fm.Extents[fm.Mapped_extents-1].Logical + fm.Extents[fm.Mapped_extents-1].Length
+
+		// Guard against a bogus last extent, which would otherwise wrap
+		// around or stall and restart the walk forever.
+		last := &fm.Extents[fm.Mapped_extents-1]
+		next, carry := bits.Add64(last.Logical, last.Length, 0)
+		if carry != 0 {
+			return fmt.Errorf("fiemap extent at logical offset %d with length %d overflows", last.Logical, last.Length)
+		}
+		if next <= nextLogicalStart {
+			return fmt.Errorf("fiemap walk did not advance past logical offset %d", nextLogicalStart)
+		}
+		nextLogicalStart = next
+	}
+	return nil
+}
+
+// FiemapExtentCount returns the number of extents that overlap the logical
+// range [start, start+length) of file, without retrieving them, by issuing
+// a FIEMAP request with no room for extents.
+func FiemapExtentCount(file *os.File, start, length uint64, flags uint32) (int, error) {
+	fm := Fiemap{
+		Start:  start,
+		Length: length,
+		Flags:  flags,
+	}
+	if err := fiemapIoctl(int(file.Fd()), &fm); err != nil {
+		return 0, err
+	}
+	return int(fm.Mapped_extents), nil
+}
+
+// CollectExtents returns all extents that back the given file.
+//
+// The flags value is passed directly to FiemapWalk.
+func CollectExtents(file *os.File, flags uint32) ([]FiemapExtent, error) {
+	var extents []FiemapExtent
+	err := FiemapWalk(file, flags, func(index int, extent *FiemapExtent) bool {
+		extents = append(extents, *extent)
+		return false
+	})
+	if err != nil {
+		return nil, err
 	}
+	return extents, nil
 }
 
 // FileFragDumpExtents prints all extents that compose the given filePath.
@@ -112,7 +200,42 @@ func FiemapWalk(file *os.File, flags uint32, callback FiemapWalkCallback) error
 // and https://github.com/torvalds/linux/blob/master/include/uapi/linux/fiemap.h
 // for more information.
 func FileFragDumpExtents(filePath string, syncFirst bool, useBytes bool, faster bool) error {
-	fmt.Println("File:", filePath)
+	return FileFragDumpExtentsTo(os.Stdout, filePath, syncFirst, useBytes, faster)
+}
+
+// FileFragDumpExtentsTo is like FileFragDumpExtents, but writes to out
+// instead of standard output.
+func FileFragDumpExtentsTo(out io.Writer, filePath string, syncFirst bool, useBytes bool, faster bool) error {
+	return FileFragDumpExtentsRange(out, filePath, 0, FIEMAP_MAX_OFFSET, syncFirst, useBytes, faster)
+}
+
+// FileFragDumpExtentsRange is like FileFragDumpExtentsTo, but only prints the
+// extents that overlap the logical range [start, start+length), given in
+// bytes. The extent indices are counted from the first extent in the range.
+func FileFragDumpExtentsRange(out io.Writer, filePath string, start, length uint64, syncFirst bool, useBytes bool, faster bool) error {
+	return FileFragDumpExtentsWindow(out, filePath, start, length, 0, 0, syncFirst, useBytes, faster)
+}
+
+// FileFragDumpExtentsWindow is like FileFragDumpExtentsRange, but only
+// prints the first head or the last tail extents of the range, when they
+// are not zero. A note with the number of extents left out is printed in
+// place of the rest.
+func FileFragDumpExtentsWindow(out io.Writer, filePath string, start, length uint64, head, tail int, syncFirst bool, useBytes bool, faster bool) error {
+	return fileFragDump(out, filePath, start, length, head, tail, 0, syncFirst, useBytes, faster)
+}
+
+// FileFragDumpExtentsMatching is like FileFragDumpExtentsRange, but only
+// prints the extents with any of the FIEMAP_EXTENT_* flags in match set, like
+// FIEMAP_EXTENT_SHARED. The indices of the printed extents are the same as
+// in an unfiltered dump.
+func FileFragDumpExtentsMatching(out io.Writer, filePath string, start, length uint64, match uint32, syncFirst bool, useBytes bool, faster bool) error {
+	return fileFragDump(out, filePath, start, length, 0, 0, match, syncFirst, useBytes, faster)
+}
+
+// fileFragDump implements FileFragDumpExtentsWindow and
+// FileFragDumpExtentsMatching. A zero match prints every extent.
+func fileFragDump(out io.Writer, filePath string, start, length uint64, head, tail int, match uint32, syncFirst bool, useBytes bool, faster bool) error {
+	fmt.Fprintln(out, "File:", filePath)
 
 	file, err := os.Open(filePath)
 	if err != nil {
@@ -120,56 +243,199 @@ func FileFragDumpExtents(filePath string, syncFirst bool, useBytes bool, faster
 	}
 	defer file.Close()
 
-	sysStat := new(syscall.Stat_t)
-	if err := syscall.Fstat(int(file.Fd()), sysStat); err != nil {
-		panic(err)
+	var flags uint32
+	if syncFirst {
+		flags |= FIEMAP_FLAG_SYNC
+	}
+	window, err := newExtentWindow(file, start, length, flags)
+	if err != nil {
+		return err
+	}
+	walk := window.walk
+	if match != 0 {
+		walk = walkMatching(walk, match)
+	}
+	return dumpExtentTable(out, window.size, window.blkSize, head, tail, useBytes, faster, window.count, walk)
+}
+
+// walkMatching wraps walk, so that callback is only called for the extents
+// with any of the flags in match set, keeping their original indices.
+func walkMatching(walk func(FiemapWalkCallback) error, match uint32) func(FiemapWalkCallback) error {
+	return func(callback FiemapWalkCallback) error {
+		return walk(func(index int, extent *FiemapExtent) bool {
+			if extent.Flags&match == 0 {
+				return false
+			}
+			return callback(index, extent)
+		})
+	}
+}
+
+// extentWindow walks the extents of a file that overlap a logical range,
+// so that the text and structured reports share the same FIEMAP walk.
+type extentWindow struct {
+	file          *os.File
+	size, blkSize uint64
+	start, length uint64
+	flags         uint32
+}
+
+// newExtentWindow returns the window of file's extents that overlap
+// [start, start+length), which are read with the given FIEMAP flags.
+func newExtentWindow(file *os.File, start, length uint64, flags uint32) (*extentWindow, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat file: %v", err)
+	}
+	if err := CheckFiemapMode(info.Mode()); err != nil {
+		return nil, err
+	}
+	return &extentWindow{
+		file:    file,
+		size:    uint64(info.Size()),
+		blkSize: uint64(info.Sys().(*syscall.Stat_t).Blksize),
+		start:   start,
+		length:  length,
+		flags:   flags,
+	}, nil
+}
+
+// count returns the number of extents in the window.
+func (w *extentWindow) count() (int, error) {
+	return FiemapExtentCount(w.file, w.start, w.length, w.flags)
+}
+
+// walk calls callback for each extent in the window, with indices counted
+// from the first extent in the window.
+func (w *extentWindow) walk(callback FiemapWalkCallback) error {
+	return FiemapWalkRange(w.file, w.start, w.length, w.flags, callback)
+}
+
+// extentSelection picks the extents shown by the extent table and the
+// structured reports, which are either all of them, only the first head, or
+// only the last tail extents, when head or tail is not zero.
+type extentSelection struct {
+	head, tail int
+	// total is the number of extents, which is only counted when head or
+	// tail is set, and skip is the number before the tail.
+	total, skip int
+	emitted     int
+}
+
+// newExtentSelection returns the selection of head or tail extents, calling
+// count to find the total when either is set.
+func newExtentSelection(head, tail int, count func() (int, error)) (*extentSelection, error) {
+	s := &extentSelection{head: head, tail: tail}
+	// The extent count is needed up front to know where the tail starts,
+	// and to report how many extents follow the head.
+	if head > 0 || tail > 0 {
+		var err error
+		s.total, err = count()
+		if err != nil {
+			return nil, fmt.Errorf("failed to count extents: %v", err)
+		}
+	}
+	if tail > 0 && s.total > tail {
+		s.skip = s.total - tail
 	}
-	blkSize := uint64(sysStat.Blksize)
-	fmt.Println("File Size  (Bytes):", sysStat.Size)
-	fmt.Println("Block Size (Bytes):", blkSize)
+	return s, nil
+}
+
+// walk visits the extents with walk and calls emit for each selected one, so
+// that every output format is fed from a single FIEMAP walk.
+func (s *extentSelection) walk(walk func(FiemapWalkCallback) error, emit func(index int, extent *FiemapExtent)) error {
+	return walk(func(index int, extent *FiemapExtent) bool {
+		if index < s.skip {
+			return false
+		}
+		emit(index, extent)
+		s.emitted++
+		return s.head > 0 && s.emitted >= s.head
+	})
+}
+
+// more returns the number of extents left out after the head, once walked.
+func (s *extentSelection) more() int {
+	if s.head > 0 && s.total > s.emitted {
+		return s.total - s.emitted
+	}
+	return 0
+}
+
+// dumpExtentTable prints the size header and the extent table of a file,
+// whose extents are visited by walk. The count function is only called when
+// head or tail is set.
+func dumpExtentTable(
+	out io.Writer,
+	size, blkSize uint64,
+	head, tail int,
+	useBytes, faster bool,
+	count func() (int, error),
+	walk func(FiemapWalkCallback) error,
+) error {
+	fmt.Fprintln(out, "File Size  (Bytes):", size)
+	fmt.Fprintln(out, "Block Size (Bytes):", blkSize)
 	units := "Blocks"
 	if useBytes {
 		units = "Bytes"
 		blkSize = 1
 	}
-	fmt.Println("Start/Length Units:", units)
+	fmt.Fprintln(out, "Start/Length Units:", units)
 
 	var w io.Writer
 	if faster {
-		w = bufio.NewWriter(os.Stdout)
+		w = bufio.NewWriter(out)
 		defer w.(*bufio.Writer).Flush()
 	} else {
-		w = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		w = tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
 		defer w.(*tabwriter.Writer).Flush()
 	}
 
+	sel, err := newExtentSelection(head, tail, count)
+	if err != nil {
+		return err
+	}
+	// The note is printed above the header, since a line without tabs
+	// would split the table's columns.
+	if sel.skip > 0 {
+		fmt.Fprintf(w, "... (truncated, %d earlier extents)\n", sel.skip)
+	}
+
 	fmt.Fprintln(w, "Extent-Index\tLogical-Start\tPhysical-Start\tLength\tFlags")
 
-	var flags uint32
-	if syncFirst {
-		flags |= FIEMAP_FLAG_SYNC
-	}
-	err = FiemapWalk(file, flags, func(index int, extent *FiemapExtent) bool {
-		fmt.Fprintf(
-			w,
-			"%d\t%d\t%d\t%d\t",
-			index,
-			extent.Logical/blkSize,
-			extent.Physical/blkSize,
-			extent.Length/blkSize,
-		)
-		if extent.Logical%blkSize != 0 || extent.Physical%blkSize != 0 || extent.Length%blkSize != 0 {
-			panic("logical start, pysical start, or length are not block size aligned")
+	err = sel.walk(walk, func(index int, extent *FiemapExtent) {
+		// Inline and tail packed extents aren't block aligned, so their
+		// values are printed in bytes, marked with a B suffix.
+		if ExtentIsAligned(extent, blkSize) {
+			fmt.Fprintf(
+				w,
+				"%d\t%d\t%d\t%d\t",
+				index,
+				extent.Logical/blkSize,
+				extent.Physical/blkSize,
+				extent.Length/blkSize,
+			)
+		} else {
+			fmt.Fprintf(
+				w,
+				"%d\t%dB\t%dB\t%dB\t",
+				index,
+				extent.Logical,
+				extent.Physical,
+				extent.Length,
+			)
 		}
 
 		flagNames := FiemapExtentFlagsToStrings(extent.Flags)
 		fmt.Fprintln(w, strings.Join(flagNames, ","))
-		return false
 	})
 
 	if err != nil {
 		return fmt.Errorf("failed to walk fiemap: %v", err)
 	}
+	if more := sel.more(); more > 0 {
+		fmt.Fprintf(w, "... (truncated, %d more extents)\n", more)
+	}
 
 	return nil
 }
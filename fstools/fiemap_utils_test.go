@@ -0,0 +1,261 @@
+package fstools
+
+import (
+	"math"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// fakeFiemap replaces the FIEMAP ioctl with fn for the rest of the test.
+func fakeFiemap(t *testing.T, fn func(fd int, value *Fiemap) error) {
+	t.Helper()
+	orig := fiemapIoctl
+	fiemapIoctl = fn
+	t.Cleanup(func() { fiemapIoctl = orig })
+}
+
+// fiemapOf returns a FIEMAP ioctl that maps extents, which must be sorted,
+// like the kernel would for a file made of them. Offsets that overflow are
+// treated as the end of the logical address space.
+func fiemapOf(extents []FiemapExtent) func(fd int, value *Fiemap) error {
+	saturatingEnd := func(start, length uint64) uint64 {
+		end, carry := bits.Add64(start, length, 0)
+		if carry != 0 {
+			return math.MaxUint64
+		}
+		return end
+	}
+	return func(fd int, value *Fiemap) error {
+		end := saturatingEnd(value.Start, value.Length)
+		var n int
+		for _, e := range extents {
+			if saturatingEnd(e.Logical, e.Length) <= value.Start || e.Logical >= end {
+				continue
+			}
+			// With no room for extents, only the count is returned.
+			if len(value.Extents) > 0 {
+				if n == len(value.Extents) {
+					break
+				}
+				value.Extents[n] = e
+			}
+			n++
+		}
+		value.Mapped_extents = uint32(n)
+		return nil
+	}
+}
+
+// tempFile returns a new empty file, which is closed at the end of the test.
+func tempFile(t *testing.T) *os.File {
+	t.Helper()
+	f, err := os.Create(filepath.Join(t.TempDir(), "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	return f
+}
+
+// walkExtents returns the indices and extents visited by FiemapWalkRange.
+func walkExtents(file *os.File, start, length uint64) ([]int, []FiemapExtent, error) {
+	var indices []int
+	var extents []FiemapExtent
+	err := FiemapWalkRange(file, start, length, 0, func(index int, extent *FiemapExtent) bool {
+		indices = append(indices, index)
+		extents = append(extents, *extent)
+		return false
+	})
+	return indices, extents, err
+}
+
+// fiemapExtentFlagNames maps each name returned by FiemapExtentFlagsToStrings
+// back to its flag.
+var fiemapExtentFlagNames = map[string]uint32{
+	"last":           FIEMAP_EXTENT_LAST,
+	"unknown":        FIEMAP_EXTENT_UNKNOWN,
+	"delalloc":       FIEMAP_EXTENT_DELALLOC,
+	"encoded":        FIEMAP_EXTENT_ENCODED,
+	"data_encrypted": FIEMAP_EXTENT_DATA_ENCRYPTED,
+	"not_aligned":    FIEMAP_EXTENT_NOT_ALIGNED,
+	"data_inline":    FIEMAP_EXTENT_DATA_INLINE,
+	"data_tail":      FIEMAP_EXTENT_DATA_TAIL,
+	"unwritten":      FIEMAP_EXTENT_UNWRITTEN,
+	"merged":         FIEMAP_EXTENT_MERGED,
+	"shared":         FIEMAP_EXTENT_SHARED,
+}
+
+func FuzzFiemapExtentFlagsToStrings(f *testing.F) {
+	f.Add(uint32(0))
+	f.Add(uint32(FIEMAP_EXTENT_LAST | FIEMAP_EXTENT_SHARED))
+	f.Add(uint32(0x10))
+	f.Add(^uint32(0))
+	f.Fuzz(func(t *testing.T, flags uint32) {
+		names := FiemapExtentFlagsToStrings(flags)
+
+		// The names must decode back to the same flags, with any
+		// undocumented ones in a single trailing hex value.
+		var decoded uint32
+		for i, name := range names {
+			if flag, ok := fiemapExtentFlagNames[name]; ok {
+				if decoded&flag != 0 {
+					t.Fatalf("flags %#x: %q repeated in %q", flags, name, names)
+				}
+				decoded |= flag
+				continue
+			}
+			if i != len(names)-1 || !strings.HasPrefix(name, "0x") {
+				t.Fatalf("flags %#x: unexpected name %q in %q", flags, name, names)
+			}
+			rest, err := strconv.ParseUint(name[2:], 16, 32)
+			if err != nil || rest == 0 || uint32(rest)&decoded != 0 {
+				t.Fatalf("flags %#x: bad undocumented flags %q in %q", flags, name, names)
+			}
+			decoded |= uint32(rest)
+		}
+		if decoded != flags {
+			t.Fatalf("flags %#x: %q decodes to %#x", flags, names, decoded)
+		}
+	})
+}
+
+func TestFiemapWalkNearMaxOffset(t *testing.T) {
+	const max = math.MaxUint64
+	tests := []struct {
+		name    string
+		extents []FiemapExtent
+		visited int
+		wantErr bool
+	}{
+		{
+			name: "ends at the max offset",
+			extents: []FiemapExtent{
+				{Logical: max - 8191, Length: 4096},
+				{Logical: max - 4095, Length: 4095},
+			},
+			visited: 2,
+		},
+		{
+			name: "last extent at the max offset",
+			extents: []FiemapExtent{
+				{Logical: max - 4095, Length: 4095, Flags: FIEMAP_EXTENT_LAST},
+			},
+			visited: 1,
+		},
+		{
+			name: "overflows",
+			extents: []FiemapExtent{
+				{Logical: max - 4095, Length: 8192},
+			},
+			visited: 1,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakeFiemap(t, fiemapOf(tt.extents))
+			_, visited, err := walkExtents(tempFile(t), 0, FIEMAP_MAX_OFFSET)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if len(visited) != tt.visited {
+				t.Errorf("visited %d extents, want %d", len(visited), tt.visited)
+			}
+		})
+	}
+}
+
+func TestFiemapWalkStall(t *testing.T) {
+	// A broken filesystem that maps the same extent for every start would
+	// otherwise restart the walk forever.
+	var calls int
+	fakeFiemap(t, func(fd int, value *Fiemap) error {
+		calls++
+		if calls > 2 {
+			t.Fatalf("walk did not stop after a request that didn't advance")
+		}
+		value.Extents[0] = FiemapExtent{Logical: 0, Length: 4096}
+		value.Mapped_extents = 1
+		return nil
+	})
+	if _, _, err := walkExtents(tempFile(t), 0, FIEMAP_MAX_OFFSET); err == nil {
+		t.Fatal("got no error for a walk that didn't advance")
+	}
+}
+
+func TestFiemapWalkRange(t *testing.T) {
+	extents := []FiemapExtent{
+		{Logical: 0, Physical: 1 << 20, Length: 4096},
+		{Logical: 4096, Physical: 2 << 20, Length: 8192},
+		{Logical: 16384, Physical: 3 << 20, Length: 4096, Flags: FIEMAP_EXTENT_LAST},
+	}
+	tests := []struct {
+		name          string
+		start, length uint64
+		want          []FiemapExtent
+	}{
+		{
+			name:   "everything",
+			start:  0,
+			length: FIEMAP_MAX_OFFSET,
+			want:   extents,
+		},
+		{
+			name:   "clips the final extent",
+			start:  2048,
+			length: 8192,
+			want: []FiemapExtent{
+				extents[0],
+				{Logical: 4096, Physical: 2 << 20, Length: 6144},
+			},
+		},
+		{
+			name:   "first extent starts before the range",
+			start:  8192,
+			length: 16384,
+			want:   extents[1:],
+		},
+		{
+			name:   "range in a hole",
+			start:  13000,
+			length: 1000,
+			want:   nil,
+		},
+		{
+			name:   "range ends where an extent starts",
+			start:  12288,
+			length: 4096,
+			want:   nil,
+		},
+		{
+			name:   "length overflows",
+			start:  16384,
+			length: FIEMAP_MAX_OFFSET,
+			want:   extents[2:],
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakeFiemap(t, fiemapOf(extents))
+			indices, got, err := walkExtents(tempFile(t), tt.start, tt.length)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d extents %+v, want %+v", len(got), got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("extent %d: got %+v, want %+v", i, got[i], tt.want[i])
+				}
+				if indices[i] != i {
+					t.Errorf("extent %d: got index %d", i, indices[i])
+				}
+			}
+		})
+	}
+}
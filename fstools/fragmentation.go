@@ -0,0 +1,93 @@
+package fstools
+
+const (
+	// btrfsMaxExtentSize is the largest extent btrfs will create for
+	// uncompressed data.
+	btrfsMaxExtentSize = 128 * 1024 * 1024
+	// btrfsMaxCompressedExtentSize is the largest extent btrfs will create
+	// for compressed data.
+	btrfsMaxCompressedExtentSize = 128 * 1024
+)
+
+// Fragmentation describes how fragmented the extents of a file are.
+type Fragmentation struct {
+	Extents int `json:"extents"`
+	// Fragments is the number of physically contiguous runs of extents.
+	// Adjacent extents that continue each other both logically and
+	// physically are counted as one fragment.
+	Fragments int `json:"fragments"`
+	// IdealFragments is the fewest fragments the mapped bytes could be
+	// stored in, given the filesystem's maximum extent size.
+	IdealFragments int `json:"ideal_fragments"`
+	// Score is Fragments divided by IdealFragments, so a perfectly laid
+	// out file scores 1 and larger values are more fragmented.
+	// A file without any mapped extents scores 0.
+	Score float64 `json:"score"`
+}
+
+// FragmentationScore computes the fragmentation of a file from its extents,
+// sorted by logical offset.
+//
+// Extents without a physical location, like inline or delayed allocation
+// extents, are not counted. Compressed extents are limited to a much smaller
+// size by btrfs, so they are expected to be split more finely.
+func FragmentationScore(extents []FiemapExtent) Fragmentation {
+	var f Fragmentation
+	var plainBytes, encodedBytes uint64
+	var prev *FiemapExtent
+	for i := range extents {
+		e := &extents[i]
+		if !extentHasLocation(e) {
+			continue
+		}
+		f.Extents++
+		if e.Flags&FIEMAP_EXTENT_ENCODED != 0 {
+			encodedBytes += e.Length
+		} else {
+			plainBytes += e.Length
+		}
+		if prev == nil ||
+			prev.Logical+prev.Length != e.Logical ||
+			prev.Physical+prev.Length != e.Physical {
+			f.Fragments++
+		}
+		prev = e
+	}
+	if f.Fragments == 0 {
+		return f
+	}
+
+	f.IdealFragments = int((plainBytes + btrfsMaxExtentSize - 1) / btrfsMaxExtentSize)
+	f.IdealFragments += int((encodedBytes + btrfsMaxCompressedExtentSize - 1) / btrfsMaxCompressedExtentSize)
+	if f.IdealFragments == 0 {
+		f.IdealFragments = 1
+	}
+	f.Score = float64(f.Fragments) / float64(f.IdealFragments)
+	return f
+}
+
+// PhysicalGaps returns how far the disk would have to seek between each pair
+// of consecutive extents, sorted by logical offset, when reading the file in
+// order. Each gap is the absolute distance from the physical end of one
+// extent to the physical start of the next, so contiguous extents have a gap
+// of zero. Extents without a physical location are not counted.
+func PhysicalGaps(extents []FiemapExtent) []uint64 {
+	var gaps []uint64
+	var prev *FiemapExtent
+	for i := range extents {
+		e := &extents[i]
+		if !extentHasLocation(e) {
+			continue
+		}
+		if prev != nil {
+			end := prev.Physical + prev.Length
+			if e.Physical >= end {
+				gaps = append(gaps, e.Physical-end)
+			} else {
+				gaps = append(gaps, end-e.Physical)
+			}
+		}
+		prev = e
+	}
+	return gaps
+}
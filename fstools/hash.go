@@ -0,0 +1,78 @@
+package fstools
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"sort"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/zeebo/blake3"
+)
+
+// DefaultHashAlgorithm is the hash algorithm used to find files that are
+// likely identical. A fast non-cryptographic hash is enough, since the
+// kernel compares the bytes before deduping anything.
+const DefaultHashAlgorithm = "xxhash"
+
+// Hasher computes the content hash used to find files that are likely
+// identical.
+type Hasher interface {
+	hash.Hash
+
+	// Algorithm returns the name the Hasher was created with.
+	Algorithm() string
+}
+
+// hashAlgorithms maps each algorithm name accepted by NewHasher to the
+// function creating its hash.
+var hashAlgorithms = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+	"blake3": func() hash.Hash { return blake3.New() },
+	"xxhash": func() hash.Hash { return xxhash.New() },
+}
+
+// HashAlgorithms returns the names of the algorithms accepted by NewHasher,
+// sorted.
+func HashAlgorithms() []string {
+	names := make([]string, 0, len(hashAlgorithms))
+	for name := range hashAlgorithms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+type namedHasher struct {
+	hash.Hash
+	algorithm string
+}
+
+func (h namedHasher) Algorithm() string {
+	return h.algorithm
+}
+
+// NewHasher returns a new Hasher for the named algorithm, which must be one
+// of HashAlgorithms.
+func NewHasher(algorithm string) (Hasher, error) {
+	newHash, ok := hashAlgorithms[algorithm]
+	if !ok {
+		return nil, fmt.Errorf("unknown hash algorithm %q, expected one of %v", algorithm, HashAlgorithms())
+	}
+	return namedHasher{Hash: newHash(), algorithm: algorithm}, nil
+}
+
+// HashReader returns the hex encoded hash of everything read from r, using
+// the named algorithm.
+func HashReader(r io.Reader, algorithm string) (string, error) {
+	h, err := NewHasher(algorithm)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
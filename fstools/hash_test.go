@@ -0,0 +1,78 @@
+package fstools
+
+import (
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHashReader(t *testing.T) {
+	tests := []struct {
+		algorithm string
+		want      string
+	}{
+		{"sha256", "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"},
+		{"blake3", "6437b3ac38465133ffb63b75273a8db548c558465d79db03fd359c6cd5bd9d85"},
+		{"xxhash", "44bc2cf5ad770999"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.algorithm, func(t *testing.T) {
+			got, err := HashReader(strings.NewReader("abc"), tt.algorithm)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+	if _, err := HashReader(strings.NewReader("abc"), "md5"); err == nil {
+		t.Error("got no error for an unknown algorithm")
+	}
+}
+
+// BenchmarkHasher measures the throughput of each algorithm hashing a 1GiB
+// file, or a 64MiB one with -short. The file is written once, so after the
+// first run it is read from the page cache.
+func BenchmarkHasher(b *testing.B) {
+	size := 1 << 30
+	if testing.Short() {
+		size = 64 << 20
+	}
+	path := filepath.Join(b.TempDir(), "data")
+	f, err := os.Create(path)
+	if err != nil {
+		b.Fatal(err)
+	}
+	buf := make([]byte, 1<<20)
+	for written := 0; written < size; written += len(buf) {
+		if _, err := rand.Read(buf); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := f.Write(buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := f.Close(); err != nil {
+		b.Fatal(err)
+	}
+
+	for _, algorithm := range HashAlgorithms() {
+		b.Run(algorithm, func(b *testing.B) {
+			b.SetBytes(int64(size))
+			for i := 0; i < b.N; i++ {
+				f, err := os.Open(path)
+				if err != nil {
+					b.Fatal(err)
+				}
+				_, err = HashReader(f, algorithm)
+				f.Close()
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,27 @@
+package fstools
+
+import (
+	"os"
+)
+
+// InspectOptions holds the optional settings for InspectFile.
+type InspectOptions struct {
+	// Sync flushes the file to disk before reading its extents, so that
+	// delayed allocations have a physical location.
+	Sync bool
+}
+
+// InspectFile returns the extents that back the file at path.
+func InspectFile(path string, opts InspectOptions) (*ExtentReport, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var flags uint32
+	if opts.Sync {
+		flags |= FIEMAP_FLAG_SYNC
+	}
+	return NewExtentReport(file, path, flags)
+}
@@ -41,3 +41,14 @@ func ioctlPtr(fd int, req uint, arg unsafe.Pointer) (err error) {
 	}
 	return
 }
+
+// retryEINTR calls ioctl until it returns anything but EINTR, which a signal
+// can cause even though nothing went wrong. It must only be used for ioctls
+// that are safe to repeat, like read-only ones or FIDEDUPERANGE.
+func retryEINTR(ioctl func() error) error {
+	for {
+		if err := ioctl(); err != syscall.EINTR {
+			return err
+		}
+	}
+}
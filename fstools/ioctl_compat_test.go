@@ -0,0 +1,38 @@
+package fstools
+
+import (
+	"syscall"
+	"testing"
+)
+
+func TestRetryEINTR(t *testing.T) {
+	tests := []struct {
+		name      string
+		results   []error
+		wantErr   error
+		wantCalls int
+	}{
+		{"success", []error{nil}, nil, 1},
+		{"interrupted then success", []error{syscall.EINTR, syscall.EINTR, nil}, nil, 3},
+		{"interrupted then failure", []error{syscall.EINTR, syscall.EINVAL}, syscall.EINVAL, 2},
+		{"failure is not retried", []error{syscall.EAGAIN, nil}, syscall.EAGAIN, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls int
+			err := retryEINTR(func() error {
+				if calls == len(tt.results) {
+					t.Fatal("retried past the last result")
+				}
+				calls++
+				return tt.results[calls-1]
+			})
+			if err != tt.wantErr {
+				t.Errorf("got error %v, want %v", err, tt.wantErr)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("got %d calls, want %d", calls, tt.wantCalls)
+			}
+		})
+	}
+}
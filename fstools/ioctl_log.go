@@ -0,0 +1,155 @@
+package fstools
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// IoctlLogger records every FIEMAP, FIDEDUPERANGE, and FICLONERANGE ioctl
+// issued by this package as one JSON object per line, including the inputs
+// and outputs of each call. This is useful for diagnosing filesystem
+// specific behavior.
+type IoctlLogger struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// NewIoctlLogger returns a logger that writes JSON lines to w.
+func NewIoctlLogger(w io.Writer) *IoctlLogger {
+	return &IoctlLogger{enc: json.NewEncoder(w)}
+}
+
+var ioctlLogger *IoctlLogger
+
+// SetIoctlLogger sets the logger used for all subsequent ioctls.
+// A nil logger disables logging, which is the default.
+func SetIoctlLogger(l *IoctlLogger) {
+	ioctlLogger = l
+}
+
+type ioctlLogEntry struct {
+	Time   time.Time       `json:"time"`
+	Ioctl  string          `json:"ioctl"`
+	Fd     int             `json:"fd"`
+	Path   string          `json:"path,omitempty"`
+	Error  string          `json:"error,omitempty"`
+	Fiemap *fiemapLogEntry `json:"fiemap,omitempty"`
+	Dedupe *dedupeLogEntry `json:"dedupe,omitempty"`
+	Clone  *cloneLogEntry  `json:"clone,omitempty"`
+}
+
+type fiemapLogEntry struct {
+	Start         uint64 `json:"start"`
+	Length        uint64 `json:"length"`
+	Flags         uint32 `json:"flags"`
+	ExtentCount   int    `json:"extent_count"`
+	OutFlags      uint32 `json:"out_flags"`
+	MappedExtents uint32 `json:"mapped_extents"`
+}
+
+type dedupeLogEntry struct {
+	SrcOffset uint64                 `json:"src_offset"`
+	SrcLength uint64                 `json:"src_length"`
+	Targets   []dedupeTargetLogEntry `json:"targets"`
+}
+
+type dedupeTargetLogEntry struct {
+	DestFd       int64  `json:"dest_fd"`
+	DestPath     string `json:"dest_path,omitempty"`
+	DestOffset   uint64 `json:"dest_offset"`
+	Status       int32  `json:"status"`
+	BytesDeduped uint64 `json:"bytes_deduped"`
+}
+
+type cloneLogEntry struct {
+	SrcFd      int64  `json:"src_fd"`
+	SrcPath    string `json:"src_path,omitempty"`
+	SrcOffset  uint64 `json:"src_offset"`
+	SrcLength  uint64 `json:"src_length"`
+	DestOffset uint64 `json:"dest_offset"`
+}
+
+func fdPath(fd int64) string {
+	path, _ := os.Readlink("/proc/self/fd/" + strconv.FormatInt(fd, 10))
+	return path
+}
+
+func (l *IoctlLogger) log(entry *ioctlLogEntry, err error) {
+	entry.Time = time.Now()
+	entry.Path = fdPath(int64(entry.Fd))
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.enc.Encode(entry)
+}
+
+func (l *IoctlLogger) logFiemap(fd int, in Fiemap, out *Fiemap, err error) {
+	l.log(&ioctlLogEntry{
+		Ioctl: "FIEMAP",
+		Fd:    fd,
+		Fiemap: &fiemapLogEntry{
+			Start:         in.Start,
+			Length:        in.Length,
+			Flags:         in.Flags,
+			ExtentCount:   len(in.Extents),
+			OutFlags:      out.Flags,
+			MappedExtents: out.Mapped_extents,
+		},
+	}, err)
+}
+
+func (l *IoctlLogger) logDedupe(srcFd int, value *unix.FileDedupeRange, err error) {
+	dedupe := &dedupeLogEntry{
+		SrcOffset: value.Src_offset,
+		SrcLength: value.Src_length,
+	}
+	for _, info := range value.Info {
+		dedupe.Targets = append(dedupe.Targets, dedupeTargetLogEntry{
+			DestFd:       info.Dest_fd,
+			DestPath:     fdPath(info.Dest_fd),
+			DestOffset:   info.Dest_offset,
+			Status:       info.Status,
+			BytesDeduped: info.Bytes_deduped,
+		})
+	}
+	l.log(&ioctlLogEntry{
+		Ioctl:  "FIDEDUPERANGE",
+		Fd:     srcFd,
+		Dedupe: dedupe,
+	}, err)
+}
+
+// ioctlFileDedupeRange issues FIDEDUPERANGE, logging the call if an
+// IoctlLogger is set. It is retried on EINTR, since deduping a range that
+// is already deduped has no effect.
+func ioctlFileDedupeRange(srcFd int, value *unix.FileDedupeRange) error {
+	err := retryEINTR(func() error {
+		return unix.IoctlFileDedupeRange(srcFd, value)
+	})
+	if l := ioctlLogger; l != nil {
+		l.logDedupe(srcFd, value, err)
+	}
+	return err
+}
+
+func (l *IoctlLogger) logClone(destFd int, value *unix.FileCloneRange, err error) {
+	l.log(&ioctlLogEntry{
+		Ioctl: "FICLONERANGE",
+		Fd:    destFd,
+		Clone: &cloneLogEntry{
+			SrcFd:      value.Src_fd,
+			SrcPath:    fdPath(value.Src_fd),
+			SrcOffset:  value.Src_offset,
+			SrcLength:  value.Src_length,
+			DestOffset: value.Dest_offset,
+		},
+	}, err)
+}
@@ -0,0 +1,73 @@
+package fstools
+
+import (
+	"bytes"
+	"os"
+	"sort"
+)
+
+// matchScanBufferSize is the amount of data read from each file at once while
+// scanning for matching blocks.
+const matchScanBufferSize = 1024 * 1024
+
+// MatchingRanges compares the blocks of a and b at the same offsets and
+// returns the contiguous ranges whose contents are identical, in offset
+// order. Ranges are block aligned, except that a trailing partial block is
+// included when both files end with it, since dedupe allows a range to run
+// to the end of the files.
+func MatchingRanges(a, b *os.File, blockSize uint64) ([]Range, error) {
+	aInfo, err := a.Stat()
+	if err != nil {
+		return nil, err
+	}
+	bInfo, err := b.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := uint64(min(aInfo.Size(), bInfo.Size()))
+	if aInfo.Size() != bInfo.Size() {
+		size = AlignDown(size, blockSize)
+	}
+
+	bufSize := AlignDown(matchScanBufferSize, blockSize)
+	if bufSize == 0 {
+		bufSize = blockSize
+	}
+	aBuf := make([]byte, bufSize)
+	bBuf := make([]byte, bufSize)
+
+	var ranges []Range
+	addMatch := func(offset, length uint64) {
+		if n := len(ranges); n > 0 && ranges[n-1].End() == offset {
+			ranges[n-1].Length += length
+			return
+		}
+		ranges = append(ranges, Range{Offset: offset, Length: length})
+	}
+
+	for pos := uint64(0); pos < size; {
+		n := min(bufSize, size-pos)
+		if _, err := a.ReadAt(aBuf[:n], int64(pos)); err != nil {
+			return nil, err
+		}
+		if _, err := b.ReadAt(bBuf[:n], int64(pos)); err != nil {
+			return nil, err
+		}
+		for off := uint64(0); off < n; off += blockSize {
+			end := min(off+blockSize, n)
+			if bytes.Equal(aBuf[off:end], bBuf[off:end]) {
+				addMatch(pos+off, end-off)
+			}
+		}
+		pos += n
+	}
+	return ranges, nil
+}
+
+// SortRangesBySize sorts ranges from longest to shortest, keeping ranges of
+// the same length in offset order.
+func SortRangesBySize(ranges []Range) {
+	sort.SliceStable(ranges, func(i, j int) bool {
+		return ranges[i].Length > ranges[j].Length
+	})
+}
@@ -0,0 +1,108 @@
+package fstools
+
+import (
+	"bytes"
+	"errors"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// ProbeStatus classifies the outcome of probing an ioctl.
+type ProbeStatus string
+
+const (
+	ProbeSupported   ProbeStatus = "supported"
+	ProbeUnsupported ProbeStatus = "unsupported"
+	ProbeError       ProbeStatus = "error"
+)
+
+// Capability is the result of probing a single ioctl.
+type Capability struct {
+	Name   string      `json:"name"`
+	Status ProbeStatus `json:"status"`
+	Error  string      `json:"error,omitempty"`
+}
+
+// ClassifyProbeError maps the error returned by an ioctl to a ProbeStatus.
+// EOPNOTSUPP, ENOTTY, and EXDEV indicate that the filesystem or kernel
+// doesn't implement the ioctl.
+func ClassifyProbeError(err error) ProbeStatus {
+	switch {
+	case err == nil:
+		return ProbeSupported
+	case errors.Is(err, unix.EOPNOTSUPP),
+		errors.Is(err, unix.ENOTTY),
+		errors.Is(err, unix.EXDEV):
+		return ProbeUnsupported
+	default:
+		return ProbeError
+	}
+}
+
+func newCapability(name string, err error) Capability {
+	c := Capability{Name: name, Status: ClassifyProbeError(err)}
+	if err != nil {
+		c.Error = err.Error()
+	}
+	return c
+}
+
+// ProbeCapabilities creates temporary files in dir and tries each of the
+// FIEMAP, FIDEDUPERANGE, FICLONERANGE, and BTRFS_IOC_DEFRAG ioctls against
+// them, reporting which are available on the filesystem containing dir.
+// The temporary files are removed before returning.
+func ProbeCapabilities(dir string) ([]Capability, error) {
+	src, err := os.CreateTemp(dir, ".btrfs-optimize-probe-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(src.Name())
+	defer src.Close()
+	dst, err := os.CreateTemp(dir, ".btrfs-optimize-probe-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(dst.Name())
+	defer dst.Close()
+
+	blkSize, err := FileBlockSize(src)
+	if err != nil {
+		return nil, err
+	}
+	data := bytes.Repeat([]byte{0xA5}, int(blkSize))
+	for _, f := range []*os.File{src, dst} {
+		if _, err := f.Write(data); err != nil {
+			return nil, err
+		}
+		if err := f.Sync(); err != nil {
+			return nil, err
+		}
+	}
+
+	var caps []Capability
+
+	_, err = CollectExtents(src, 0)
+	caps = append(caps, newCapability("FIEMAP", err))
+
+	value := &unix.FileDedupeRange{
+		Src_length: blkSize,
+		Info:       []unix.FileDedupeRangeInfo{{Dest_fd: int64(dst.Fd())}},
+	}
+	err = unix.IoctlFileDedupeRange(int(src.Fd()), value)
+	if err == nil && value.Info[0].Status < 0 {
+		err = unix.Errno(-value.Info[0].Status)
+	}
+	caps = append(caps, newCapability("FIDEDUPERANGE", err))
+
+	err = unix.IoctlFileCloneRange(int(dst.Fd()), &unix.FileCloneRange{
+		Src_fd:     int64(src.Fd()),
+		Src_length: blkSize,
+	})
+	caps = append(caps, newCapability("FICLONERANGE", err))
+
+	err = BtrfsDefrag(int(dst.Fd()))
+	caps = append(caps, newCapability("BTRFS_IOC_DEFRAG", err))
+
+	return caps, nil
+}
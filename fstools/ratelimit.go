@@ -0,0 +1,45 @@
+package fstools
+
+import (
+	"time"
+)
+
+// rateLimiter is a token bucket that limits the average number of bytes
+// processed per second.
+//
+// Bytes are accounted after they have been processed, so the caller may go
+// into debt and Wait will sleep until the debt has been repaid.
+type rateLimiter struct {
+	rate   float64 // bytes per second
+	burst  float64 // maximum number of tokens that can accumulate
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(bytesPerSecond, burst uint64) *rateLimiter {
+	return &rateLimiter{
+		rate:   float64(bytesPerSecond),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// Wait accounts for n processed bytes and sleeps long enough to keep the
+// average rate under the limit.
+func (r *rateLimiter) Wait(n uint64) {
+	now := time.Now()
+	r.tokens += now.Sub(r.last).Seconds() * r.rate
+	if r.tokens > r.burst {
+		r.tokens = r.burst
+	}
+	r.last = now
+
+	r.tokens -= float64(n)
+	if r.tokens < 0 {
+		delay := time.Duration(-r.tokens / r.rate * float64(time.Second))
+		time.Sleep(delay)
+		r.tokens = 0
+		r.last = time.Now()
+	}
+}
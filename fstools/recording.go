@@ -0,0 +1,118 @@
+package fstools
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+)
+
+// RecordingVersion is the version of the format written by WriteRecording.
+const RecordingVersion = 1
+
+// Recording holds the unprocessed FIEMAP results of a set of files, along
+// with the file metadata needed to render reports from them later, without
+// access to the files.
+type Recording struct {
+	Version int                 `json:"version"`
+	Files   []RecordedExtentMap `json:"files"`
+}
+
+// RecordedExtentMap is the recorded extent map of a single file.
+type RecordedExtentMap struct {
+	Path      string `json:"path"`
+	Size      uint64 `json:"size"`
+	BlockSize uint64 `json:"block_size"`
+	// RequestFlags are the FIEMAP_FLAG_* flags the extents were mapped
+	// with.
+	RequestFlags uint32         `json:"request_flags"`
+	Extents      []FiemapExtent `json:"extents"`
+}
+
+// RecordExtentMap walks all extents of file and records them. The path is
+// only recorded.
+//
+// The flags value is passed directly to FiemapWalk.
+func RecordExtentMap(file *os.File, path string, flags uint32) (*RecordedExtentMap, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if err := CheckFiemapMode(info.Mode()); err != nil {
+		return nil, err
+	}
+	extents, err := CollectExtents(file, flags)
+	if err != nil {
+		return nil, err
+	}
+	if extents == nil {
+		extents = []FiemapExtent{}
+	}
+	return &RecordedExtentMap{
+		Path:         path,
+		Size:         uint64(info.Size()),
+		BlockSize:    uint64(info.Sys().(*syscall.Stat_t).Blksize),
+		RequestFlags: flags,
+		Extents:      extents,
+	}, nil
+}
+
+// WriteRecording encodes the recorded files to w as JSON.
+func WriteRecording(w io.Writer, files []RecordedExtentMap) error {
+	if files == nil {
+		files = []RecordedExtentMap{}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(Recording{Version: RecordingVersion, Files: files})
+}
+
+// ReadRecording decodes a recording written by WriteRecording, rejecting
+// versions of the format that it doesn't understand.
+func ReadRecording(r io.Reader) (*Recording, error) {
+	var rec Recording
+	if err := json.NewDecoder(r).Decode(&rec); err != nil {
+		return nil, fmt.Errorf("failed to decode recording: %v", err)
+	}
+	if rec.Version != RecordingVersion {
+		return nil, fmt.Errorf("unsupported recording version %d, expected %d", rec.Version, RecordingVersion)
+	}
+	return &rec, nil
+}
+
+// Dump prints the recorded extents in the same format as
+// FileFragDumpExtentsWindow, without touching the filesystem.
+func (m *RecordedExtentMap) Dump(out io.Writer, head, tail int, useBytes, faster bool) error {
+	fmt.Fprintln(out, "File:", m.Path)
+	return dumpExtentTable(
+		out,
+		m.Size,
+		m.BlockSize,
+		head,
+		tail,
+		useBytes,
+		faster,
+		func() (int, error) {
+			return len(m.Extents), nil
+		},
+		func(callback FiemapWalkCallback) error {
+			for i := range m.Extents {
+				extent := m.Extents[i]
+				if callback(i, &extent) {
+					break
+				}
+			}
+			return nil
+		},
+	)
+}
+
+// Summarize returns the summary of the recorded extents, like SummarizeFile.
+func (m *RecordedExtentMap) Summarize() ExtentSummary {
+	s := newExtentSummarizer(m.Size)
+	for i := range m.Extents {
+		s.add(&m.Extents[i])
+	}
+	return s.summary
+}
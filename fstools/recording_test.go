@@ -0,0 +1,104 @@
+package fstools
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "Rewrite the golden files in testdata")
+
+// readFixture reads the recording in testdata/recording.json.
+func readFixture(t *testing.T) *Recording {
+	t.Helper()
+	f, err := os.Open(filepath.Join("testdata", "recording.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	rec, err := ReadRecording(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rec
+}
+
+// checkGolden compares got to testdata/name, or rewrites it with -update.
+func checkGolden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *update {
+		if err := os.WriteFile(path, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("output differs from %s:\n%s\nwant:\n%s", path, got, want)
+	}
+}
+
+func TestRecordingReplay(t *testing.T) {
+	rec := readFixture(t)
+	tests := []struct {
+		name       string
+		head, tail int
+		useBytes   bool
+		faster     bool
+	}{
+		{name: "blocks"},
+		{name: "bytes", useBytes: true},
+		{name: "head", head: 2},
+		{name: "tail", tail: 2},
+		{name: "faster", faster: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			for i := range rec.Files {
+				if err := rec.Files[i].Dump(&out, tt.head, tt.tail, tt.useBytes, tt.faster); err != nil {
+					t.Fatal(err)
+				}
+			}
+			checkGolden(t, "replay_"+tt.name+".golden", out.Bytes())
+		})
+	}
+}
+
+func TestRecordingSummarize(t *testing.T) {
+	rec := readFixture(t)
+	var out bytes.Buffer
+	for i := range rec.Files {
+		fmt.Fprintf(&out, "%s: %+v\n", rec.Files[i].Path, rec.Files[i].Summarize())
+	}
+	checkGolden(t, "replay_summary.golden", out.Bytes())
+}
+
+func TestRecordingRoundTrip(t *testing.T) {
+	rec := readFixture(t)
+	var buf bytes.Buffer
+	if err := WriteRecording(&buf, rec.Files); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadRecording(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, rec) {
+		t.Errorf("got %+v, want %+v", got, rec)
+	}
+}
+
+func TestReadRecordingVersion(t *testing.T) {
+	if _, err := ReadRecording(bytes.NewReader([]byte(`{"version": 2, "files": []}`))); err == nil {
+		t.Error("got no error for an unknown version")
+	}
+}
@@ -0,0 +1,179 @@
+package fstools
+
+import (
+	"os"
+	"slices"
+)
+
+// ExtentReport is a structured description of the extents that back a file,
+// suitable for encoding as JSON.
+type ExtentReport struct {
+	Path      string         `json:"path"`
+	Size      uint64         `json:"size"`
+	BlockSize uint64         `json:"block_size"`
+	Extents   []ExtentRecord `json:"extents"`
+}
+
+// ExtentRecord describes a single extent, with all values in bytes.
+type ExtentRecord struct {
+	Logical  uint64   `json:"logical"`
+	Physical uint64   `json:"physical"`
+	Length   uint64   `json:"length"`
+	Flags    []string `json:"flags"`
+}
+
+// Shared reports whether the extent was flagged as shared.
+func (e ExtentRecord) Shared() bool {
+	return slices.Contains(e.Flags, "shared")
+}
+
+// NewExtentRecord converts a FiemapExtent into an ExtentRecord.
+func NewExtentRecord(extent *FiemapExtent) ExtentRecord {
+	flags := FiemapExtentFlagsToStrings(extent.Flags)
+	if flags == nil {
+		flags = []string{}
+	}
+	return ExtentRecord{
+		Logical:  extent.Logical,
+		Physical: extent.Physical,
+		Length:   extent.Length,
+		Flags:    flags,
+	}
+}
+
+// NewExtentReport walks all extents of file and returns the report for it.
+// The path is only recorded in the report.
+//
+// The flags value is passed directly to FiemapWalk.
+func NewExtentReport(file *os.File, path string, flags uint32) (*ExtentReport, error) {
+	return NewExtentReportWindow(file, path, 0, FIEMAP_MAX_OFFSET, 0, 0, flags)
+}
+
+// NewExtentReportWindow is like NewExtentReport, but only includes the
+// extents that overlap the logical range [start, start+length), given in
+// bytes, and of those only the first head or the last tail extents, when
+// they are not zero. It selects the same extents as FileFragDumpExtentsWindow.
+func NewExtentReportWindow(file *os.File, path string, start, length uint64, head, tail int, flags uint32) (*ExtentReport, error) {
+	window, err := newExtentWindow(file, start, length, flags)
+	if err != nil {
+		return nil, err
+	}
+
+	sel, err := newExtentSelection(head, tail, window.count)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &ExtentReport{
+		Path:      path,
+		Size:      window.size,
+		BlockSize: window.blkSize,
+		Extents:   []ExtentRecord{},
+	}
+	err = sel.walk(window.walk, func(index int, extent *FiemapExtent) {
+		report.Extents = append(report.Extents, NewExtentRecord(extent))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// ReportDelta summarizes how the extents of a file changed between two
+// reports.
+type ReportDelta struct {
+	ExtentsBefore int
+	ExtentsAfter  int
+	SizeBefore    uint64
+	SizeAfter     uint64
+
+	// Unchanged extents have the same logical start, physical start, and
+	// length in both reports.
+	Unchanged int
+	// New extents only exist in the later report, and Removed extents
+	// only exist in the earlier report.
+	New     []ExtentRecord
+	Removed []ExtentRecord
+	// Split counts earlier extents that are now covered by more than one
+	// extent, and Merged counts later extents that cover more than one
+	// earlier extent.
+	Split  int
+	Merged int
+
+	// SharedGainedBytes are logical bytes that were not flagged as shared
+	// before, but are now, and SharedLostBytes are the reverse.
+	SharedGainedBytes uint64
+	SharedLostBytes   uint64
+}
+
+type extentKey struct {
+	logical, physical, length uint64
+}
+
+func overlapCount(e ExtentRecord, others []ExtentRecord) int {
+	var n int
+	for _, o := range others {
+		if o.Logical < e.Logical+e.Length && e.Logical < o.Logical+o.Length {
+			n++
+		}
+	}
+	return n
+}
+
+// DiffReports compares the extents of the same file at two points in time.
+func DiffReports(before, after *ExtentReport) ReportDelta {
+	d := ReportDelta{
+		ExtentsBefore: len(before.Extents),
+		ExtentsAfter:  len(after.Extents),
+		SizeBefore:    before.Size,
+		SizeAfter:     after.Size,
+	}
+
+	beforeKeys := make(map[extentKey]bool, len(before.Extents))
+	for _, e := range before.Extents {
+		beforeKeys[extentKey{e.Logical, e.Physical, e.Length}] = true
+	}
+	afterKeys := make(map[extentKey]bool, len(after.Extents))
+	for _, e := range after.Extents {
+		key := extentKey{e.Logical, e.Physical, e.Length}
+		afterKeys[key] = true
+		if beforeKeys[key] {
+			d.Unchanged++
+		} else {
+			d.New = append(d.New, e)
+			if overlapCount(e, before.Extents) > 1 {
+				d.Merged++
+			}
+		}
+	}
+	for _, e := range before.Extents {
+		if !afterKeys[extentKey{e.Logical, e.Physical, e.Length}] {
+			d.Removed = append(d.Removed, e)
+			if overlapCount(e, after.Extents) > 1 {
+				d.Split++
+			}
+		}
+	}
+
+	// Compare the shared flag over every logical range mapped in both.
+	i, j := 0, 0
+	for i < len(before.Extents) && j < len(after.Extents) {
+		eb, ea := before.Extents[i], after.Extents[j]
+		lo := max(eb.Logical, ea.Logical)
+		hi := min(eb.Logical+eb.Length, ea.Logical+ea.Length)
+		if lo < hi {
+			switch {
+			case !eb.Shared() && ea.Shared():
+				d.SharedGainedBytes += hi - lo
+			case eb.Shared() && !ea.Shared():
+				d.SharedLostBytes += hi - lo
+			}
+		}
+		if eb.Logical+eb.Length <= ea.Logical+ea.Length {
+			i++
+		} else {
+			j++
+		}
+	}
+	return d
+}
@@ -0,0 +1,213 @@
+package fstools
+
+import (
+	"os"
+	"sort"
+)
+
+// SharingReport classifies the bytes of two files by whether they are backed
+// by the same physical storage.
+type SharingReport struct {
+	// SharedBytes are backed by the same physical offsets and flagged with
+	// FIEMAP_EXTENT_SHARED in both files.
+	SharedBytes uint64
+	// PhysicalOnlyBytes are backed by the same physical offsets, but at
+	// least one of the files is missing the FIEMAP_EXTENT_SHARED flag.
+	// Some filesystems don't set the flag reliably, so these are still
+	// considered shared.
+	PhysicalOnlyBytes uint64
+	// FlagOnlyBytes are flagged as shared in both files, but are backed by
+	// different physical offsets, so they are shared with other files and
+	// not with each other.
+	FlagOnlyBytes uint64
+	// UnsharedBytes are mapped in both files at different physical offsets.
+	UnsharedBytes uint64
+	// UnmatchedBytes are only mapped in one of the files, or are in the
+	// other file's hole.
+	UnmatchedBytes uint64
+}
+
+// TotalShared returns the number of bytes that are physically shared,
+// regardless of FIEMAP_EXTENT_SHARED.
+func (r SharingReport) TotalShared() uint64 {
+	return r.SharedBytes + r.PhysicalOnlyBytes
+}
+
+// extentHasLocation reports whether the extent's physical offset is
+// meaningful for comparison.
+func extentHasLocation(e *FiemapExtent) bool {
+	return e.Flags&(FIEMAP_EXTENT_UNKNOWN|FIEMAP_EXTENT_DATA_INLINE) == 0
+}
+
+// CompareSharing compares the extents of two files, both sorted by logical
+// offset, over each logical range mapped in both files.
+// Ranges are considered shared when they map to the same physical offset,
+// which works even when FIEMAP_EXTENT_SHARED isn't set by the filesystem.
+func CompareSharing(a, b []FiemapExtent) SharingReport {
+	var r SharingReport
+	for _, d := range DiffExtents(a, b) {
+		bothFlagged := d.AFlags&FIEMAP_EXTENT_SHARED != 0 && d.BFlags&FIEMAP_EXTENT_SHARED != 0
+		switch {
+		case d.Kind == RangeOnlyA || d.Kind == RangeOnlyB:
+			r.UnmatchedBytes += d.Length
+		case d.Kind == RangeShared && bothFlagged:
+			r.SharedBytes += d.Length
+		case d.Kind == RangeShared:
+			r.PhysicalOnlyBytes += d.Length
+		case bothFlagged:
+			r.FlagOnlyBytes += d.Length
+		default:
+			r.UnsharedBytes += d.Length
+		}
+	}
+	return r
+}
+
+// AlreadyShared reports whether every mapped byte of a and b is backed by the
+// same physical storage at the same logical offset, in which case deduping
+// the files against each other would have no effect.
+func AlreadyShared(a, b []FiemapExtent) bool {
+	r := CompareSharing(a, b)
+	return r.TotalShared() > 0 &&
+		r.FlagOnlyBytes == 0 &&
+		r.UnsharedBytes == 0 &&
+		r.UnmatchedBytes == 0
+}
+
+// clipExtents returns the parts of extents that fall within
+// [offset, offset+length), with logical offsets made relative to offset.
+// Physical offsets are moved along with the logical start of each clipped
+// extent, so the result can be compared with CompareSharing.
+func clipExtents(extents []FiemapExtent, offset, length uint64) []FiemapExtent {
+	end := offset + length
+	var clipped []FiemapExtent
+	for _, e := range extents {
+		lo := max(e.Logical, offset)
+		hi := min(e.Logical+e.Length, end)
+		if lo >= hi {
+			continue
+		}
+		c := e
+		c.Logical = lo - offset
+		c.Length = hi - lo
+		if extentHasLocation(&e) {
+			c.Physical = e.Physical + (lo - e.Logical)
+		}
+		clipped = append(clipped, c)
+	}
+	return clipped
+}
+
+// AlreadySharedRange is like AlreadyShared, but only compares length bytes
+// of a starting at aOffset with the same number of bytes of b starting at
+// bOffset. This is the check needed before cloning a range of one file into
+// another, which would otherwise redundantly relink it.
+func AlreadySharedRange(a []FiemapExtent, aOffset uint64, b []FiemapExtent, bOffset, length uint64) bool {
+	return AlreadyShared(clipExtents(a, aOffset, length), clipExtents(b, bOffset, length))
+}
+
+// RangeHasExtentFlags reports whether any of extents that overlaps
+// [offset, offset+length) has any of flags set, like FIEMAP_EXTENT_ENCODED
+// for compressed data.
+func RangeHasExtentFlags(extents []FiemapExtent, offset, length uint64, flags uint32) bool {
+	for _, e := range clipExtents(extents, offset, length) {
+		if e.Flags&flags != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// SharedLink is a range of one file that is backed by the same physical
+// storage as a range of another file, possibly at a different logical
+// offset.
+type SharedLink struct {
+	AOffset uint64
+	BOffset uint64
+	Length  uint64
+}
+
+// SharedLinks finds the ranges of a that are backed by the same physical
+// storage as ranges of b, considering only extents flagged with
+// FIEMAP_EXTENT_SHARED in both files. The links are ordered by AOffset.
+// Unlike CompareSharing, the logical offsets don't need to match, so this
+// also finds data that was deduped or cloned to a different offset.
+func SharedLinks(a, b []FiemapExtent) []SharedLink {
+	var links []SharedLink
+	for i := range a {
+		ae := &a[i]
+		if ae.Flags&FIEMAP_EXTENT_SHARED == 0 || !extentHasLocation(ae) {
+			continue
+		}
+		for j := range b {
+			be := &b[j]
+			if be.Flags&FIEMAP_EXTENT_SHARED == 0 || !extentHasLocation(be) {
+				continue
+			}
+			lo := max(ae.Physical, be.Physical)
+			hi := min(ae.Physical+ae.Length, be.Physical+be.Length)
+			if lo >= hi {
+				continue
+			}
+			links = append(links, SharedLink{
+				AOffset: ae.Logical + (lo - ae.Physical),
+				BOffset: be.Logical + (lo - be.Physical),
+				Length:  hi - lo,
+			})
+		}
+	}
+	sort.Slice(links, func(i, j int) bool {
+		return links[i].AOffset < links[j].AOffset
+	})
+	return links
+}
+
+// FilesShareAllExtents reports whether a and b have the same size and every
+// mapped logical range of either file is backed by the same physical
+// extent in both, so they are already identical in storage, like after a
+// reflink copy or a complete dedupe. Files without any data extents are
+// not considered shared.
+func FilesShareAllExtents(a, b *os.File) (bool, error) {
+	aInfo, err := a.Stat()
+	if err != nil {
+		return false, err
+	}
+	bInfo, err := b.Stat()
+	if err != nil {
+		return false, err
+	}
+	if aInfo.Size() != bInfo.Size() {
+		return false, nil
+	}
+	aExtents, err := CollectExtents(a, 0)
+	if err != nil {
+		return false, err
+	}
+	bExtents, err := CollectExtents(b, 0)
+	if err != nil {
+		return false, err
+	}
+	return AlreadyShared(aExtents, bExtents), nil
+}
+
+// CountSharedExtents returns the number of extents of a that are, at least
+// in part, backed by the same physical storage at the same logical offset
+// in b.
+func CountSharedExtents(a, b []FiemapExtent) int {
+	var shared []RangeDiff
+	for _, d := range DiffExtents(a, b) {
+		if d.Kind == RangeShared {
+			shared = append(shared, d)
+		}
+	}
+	var n int
+	for _, e := range a {
+		for _, d := range shared {
+			if d.Logical < e.Logical+e.Length && e.Logical < d.Logical+d.Length {
+				n++
+				break
+			}
+		}
+	}
+	return n
+}
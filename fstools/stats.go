@@ -0,0 +1,118 @@
+package fstools
+
+import (
+	"os"
+)
+
+// Stats is a quick fragmentation summary of a single file.
+type Stats struct {
+	Extents       int    // number of extents
+	MappedBytes   uint64 // sum of all extent lengths
+	SharedExtents int    // number of extents with FIEMAP_EXTENT_SHARED
+	// Holes is the number of gaps in the file's logical range that no
+	// extent maps, including a gap before the first extent and after the
+	// last one, so any hole means the file is sparse.
+	Holes int
+	// LargestExtent and SmallestExtent are the longest and shortest extent
+	// lengths, which are zero if there are no extents.
+	LargestExtent  uint64
+	SmallestExtent uint64
+}
+
+// FiemapStats walks all extents of file and returns their statistics.
+//
+// The flags value is passed directly to FiemapWalk.
+func FiemapStats(file *os.File, flags uint32) (Stats, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return Stats{}, err
+	}
+
+	var s Stats
+	var end uint64 // logical end of the previous extent
+	err = FiemapWalk(file, flags, func(index int, extent *FiemapExtent) bool {
+		if extent.Logical > end {
+			s.Holes++
+		}
+		end = max(end, extent.Logical+extent.Length)
+
+		s.Extents++
+		s.MappedBytes += extent.Length
+		if extent.Flags&FIEMAP_EXTENT_SHARED != 0 {
+			s.SharedExtents++
+		}
+		s.LargestExtent = max(s.LargestExtent, extent.Length)
+		if s.Extents == 1 || extent.Length < s.SmallestExtent {
+			s.SmallestExtent = extent.Length
+		}
+		return false
+	})
+	if err != nil {
+		return Stats{}, err
+	}
+	if end < uint64(info.Size()) {
+		s.Holes++
+	}
+	return s, nil
+}
+
+// SharedExclusiveBytes walks all extents of file and sums the lengths of the
+// extents flagged with FIEMAP_EXTENT_SHARED, and of those that aren't.
+// Like "btrfs filesystem du", it doesn't tell which files the shared bytes
+// are shared with, and FIEMAP only approximates sharing, since the flag is
+// set when any part of an extent is referenced elsewhere.
+func SharedExclusiveBytes(file *os.File) (shared, exclusive uint64, err error) {
+	err = FiemapWalk(file, 0, func(index int, extent *FiemapExtent) bool {
+		if extent.Flags&FIEMAP_EXTENT_SHARED != 0 {
+			shared += extent.Length
+		} else {
+			exclusive += extent.Length
+		}
+		return false
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return shared, exclusive, nil
+}
+
+// CompressionStats counts the extents of a file that are encoded, which on
+// btrfs means compressed, and those that aren't. The byte counts are the
+// logical lengths reported by FIEMAP, which for encoded extents is the
+// uncompressed length, not the space used on disk.
+type CompressionStats struct {
+	EncodedExtents int
+	EncodedBytes   uint64
+	PlainExtents   int
+	PlainBytes     uint64
+}
+
+// Add adds the counts of o to s.
+func (s *CompressionStats) Add(o CompressionStats) {
+	s.EncodedExtents += o.EncodedExtents
+	s.EncodedBytes += o.EncodedBytes
+	s.PlainExtents += o.PlainExtents
+	s.PlainBytes += o.PlainBytes
+}
+
+// FiemapCompressionStats walks all extents of file and counts those flagged
+// with FIEMAP_EXTENT_ENCODED, and those that aren't.
+//
+// The flags value is passed directly to FiemapWalk.
+func FiemapCompressionStats(file *os.File, flags uint32) (CompressionStats, error) {
+	var s CompressionStats
+	err := FiemapWalk(file, flags, func(index int, extent *FiemapExtent) bool {
+		if extent.Flags&FIEMAP_EXTENT_ENCODED != 0 {
+			s.EncodedExtents++
+			s.EncodedBytes += extent.Length
+		} else {
+			s.PlainExtents++
+			s.PlainBytes += extent.Length
+		}
+		return false
+	})
+	if err != nil {
+		return CompressionStats{}, err
+	}
+	return s, nil
+}
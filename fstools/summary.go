@@ -0,0 +1,108 @@
+package fstools
+
+import (
+	"os"
+)
+
+// ExtentSummary aggregates the extents that back a file.
+type ExtentSummary struct {
+	Files         int    // number of files summarized
+	Size          uint64 // file size in bytes
+	Extents       int    // number of extents
+	MappedBytes   uint64 // sum of all extent lengths
+	SharedExtents int    // number of extents with FIEMAP_EXTENT_SHARED
+	SharedBytes   uint64 // sum of shared extent lengths
+	// MergeableExtents is the number of adjacent extent pairs that continue
+	// each other both logically and physically, so they could have been a
+	// single extent.
+	MergeableExtents int
+	// XattrExtents and XattrBytes describe the extents that store the
+	// file's extended attributes, which are only collected by
+	// AddXattrExtents.
+	XattrExtents int
+	XattrBytes   uint64
+}
+
+// Add accumulates other into s, which is used to total multiple files.
+func (s *ExtentSummary) Add(other ExtentSummary) {
+	s.Files += other.Files
+	s.Size += other.Size
+	s.Extents += other.Extents
+	s.MappedBytes += other.MappedBytes
+	s.SharedExtents += other.SharedExtents
+	s.SharedBytes += other.SharedBytes
+	s.MergeableExtents += other.MergeableExtents
+	s.XattrExtents += other.XattrExtents
+	s.XattrBytes += other.XattrBytes
+}
+
+// AddXattrExtents walks the extents of file's extended attributes, by
+// passing FIEMAP_FLAG_XATTR along with flags, and adds them to s.
+// Not all filesystems support this, btrfs returns EBADR.
+func (s *ExtentSummary) AddXattrExtents(file *os.File, flags uint32) error {
+	return FiemapWalk(file, flags|FIEMAP_FLAG_XATTR, func(index int, extent *FiemapExtent) bool {
+		s.XattrExtents++
+		s.XattrBytes += extent.Length
+		return false
+	})
+}
+
+// SummarizeFile walks all extents of file and returns their summary.
+//
+// The flags value is passed directly to FiemapWalk.
+func SummarizeFile(file *os.File, flags uint32) (ExtentSummary, error) {
+	return SummarizeFileProgress(file, flags, nil)
+}
+
+// SummarizeFileProgress is like SummarizeFile, but calls progress with the
+// number of extents summarized so far after each extent, if not nil.
+func SummarizeFileProgress(file *os.File, flags uint32, progress func(extents int)) (ExtentSummary, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return ExtentSummary{}, err
+	}
+
+	s := newExtentSummarizer(uint64(info.Size()))
+	err = FiemapWalk(file, flags, func(index int, extent *FiemapExtent) bool {
+		s.add(extent)
+		if progress != nil {
+			progress(s.summary.Extents)
+		}
+		return false
+	})
+	return s.summary, err
+}
+
+// extentSummarizer accumulates the summary of a file's extents, which must
+// be added in logical order.
+type extentSummarizer struct {
+	summary   ExtentSummary
+	prev      FiemapExtent
+	prevValid bool
+}
+
+func newExtentSummarizer(size uint64) *extentSummarizer {
+	return &extentSummarizer{
+		summary: ExtentSummary{
+			Files: 1,
+			Size:  size,
+		},
+	}
+}
+
+func (s *extentSummarizer) add(extent *FiemapExtent) {
+	s.summary.Extents++
+	s.summary.MappedBytes += extent.Length
+	if extent.Flags&FIEMAP_EXTENT_SHARED != 0 {
+		s.summary.SharedExtents++
+		s.summary.SharedBytes += extent.Length
+	}
+
+	located := extentHasLocation(extent)
+	if s.prevValid && located &&
+		s.prev.Logical+s.prev.Length == extent.Logical &&
+		s.prev.Physical+s.prev.Length == extent.Physical {
+		s.summary.MergeableExtents++
+	}
+	s.prev, s.prevValid = *extent, located
+}
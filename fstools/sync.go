@@ -0,0 +1,14 @@
+package fstools
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// Syncfs writes all dirty data of the filesystem containing file to disk.
+// This is usually faster than calling fsync on many files of the same
+// filesystem.
+func Syncfs(file *os.File) error {
+	return unix.Syncfs(int(file.Fd()))
+}
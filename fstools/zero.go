@@ -0,0 +1,144 @@
+package fstools
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// zeroScanBufferSize is the amount of data read at once while scanning for
+// zero filled blocks.
+const zeroScanBufferSize = 1024 * 1024
+
+// Range is a contiguous byte range of a file.
+type Range struct {
+	Offset uint64
+	Length uint64
+}
+
+// End returns the offset just past the end of the range.
+func (r Range) End() uint64 {
+	return r.Offset + r.Length
+}
+
+// DataEnd returns the logical offset just past the last extent of file that
+// holds data, ignoring trailing holes and unwritten (preallocated) extents.
+// It returns 0 if the file has no data extents.
+//
+// The flags value is passed directly to FiemapWalk.
+func DataEnd(file *os.File, flags uint32) (uint64, error) {
+	var end uint64
+	err := FiemapWalk(file, flags, func(index int, extent *FiemapExtent) bool {
+		if extent.Flags&FIEMAP_EXTENT_UNWRITTEN == 0 {
+			end = extent.Logical + extent.Length
+		}
+		return false
+	})
+	return end, err
+}
+
+// DataRanges returns the logical ranges of file that hold data, in order,
+// merging adjacent extents. Holes and unwritten (preallocated) extents,
+// which both read as zeros, are left out.
+//
+// The flags value is passed directly to FiemapWalk.
+func DataRanges(file *os.File, flags uint32) ([]Range, error) {
+	var ranges []Range
+	err := FiemapWalk(file, flags, func(index int, extent *FiemapExtent) bool {
+		if extent.Flags&FIEMAP_EXTENT_UNWRITTEN != 0 {
+			return false
+		}
+		if n := len(ranges); n > 0 && ranges[n-1].End() == extent.Logical {
+			ranges[n-1].Length += extent.Length
+			return false
+		}
+		ranges = append(ranges, Range{Offset: extent.Logical, Length: extent.Length})
+		return false
+	})
+	return ranges, err
+}
+
+// HasInlineData reports whether any extent of file is stored inline in the
+// filesystem metadata, which btrfs does for small files. Such files can't be
+// deduped.
+//
+// The flags value is passed directly to FiemapWalk.
+func HasInlineData(file *os.File, flags uint32) (bool, error) {
+	var inline bool
+	err := FiemapWalk(file, flags, func(index int, extent *FiemapExtent) bool {
+		inline = extent.Flags&FIEMAP_EXTENT_DATA_INLINE != 0
+		return inline
+	})
+	return inline, err
+}
+
+// ZeroRanges scans the data regions of file and returns the block aligned
+// ranges that contain only zeros. Existing holes are skipped, using
+// SEEK_DATA and SEEK_HOLE when the filesystem supports them.
+// A trailing partial block is never included.
+func ZeroRanges(file *os.File, blockSize uint64) ([]Range, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := AlignDown(uint64(info.Size()), blockSize)
+	fd := int(file.Fd())
+
+	bufSize := AlignDown(zeroScanBufferSize, blockSize)
+	if bufSize == 0 {
+		bufSize = blockSize
+	}
+	buf := make([]byte, bufSize)
+
+	var ranges []Range
+	addZeroBlock := func(offset uint64) {
+		if n := len(ranges); n > 0 && ranges[n-1].End() == offset {
+			ranges[n-1].Length += blockSize
+			return
+		}
+		ranges = append(ranges, Range{Offset: offset, Length: blockSize})
+	}
+
+	for offset := uint64(0); offset < size; {
+		dataStart, holeStart := offset, size
+		if off, err := unix.Seek(fd, int64(offset), unix.SEEK_DATA); err == unix.ENXIO {
+			break
+		} else if err == nil {
+			dataStart = AlignDown(uint64(off), blockSize)
+			if off, err := unix.Seek(fd, off, unix.SEEK_HOLE); err == nil {
+				holeStart = min(AlignUp(uint64(off), blockSize), size)
+			}
+		}
+
+		for pos := dataStart; pos < holeStart; {
+			n := min(bufSize, holeStart-pos)
+			if _, err := file.ReadAt(buf[:n], int64(pos)); err != nil {
+				return nil, err
+			}
+			for b := uint64(0); b < n; b += blockSize {
+				if isZero(buf[b : b+blockSize]) {
+					addZeroBlock(pos + b)
+				}
+			}
+			pos += n
+		}
+		offset = max(holeStart, offset+blockSize)
+	}
+	return ranges, nil
+}
+
+func isZero(b []byte) bool {
+	for _, v := range b {
+		if v != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// PunchHole deallocates the given range of the file, which will then read
+// back as zeros, without changing the file size.
+// The fd must be open for writing.
+func PunchHole(fd int, offset, length uint64) error {
+	return unix.Fallocate(fd, unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE, int64(offset), int64(length))
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/linux4life798/btrfs-optimize/fstools"
+	"github.com/linux4life798/btrfs-optimize/hashcache"
+	"github.com/schollz/progressbar/v3"
+	"github.com/spf13/cobra"
+)
+
+var hashcacheCmd = &cobra.Command{
+	Use:   "hashcache",
+	Short: "Manage the persistent file content hash cache",
+	Long: `Hashcache is a group of subcommands that manage a persistent cache of file
+content hashes, which lets repeated runs avoid rehashing unchanged files.`,
+}
+
+var hashcacheBuildCmd = &cobra.Command{
+	Use:   "build <path> [path...]",
+	Short: "Hash all files under the paths and add them to the cache",
+	Args:  cobra.MinimumNArgs(1),
+	Run:   runHashcacheBuild,
+}
+
+var hashcacheStatsCmd = &cobra.Command{
+	Use:   "stats",
+	Short: "Report cached entries and the estimated dedupe savings",
+	Args:  cobra.NoArgs,
+	Run:   runHashcacheStats,
+}
+
+var hashcacheExportCmd = &cobra.Command{
+	Use:   "export <file>",
+	Short: "Write the cache to a portable JSON file",
+	Long: `Export writes every entry of the cache to a versioned JSON file that is
+independent of the on-disk cache format, so hashes can be computed on one
+machine and imported on another with "hashcache import".`,
+	Args: cobra.ExactArgs(1),
+	Run:  runHashcacheExport,
+}
+
+var hashcacheImportCmd = &cobra.Command{
+	Use:   "import <file>",
+	Short: "Add the entries of a file written by export to the cache",
+	Args:  cobra.ExactArgs(1),
+	Run:   runHashcacheImport,
+}
+
+// hashAlgorithmList lists the values accepted by the --hash flags.
+var hashAlgorithmList = strings.Join(fstools.HashAlgorithms(), ", ")
+
+var hashcachePruneCmd = &cobra.Command{
+	Use:   "prune",
+	Short: "Remove entries whose file was deleted or has changed",
+	Long: `Prune checks the file of every cache entry and removes the entries whose file
+no longer exists, or whose size or modification time has changed since it
+was hashed.`,
+	Args: cobra.NoArgs,
+	Run:  runHashcachePrune,
+}
+
+var hashcachePurgeCmd = &cobra.Command{
+	Use:   "purge",
+	Short: "Delete the cache file",
+	Args:  cobra.NoArgs,
+	Run:   runHashcachePurge,
+}
+
+func init() {
+	hashcacheCmd.PersistentFlags().String("cache", hashcache.DefaultPath(), "Path of the hash cache file")
+	hashcacheCmd.PersistentFlags().String("hash", fstools.DefaultHashAlgorithm, "Hash algorithm of the cache entries: "+hashAlgorithmList+" (a cache built with another algorithm is discarded)")
+
+	hashcacheBuildCmd.Flags().Bool("same-size-only", false, "Only hash files whose size matches at least one other file")
+	hashcacheStatsCmd.Flags().Bool("json", false, "Print the statistics as JSON")
+
+	hashcacheCmd.AddCommand(hashcacheBuildCmd)
+	hashcacheCmd.AddCommand(hashcacheStatsCmd)
+	hashcacheCmd.AddCommand(hashcachePruneCmd)
+	hashcacheCmd.AddCommand(hashcachePurgeCmd)
+	hashcacheCmd.AddCommand(hashcacheExportCmd)
+	hashcacheCmd.AddCommand(hashcacheImportCmd)
+	rootCmd.AddCommand(hashcacheCmd)
+}
+
+func loadHashcache(cmd *cobra.Command) (*hashcache.Cache, bool) {
+	cachePath, _ := cmd.Flags().GetString("cache")
+	algorithm, _ := cmd.Flags().GetString("hash")
+	cache, err := hashcache.Load(cachePath, algorithm)
+	if err != nil {
+		printErrorf("Error loading hash cache: %v\n", err)
+		return nil, false
+	}
+	return cache, true
+}
+
+func runHashcacheBuild(cmd *cobra.Command, args []string) {
+	cache, ok := loadHashcache(cmd)
+	if !ok {
+		return
+	}
+
+	sameSizeOnly, _ := cmd.Flags().GetBool("same-size-only")
+
+	files := scanFiles(cmd.Context(), args, -1)
+	if sameSizeOnly {
+		var eliminated int
+		files, eliminated = filterUniqueSizes(files)
+		fmt.Fprintf(out, "Skipping %d files with a unique size.\n", eliminated)
+	}
+
+	var toHash []scannedFile
+	var toHashBytes int64
+	var hashed, cached int
+	for _, f := range files {
+		if _, ok := cache.Lookup(f.path, f.info); ok {
+			cached++
+			continue
+		}
+		toHash = append(toHash, f)
+		toHashBytes += f.info.Size()
+	}
+
+	var progressBar *progressbar.ProgressBar
+	if !quiet && isTerminal(os.Stdout) && len(toHash) > 0 {
+		progressBar = progressbar.DefaultBytes(toHashBytes, "hashing")
+	}
+	for i, f := range toHash {
+		// The hashes computed so far are still saved below.
+		if err := cmd.Context().Err(); err != nil {
+			printErrorf("Hashing interrupted after %d of %d files.\n", i, len(toHash))
+			break
+		}
+		if progressBar != nil {
+			progressBar.Describe(fmt.Sprintf("hashing %d/%d files", i+1, len(toHash)))
+		}
+		hash, err := hashFileWithProgress(f.path, cache.Algorithm, progressBar)
+		if err != nil {
+			printErrorf("Error hashing %s: %v\n", f.path, err)
+			continue
+		}
+		cache.Put(f.path, f.info, hash)
+		hashed++
+	}
+	if progressBar != nil {
+		progressBar.Exit()
+	}
+
+	if err := cache.Save(); err != nil {
+		printErrorf("Error saving hash cache: %v\n", err)
+		return
+	}
+	fmt.Fprintf(out, "Hashed %d files, %d already cached.\n", hashed, cached)
+}
+
+// hashFileWithProgress hashes the file at path with algorithm, adding the
+// bytes read to progressBar if it isn't nil.
+func hashFileWithProgress(path, algorithm string, progressBar *progressbar.ProgressBar) (string, error) {
+	if progressBar == nil {
+		return hashcache.HashFile(path, algorithm)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return fstools.HashReader(io.TeeReader(f, progressBar), algorithm)
+}
+
+func runHashcacheStats(cmd *cobra.Command, args []string) {
+	cache, ok := loadHashcache(cmd)
+	if !ok {
+		return
+	}
+	asJSON, _ := cmd.Flags().GetBool("json")
+
+	stats := cache.Stats()
+	if asJSON {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		enc.Encode(stats)
+		return
+	}
+	fmt.Fprintln(out, "Cache:", cache.Path())
+	fmt.Fprintln(out, "Entries                  :", stats.Entries)
+	fmt.Fprintln(out, "Total             (Bytes):", stats.TotalBytes)
+	fmt.Fprintln(out, "Distinct Hashes          :", stats.Distinct)
+	fmt.Fprintln(out, "Dedupe Groups            :", stats.DedupeGroups)
+	fmt.Fprintln(out, "Estimated Savings (Bytes):", stats.EstimatedSavings)
+}
+
+func runHashcachePrune(cmd *cobra.Command, args []string) {
+	cache, ok := loadHashcache(cmd)
+	if !ok {
+		return
+	}
+
+	removed := cache.Prune()
+	if err := cache.Save(); err != nil {
+		printErrorf("Error saving hash cache: %v\n", err)
+		return
+	}
+	fmt.Fprintf(out, "Pruned %d entries, %d remaining.\n", removed, len(cache.Entries))
+}
+
+func runHashcachePurge(cmd *cobra.Command, args []string) {
+	cachePath, _ := cmd.Flags().GetString("cache")
+	if err := hashcache.Purge(cachePath); err != nil {
+		printErrorf("Error purging hash cache: %v\n", err)
+		return
+	}
+	fmt.Fprintln(out, "Deleted", cachePath)
+}
+
+func runHashcacheExport(cmd *cobra.Command, args []string) {
+	cache, ok := loadHashcache(cmd)
+	if !ok {
+		return
+	}
+
+	f, err := os.Create(args[0])
+	if err != nil {
+		printErrorf("Error creating export: %v\n", err)
+		return
+	}
+	if err := cache.Export(f); err != nil {
+		f.Close()
+		printErrorf("Error writing export: %v\n", err)
+		return
+	}
+	if err := f.Close(); err != nil {
+		printErrorf("Error writing export: %v\n", err)
+		return
+	}
+	fmt.Fprintf(out, "Exported %d entries to %s.\n", len(cache.Entries), args[0])
+}
+
+func runHashcacheImport(cmd *cobra.Command, args []string) {
+	cache, ok := loadHashcache(cmd)
+	if !ok {
+		return
+	}
+
+	f, err := os.Open(args[0])
+	if err != nil {
+		printErrorf("Error opening export: %v\n", err)
+		return
+	}
+	exp, err := hashcache.ReadExport(f)
+	f.Close()
+	if err != nil {
+		printErrorf("Error reading export %s: %v\n", args[0], err)
+		return
+	}
+	// Hashes from a different algorithm can never match the ones computed
+	// here, so they are not mixed into the cache.
+	if exp.Algorithm != cache.Algorithm {
+		fmt.Fprintf(
+			os.Stderr,
+			"Warning: %s was hashed with %s, but the cache uses %s. Nothing was imported.\n",
+			args[0],
+			exp.Algorithm,
+			cache.Algorithm,
+		)
+		return
+	}
+
+	cache.Import(exp)
+	if err := cache.Save(); err != nil {
+		printErrorf("Error saving hash cache: %v\n", err)
+		return
+	}
+	fmt.Fprintf(out, "Imported %d entries.\n", len(exp.Entries))
+}
@@ -0,0 +1,85 @@
+package hashcache
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// ExportVersion is the version of the portable export format written by
+// Export. It is incremented whenever the format changes incompatibly.
+const ExportVersion = 1
+
+// Export is the portable representation of a cache, which is independent
+// of the on-disk format, so it can be moved between machines and versions
+// of this tool. It is encoded as JSON.
+type Export struct {
+	Version   int           `json:"version"`
+	Algorithm string        `json:"algorithm"`
+	Entries   []ExportEntry `json:"entries"`
+}
+
+// ExportEntry is the cached hash of the file at Path.
+type ExportEntry struct {
+	Path    string `json:"path"`
+	Size    int64  `json:"size"`
+	MtimeNs int64  `json:"mtime_ns"`
+	Hash    string `json:"hash"`
+}
+
+// Export writes every entry of the cache to w in the portable format,
+// sorted by path.
+func (c *Cache) Export(w io.Writer) error {
+	c.mu.Lock()
+	exp := Export{
+		Version:   ExportVersion,
+		Algorithm: c.Algorithm,
+		Entries:   make([]ExportEntry, 0, len(c.Entries)),
+	}
+	for path, e := range c.Entries {
+		exp.Entries = append(exp.Entries, ExportEntry{
+			Path:    path,
+			Size:    e.Size,
+			MtimeNs: e.MtimeNs,
+			Hash:    e.Hash,
+		})
+	}
+	c.mu.Unlock()
+
+	sort.Slice(exp.Entries, func(i, j int) bool {
+		return exp.Entries[i].Path < exp.Entries[j].Path
+	})
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(&exp)
+}
+
+// ReadExport decodes an export written by Export, rejecting versions of the
+// format that it doesn't understand. The algorithm is not checked, so the
+// caller can decide how to handle a mismatch.
+func ReadExport(r io.Reader) (*Export, error) {
+	var exp Export
+	if err := json.NewDecoder(r).Decode(&exp); err != nil {
+		return nil, fmt.Errorf("failed to decode export: %v", err)
+	}
+	if exp.Version != ExportVersion {
+		return nil, fmt.Errorf("unsupported export version %d, expected %d", exp.Version, ExportVersion)
+	}
+	return &exp, nil
+}
+
+// Import adds every entry of exp to the cache, replacing existing entries
+// for the same paths. The entries are written by the next Save.
+func (c *Cache) Import(exp *Export) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, e := range exp.Entries {
+		c.updated[e.Path] = struct{}{}
+		c.Entries[e.Path] = Entry{
+			Size:    e.Size,
+			MtimeNs: e.MtimeNs,
+			Hash:    e.Hash,
+		}
+	}
+}
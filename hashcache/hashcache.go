@@ -0,0 +1,304 @@
+// Package hashcache provides a persistent cache of file content hashes,
+// keyed by path and invalidated by file size and modification time.
+package hashcache
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/linux4life798/btrfs-optimize/fstools"
+	"golang.org/x/sys/unix"
+)
+
+// Entry is the cached content hash of a single file.
+type Entry struct {
+	Size    int64
+	MtimeNs int64
+	Hash    string
+}
+
+// Matches reports whether the entry is still valid for a file with the
+// given info.
+func (e Entry) Matches(info fs.FileInfo) bool {
+	return e.Size == info.Size() && e.MtimeNs == info.ModTime().UnixNano()
+}
+
+// Cache maps absolute file paths to their content hashes.
+//
+// A Cache is safe for concurrent use by multiple goroutines. Multiple
+// processes may also share the same cache file, since Save merges the
+// entries changed by this process into the latest copy on disk while
+// holding an exclusive file lock.
+type Cache struct {
+	path string
+
+	mu      sync.Mutex
+	updated map[string]struct{}
+
+	// Algorithm is the hash algorithm used for all entries in the cache,
+	// one of fstools.HashAlgorithms.
+	Algorithm string
+	Entries   map[string]Entry
+}
+
+// storedCache is the on-disk representation of a Cache.
+type storedCache struct {
+	Algorithm string
+	Entries   map[string]Entry
+}
+
+// DefaultPath returns the default cache location,
+// $XDG_CACHE_HOME/btrfs-optimize/hashes.db.
+func DefaultPath() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "btrfs-optimize", "hashes.db")
+}
+
+// Load reads the cache stored at path, for hashes computed with algorithm.
+// A missing cache file results in an empty cache. If the cache was built
+// with a different algorithm, it is discarded, and replaced by the next Save.
+func Load(path, algorithm string) (*Cache, error) {
+	if _, err := fstools.NewHasher(algorithm); err != nil {
+		return nil, err
+	}
+	entries, err := readEntries(path, algorithm)
+	if err != nil {
+		return nil, err
+	}
+	return &Cache{
+		path:      path,
+		updated:   make(map[string]struct{}),
+		Algorithm: algorithm,
+		Entries:   entries,
+	}, nil
+}
+
+// readEntries reads the entries stored at path, returning an empty map if
+// the file doesn't exist or was built with an algorithm other than
+// algorithm.
+func readEntries(path, algorithm string) (map[string]Entry, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return make(map[string]Entry), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var stored storedCache
+	if err := gob.NewDecoder(f).Decode(&stored); err != nil {
+		return nil, fmt.Errorf("failed to decode hash cache %s: %v", path, err)
+	}
+	if stored.Algorithm != algorithm || stored.Entries == nil {
+		return make(map[string]Entry), nil
+	}
+	return stored.Entries, nil
+}
+
+// lock takes an exclusive flock on a lock file next to the cache, blocking
+// until any other process has released it.
+func (c *Cache) lock() (*os.File, error) {
+	f, err := os.OpenFile(c.path+".lock", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// Path returns the location the cache is stored at.
+func (c *Cache) Path() string {
+	return c.path
+}
+
+// Save writes the cache back to its path, creating the parent directory if
+// needed.
+//
+// Entries changed or removed through this Cache are merged into the latest
+// copy on disk, so that concurrent processes don't discard each other's work.
+// The new file is written to a temporary file and renamed into place, so a
+// crash never leaves a partially written cache behind.
+func (c *Cache) Save() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	dir := filepath.Dir(c.path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	lockFile, err := c.lock()
+	if err != nil {
+		return fmt.Errorf("failed to lock hash cache: %v", err)
+	}
+	defer lockFile.Close()
+
+	merged, err := readEntries(c.path, c.Algorithm)
+	if err != nil {
+		return err
+	}
+	for path := range c.updated {
+		if e, ok := c.Entries[path]; ok {
+			merged[path] = e
+		} else {
+			delete(merged, path)
+		}
+	}
+
+	tmp, err := os.CreateTemp(dir, filepath.Base(c.path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	stored := storedCache{Algorithm: c.Algorithm, Entries: merged}
+	if err := gob.NewEncoder(tmp).Encode(&stored); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), c.path); err != nil {
+		return err
+	}
+
+	c.Entries = merged
+	c.updated = make(map[string]struct{})
+	return nil
+}
+
+// Lookup returns the cached hash of the file at path, if the cached entry
+// is still valid for info.
+func (c *Cache) Lookup(path string, info fs.FileInfo) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.Entries[path]
+	if !ok || !e.Matches(info) {
+		return "", false
+	}
+	return e.Hash, true
+}
+
+// Put records the hash of the file at path with the given info.
+func (c *Cache) Put(path string, info fs.FileInfo, hash string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.updated[path] = struct{}{}
+	c.Entries[path] = Entry{
+		Size:    info.Size(),
+		MtimeNs: info.ModTime().UnixNano(),
+		Hash:    hash,
+	}
+}
+
+// Prune removes the entries whose file no longer exists, is no longer a
+// regular file, or no longer matches the entry's size and modification
+// time, returning the number removed. Entries whose file can't be checked
+// for another reason, such as a permission error, are kept. The removals
+// are written by the next Save.
+func (c *Cache) Prune() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var removed int
+	for path, e := range c.Entries {
+		info, err := os.Stat(path)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err == nil && info.Mode().IsRegular() && e.Matches(info) {
+			continue
+		}
+		delete(c.Entries, path)
+		c.updated[path] = struct{}{}
+		removed++
+	}
+	return removed
+}
+
+// Purge deletes the cache file at path while holding the lock, so that it
+// doesn't race with another process's Save. The lock file is left in
+// place, since removing it would let a process waiting on it and one
+// creating a new one both hold the lock. A missing cache file is not an
+// error.
+func Purge(path string) error {
+	c := &Cache{path: path}
+	lockFile, err := c.lock()
+	if errors.Is(err, fs.ErrNotExist) {
+		// The directory doesn't exist, so neither does the cache.
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to lock hash cache: %v", err)
+	}
+	defer lockFile.Close()
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// HashFile returns the hex encoded content hash of the file at path, using
+// the named algorithm.
+func HashFile(path, algorithm string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return fstools.HashReader(f, algorithm)
+}
+
+// Stats summarizes the dedupe potential recorded in a cache.
+type Stats struct {
+	Entries      int    `json:"entries"`
+	TotalBytes   uint64 `json:"total_bytes"`
+	Distinct     int    `json:"distinct_hashes"`
+	DedupeGroups int    `json:"dedupe_groups"`
+	// EstimatedSavings is the number of bytes that would be reclaimed if
+	// every group of identical files was deduped down to a single copy.
+	EstimatedSavings uint64 `json:"estimated_savings_bytes"`
+}
+
+// Stats computes statistics over all entries, without touching the
+// filesystem. Files are considered identical if both their size and hash
+// match.
+func (c *Cache) Stats() Stats {
+	type key struct {
+		size int64
+		hash string
+	}
+	groups := make(map[key]int)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var s Stats
+	for _, e := range c.Entries {
+		s.Entries++
+		s.TotalBytes += uint64(e.Size)
+		groups[key{e.Size, e.Hash}]++
+	}
+	s.Distinct = len(groups)
+	for k, count := range groups {
+		if count > 1 {
+			s.DedupeGroups++
+			s.EstimatedSavings += uint64(count-1) * uint64(k.size)
+		}
+	}
+	return s
+}
@@ -0,0 +1,135 @@
+package hashcache
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/linux4life798/btrfs-optimize/fstools"
+)
+
+// statFile creates a file holding content in dir and returns its path and
+// info.
+func statFile(t *testing.T, dir, name, content string) (string, os.FileInfo) {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path, info
+}
+
+// TestConcurrentSave has many caches, standing in for separate processes,
+// save their own entries to the same file at once, each through several
+// goroutines, and checks that no entry is lost.
+func TestConcurrentSave(t *testing.T) {
+	const caches, goroutines, entries = 8, 4, 16
+	dir := t.TempDir()
+	cachePath := filepath.Join(dir, "cache", "hashes.db")
+
+	var wg sync.WaitGroup
+	errs := make(chan error, caches*goroutines*entries)
+	for c := 0; c < caches; c++ {
+		cache, err := Load(cachePath, fstools.DefaultHashAlgorithm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for g := 0; g < goroutines; g++ {
+			var files []string
+			var infos []os.FileInfo
+			for e := 0; e < entries; e++ {
+				path, info := statFile(t, dir, fmt.Sprintf("%d-%d-%d", c, g, e), "")
+				files = append(files, path)
+				infos = append(infos, info)
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i, path := range files {
+					cache.Put(path, infos[i], path)
+					if err := cache.Save(); err != nil {
+						errs <- err
+					}
+				}
+			}()
+		}
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	cache, err := Load(cachePath, fstools.DefaultHashAlgorithm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(cache.Entries), caches*goroutines*entries; got != want {
+		t.Fatalf("got %d entries, want %d", got, want)
+	}
+	for path, e := range cache.Entries {
+		if e.Hash != path {
+			t.Errorf("%s: got hash %q", path, e.Hash)
+		}
+	}
+}
+
+func TestAlgorithmMismatchDiscards(t *testing.T) {
+	dir := t.TempDir()
+	cachePath := filepath.Join(dir, "hashes.db")
+	path, info := statFile(t, dir, "file", "data")
+
+	cache, err := Load(cachePath, "sha256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.Put(path, info, "hash")
+	if err := cache.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	cache, err = Load(cachePath, "xxhash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cache.Entries) != 0 {
+		t.Errorf("got %d entries from a cache built with another algorithm", len(cache.Entries))
+	}
+}
+
+func TestPurge(t *testing.T) {
+	dir := t.TempDir()
+	cachePath := filepath.Join(dir, "hashes.db")
+	path, info := statFile(t, dir, "file", "data")
+
+	cache, err := Load(cachePath, fstools.DefaultHashAlgorithm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.Put(path, info, "hash")
+	if err := cache.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if err := Purge(cachePath); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(cachePath); !os.IsNotExist(err) {
+		t.Errorf("cache file still exists: %v", err)
+	}
+	// Removing the lock file would break the exclusion between processes.
+	if _, err := os.Stat(cachePath + ".lock"); err != nil {
+		t.Errorf("lock file was removed: %v", err)
+	}
+	if err := Purge(cachePath); err != nil {
+		t.Errorf("purging a missing cache: %v", err)
+	}
+	if err := Purge(filepath.Join(dir, "missing", "hashes.db")); err != nil {
+		t.Errorf("purging a cache in a missing directory: %v", err)
+	}
+}
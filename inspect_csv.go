@@ -0,0 +1,41 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+
+	"github.com/linux4life798/btrfs-optimize/fstools"
+)
+
+// printExtentCSV prints the extents of every file in paths as CSV, under a
+// single header row, with the path of the file in every row. The --offset
+// and --length flags, given as offsetStr and lengthStr, and head and tail
+// select the same extents as the text table, as does match, which keeps
+// only the extents with any of its flags set.
+func printExtentCSV(paths []string, offsetStr, lengthStr string, head, tail int, useBytes bool, match, flags uint32) {
+	w := csv.NewWriter(out)
+	if err := w.Write(fstools.ExtentCSVHeader); err != nil {
+		printErrorf("Error writing CSV: %v\n", err)
+		return
+	}
+	for _, filePath := range paths {
+		if err := extentCSV(w, filePath, offsetStr, lengthStr, head, tail, useBytes, match, flags); err != nil {
+			printErrorf("Error inspecting %s: %v\n", filePath, err)
+		}
+	}
+	w.Flush()
+}
+
+func extentCSV(w *csv.Writer, filePath, offsetStr, lengthStr string, head, tail int, useBytes bool, match, flags uint32) error {
+	start, length, err := inspectWindow(filePath, offsetStr, lengthStr, useBytes)
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(filePath)
+	if err != nil {
+		return fmt.Errorf("failed to open file: %v", err)
+	}
+	defer file.Close()
+	return fstools.WriteExtentCSV(w, file, filePath, start, length, head, tail, useBytes, match, flags)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/linux4life798/btrfs-optimize/fstools"
+)
+
+// newFileExtentReport opens filePath and returns its extent report.
+func newFileExtentReport(filePath string, flags uint32) (*fstools.ExtentReport, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %v", err)
+	}
+	defer file.Close()
+	return fstools.NewExtentReport(file, filePath, flags)
+}
+
+// saveBaseline writes the extent reports of all filePaths to baselinePath
+// as a JSON array.
+func saveBaseline(baselinePath string, filePaths []string, flags uint32) {
+	reports := []*fstools.ExtentReport{}
+	for _, filePath := range filePaths {
+		report, err := newFileExtentReport(filePath, flags)
+		if err != nil {
+			printErrorf("Error reading extents of %s: %v\n", filePath, err)
+			continue
+		}
+		reports = append(reports, report)
+	}
+
+	data, err := json.MarshalIndent(reports, "", "  ")
+	if err != nil {
+		printErrorf("Error encoding baseline: %v\n", err)
+		return
+	}
+	if err := os.WriteFile(baselinePath, data, 0644); err != nil {
+		printErrorf("Error writing baseline: %v\n", err)
+		return
+	}
+	fmt.Fprintf(out, "Saved baseline of %d files to %s\n", len(reports), baselinePath)
+}
+
+func loadBaseline(baselinePath string) (map[string]*fstools.ExtentReport, error) {
+	data, err := os.ReadFile(baselinePath)
+	if err != nil {
+		return nil, err
+	}
+	var reports []*fstools.ExtentReport
+	if err := json.Unmarshal(data, &reports); err != nil {
+		return nil, fmt.Errorf("failed to parse baseline: %v", err)
+	}
+	byPath := make(map[string]*fstools.ExtentReport, len(reports))
+	for _, r := range reports {
+		byPath[r.Path] = r
+	}
+	return byPath, nil
+}
+
+// printDeltas compares each of filePaths against its entry in the baseline
+// and prints what changed.
+func printDeltas(baselinePath string, filePaths []string, flags uint32) {
+	baseline, err := loadBaseline(baselinePath)
+	if err != nil {
+		printErrorf("Error loading baseline %s: %v\n", baselinePath, err)
+		return
+	}
+
+	for _, filePath := range filePaths {
+		before, ok := baseline[filePath]
+		if !ok {
+			printErrorf("Error: %s is not in the baseline\n", filePath)
+			continue
+		}
+		after, err := newFileExtentReport(filePath, flags)
+		if err != nil {
+			printErrorf("Error reading extents of %s: %v\n", filePath, err)
+			continue
+		}
+
+		d := fstools.DiffReports(before, after)
+		fmt.Fprintln(out, "File:", filePath)
+		fmt.Fprintf(out, "Size    (Bytes): %d -> %d\n", d.SizeBefore, d.SizeAfter)
+		fmt.Fprintf(out, "Extents        : %d -> %d (%d unchanged)\n", d.ExtentsBefore, d.ExtentsAfter, d.Unchanged)
+		fmt.Fprintf(out, "Split Extents  : %d\n", d.Split)
+		fmt.Fprintf(out, "Merged Extents : %d\n", d.Merged)
+		fmt.Fprintf(out, "Shared (Bytes) : +%d -%d\n", d.SharedGainedBytes, d.SharedLostBytes)
+		for _, e := range d.Removed {
+			fmt.Fprintf(out, "- %d+%d @ %d %s\n", e.Logical, e.Length, e.Physical, strings.Join(e.Flags, ","))
+		}
+		for _, e := range d.New {
+			fmt.Fprintf(out, "+ %d+%d @ %d %s\n", e.Logical, e.Length, e.Physical, strings.Join(e.Flags, ","))
+		}
+		fmt.Fprintln(out)
+	}
+}
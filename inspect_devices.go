@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/linux4life798/btrfs-optimize/fstools"
+	"golang.org/x/sys/unix"
+)
+
+// inspectDevices prints the btrfs device and on-device offset backing each
+// extent of filePath. On non-btrfs filesystems, or when the chunk tree cannot
+// be read, a note is printed instead.
+func inspectDevices(filePath string, flags uint32) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return fmt.Errorf("failed to open file: %v", err)
+	}
+	defer file.Close()
+
+	isBtrfs, err := fstools.IsBtrfs(file)
+	if err != nil {
+		return fmt.Errorf("failed to stat filesystem: %v", err)
+	}
+	if !isBtrfs {
+		fmt.Fprintln(out, "Devices: unavailable, not a btrfs filesystem")
+		return nil
+	}
+
+	chunks, err := fstools.BtrfsChunks(int(file.Fd()))
+	if err == unix.EPERM {
+		fmt.Fprintln(out, "Devices: unavailable, reading the chunk tree requires root")
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read chunk tree: %v", err)
+	}
+
+	devicePaths := make(map[uint64]string)
+	devicePath := func(devid uint64) string {
+		if path, ok := devicePaths[devid]; ok {
+			return path
+		}
+		path, err := fstools.BtrfsDevicePath(int(file.Fd()), devid)
+		if err != nil {
+			path = "?"
+		}
+		devicePaths[devid] = path
+		return path
+	}
+
+	if info, err := fstools.BtrfsGetFsInfo(int(file.Fd())); err == nil {
+		fmt.Fprintln(out, "Devices:", info.NumDevices)
+	}
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "Extent-Index\tPhysical-Start\tDevice-Locations (devid:offset:path)")
+	err = fstools.FiemapWalk(file, flags, func(index int, extent *fstools.FiemapExtent) bool {
+		var where string
+		if extent.Flags&(fstools.FIEMAP_EXTENT_UNKNOWN|fstools.FIEMAP_EXTENT_DATA_INLINE) != 0 {
+			where = "n/a"
+		} else if chunk := fstools.BtrfsFindChunk(chunks, extent.Physical); chunk == nil {
+			where = "no chunk found"
+		} else if locations, err := chunk.Map(extent.Physical); err != nil {
+			where = err.Error()
+		} else {
+			var parts []string
+			for _, l := range locations {
+				parts = append(parts, fmt.Sprintf("%d:%d:%s", l.DevID, l.Offset, devicePath(l.DevID)))
+			}
+			where = strings.Join(parts, " ")
+		}
+		fmt.Fprintf(w, "%d\t%d\t%s\n", index, extent.Physical, where)
+		return false
+	})
+	w.Flush()
+	if err != nil {
+		return fmt.Errorf("failed to walk fiemap: %v", err)
+	}
+	return nil
+}
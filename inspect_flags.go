@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/linux4life798/btrfs-optimize/fstools"
+)
+
+// flagGroup totals the extents that have exactly the same flags.
+type flagGroup struct {
+	flags   string
+	extents int
+	length  uint64
+}
+
+// inspectFlagGroups prints the number of extents and their total length for
+// each combination of flags found in filePath, largest first. Lengths are
+// in blocks, unless useBytes is set.
+func inspectFlagGroups(filePath string, flags uint32, useBytes bool) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return fmt.Errorf("failed to open file: %v", err)
+	}
+	defer file.Close()
+
+	blkSize := uint64(1)
+	units := "Bytes"
+	if !useBytes {
+		if blkSize, err = fstools.FileBlockSize(file); err != nil {
+			return err
+		}
+		units = "Blocks"
+	}
+
+	groups := make(map[uint32]*flagGroup)
+	err = fstools.FiemapWalk(file, flags, func(index int, extent *fstools.FiemapExtent) bool {
+		// The last flag only marks the end of the file, so it would split
+		// the final extent into a group of its own.
+		key := extent.Flags &^ fstools.FIEMAP_EXTENT_LAST
+		g, ok := groups[key]
+		if !ok {
+			name := strings.Join(fstools.FiemapExtentFlagsToStrings(key), ",")
+			if name == "" {
+				name = "none"
+			}
+			g = &flagGroup{flags: name}
+			groups[key] = g
+		}
+		g.extents++
+		g.length += extent.Length
+		return false
+	})
+	if err != nil {
+		return fmt.Errorf("failed to walk fiemap: %v", err)
+	}
+
+	sorted := make([]*flagGroup, 0, len(groups))
+	for _, g := range groups {
+		sorted = append(sorted, g)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].length != sorted[j].length {
+			return sorted[i].length > sorted[j].length
+		}
+		return sorted[i].flags < sorted[j].flags
+	})
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "Flags\tExtents\tLength (%s)\n", units)
+	for _, g := range sorted {
+		fmt.Fprintf(w, "%s\t%d\t%d\n", g.flags, g.extents, g.length/blkSize)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/linux4life798/btrfs-optimize/fstools"
+)
+
+// gapBucketBounds are the exclusive upper bounds of the seek distance
+// buckets printed by inspectGaps, after the bucket for contiguous extents.
+// The last bucket holds everything at or above the last bound.
+var gapBucketBounds = []uint64{Mebibyte, 16 * Mebibyte, Gibibyte}
+
+// inspectGaps prints a histogram of the physical seek distances between
+// consecutive extents of filePath, which shows how scattered the file is
+// on disk, even when it only has a modest number of extents.
+func inspectGaps(filePath string, flags uint32) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return fmt.Errorf("failed to open file: %v", err)
+	}
+	defer file.Close()
+
+	extents, err := fstools.CollectExtents(file, flags)
+	if err != nil {
+		return fmt.Errorf("failed to walk fiemap: %v", err)
+	}
+
+	// The first count is for contiguous extents.
+	counts := make([]int, len(gapBucketBounds)+2)
+	for _, gap := range fstools.PhysicalGaps(extents) {
+		if gap == 0 {
+			counts[0]++
+			continue
+		}
+		bucket := len(gapBucketBounds)
+		for i, bound := range gapBucketBounds {
+			if gap < bound {
+				bucket = i
+				break
+			}
+		}
+		counts[bucket+1]++
+	}
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "Seek-Distance\tCount")
+	fmt.Fprintf(w, "contiguous\t%d\n", counts[0])
+	lower := uint64(0)
+	for i, bound := range gapBucketBounds {
+		if lower == 0 {
+			fmt.Fprintf(w, "< %s\t%d\n", FormatSize(bound), counts[i+1])
+		} else {
+			fmt.Fprintf(w, "%s - %s\t%d\n", FormatSize(lower), FormatSize(bound), counts[i+1])
+		}
+		lower = bound
+	}
+	fmt.Fprintf(w, ">= %s\t%d\n", FormatSize(lower), counts[len(counts)-1])
+	return w.Flush()
+}
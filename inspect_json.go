@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/linux4life798/btrfs-optimize/fstools"
+)
+
+// printExtentReports prints the extents of every file in paths as a single
+// JSON array of reports, with all offsets and lengths in bytes. The --offset
+// and --length flags, given as offsetStr and lengthStr, and head and tail
+// select the same extents as the text table. Files that can't be inspected
+// are reported and left out of the array.
+func printExtentReports(paths []string, offsetStr, lengthStr string, head, tail int, flags uint32) {
+	reports := []*fstools.ExtentReport{}
+	for _, filePath := range paths {
+		report, err := extentReport(filePath, offsetStr, lengthStr, head, tail, flags)
+		if err != nil {
+			printErrorf("Error inspecting %s: %v\n", filePath, err)
+			continue
+		}
+		reports = append(reports, report)
+	}
+
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(reports); err != nil {
+		printErrorf("Error encoding JSON: %v\n", err)
+	}
+}
+
+func extentReport(filePath, offsetStr, lengthStr string, head, tail int, flags uint32) (*fstools.ExtentReport, error) {
+	start, length, err := inspectWindow(filePath, offsetStr, lengthStr, false)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %v", err)
+	}
+	defer file.Close()
+	return fstools.NewExtentReportWindow(file, filePath, start, length, head, tail, flags)
+}
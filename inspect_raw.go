@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/linux4life798/btrfs-optimize/fstools"
+)
+
+// rawExtents is the JSON form of inspect --raw=json.
+type rawExtents struct {
+	Path    string                 `json:"path"`
+	Extents []fstools.FiemapExtent `json:"extents"`
+}
+
+// inspectRaw prints every field of every extent of filePath exactly as
+// FIEMAP returned it, including the flags as a number and the reserved
+// fields, for diagnosing unexpected FIEMAP output. The format is "text",
+// with one block of lines per extent, or "json".
+func inspectRaw(filePath string, flags uint32, format string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return fmt.Errorf("failed to open file: %v", err)
+	}
+	defer file.Close()
+
+	extents, err := fstools.CollectExtents(file, flags)
+	if err != nil {
+		return fmt.Errorf("failed to walk fiemap: %v", err)
+	}
+
+	if format == "json" {
+		if extents == nil {
+			extents = []fstools.FiemapExtent{}
+		}
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(rawExtents{Path: filePath, Extents: extents})
+	}
+
+	fmt.Fprintln(out, "File:", filePath)
+	for i, e := range extents {
+		fmt.Fprintf(out, "Extent %d:\n", i)
+		fmt.Fprintln(out, "  Logical   :", e.Logical)
+		fmt.Fprintln(out, "  Physical  :", e.Physical)
+		fmt.Fprintln(out, "  Length    :", e.Length)
+		fmt.Fprintf(out, "  Flags     : 0x%08X\n", e.Flags)
+		fmt.Fprintln(out, "  Reserved64:", e.Reserved64)
+		fmt.Fprintln(out, "  Reserved  :", e.Reserved)
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/linux4life798/btrfs-optimize/fstools"
+)
+
+// recordExtents saves the extents and metadata of every file in paths to
+// recordPath, for rendering later with inspect --replay. Files that can't be
+// mapped are reported and left out of the recording.
+func recordExtents(recordPath string, paths []string, flags uint32) {
+	var files []fstools.RecordedExtentMap
+	for _, filePath := range paths {
+		file, err := os.Open(filePath)
+		if err != nil {
+			printErrorf("Error recording %s: %v\n", filePath, err)
+			continue
+		}
+		m, err := fstools.RecordExtentMap(file, filePath, flags)
+		file.Close()
+		if err != nil {
+			printErrorf("Error recording %s: %v\n", filePath, err)
+			continue
+		}
+		files = append(files, *m)
+	}
+
+	f, err := os.Create(recordPath)
+	if err != nil {
+		printErrorf("Error creating recording: %v\n", err)
+		return
+	}
+	if err := fstools.WriteRecording(f, files); err != nil {
+		f.Close()
+		printErrorf("Error writing recording: %v\n", err)
+		return
+	}
+	if err := f.Close(); err != nil {
+		printErrorf("Error writing recording: %v\n", err)
+		return
+	}
+	fmt.Fprintf(out, "Recorded %d files to %s\n", len(files), recordPath)
+}
+
+// replayRecording renders the extent table, or the --summary and --total
+// reports, of every file in the recording at recordPath, like inspect does
+// for live files, without touching the recorded files.
+func replayRecording(recordPath string, head, tail int, useBytes, faster, summary, total bool) {
+	f, err := os.Open(recordPath)
+	if err != nil {
+		printErrorf("Error opening recording: %v\n", err)
+		return
+	}
+	rec, err := fstools.ReadRecording(f)
+	f.Close()
+	if err != nil {
+		printErrorf("Error reading recording %s: %v\n", recordPath, err)
+		return
+	}
+	total = total && len(rec.Files) > 1
+
+	var totalSummary fstools.ExtentSummary
+	for i := range rec.Files {
+		m := &rec.Files[i]
+		if !summary {
+			if err := m.Dump(out, head, tail, useBytes, faster); err != nil {
+				printErrorf("Error showing extents for %s: %v\n", m.Path, err)
+			}
+		}
+		if summary || total {
+			s := m.Summarize()
+			totalSummary.Add(s)
+			if summary {
+				fmt.Fprintln(out, "File:", m.Path)
+				printExtentSummary(s, false)
+			}
+		}
+		fmt.Fprintln(out)
+	}
+
+	if total {
+		fmt.Fprintln(out, "Total Files:", totalSummary.Files)
+		printExtentSummary(totalSummary, false)
+	}
+}
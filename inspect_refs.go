@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/linux4life798/btrfs-optimize/fstools"
+	"golang.org/x/sys/unix"
+)
+
+// inspectRefs prints how many references point at each extent of filePath,
+// using BTRFS_IOC_LOGICAL_INO. Unlike FIEMAP_EXTENT_SHARED, this shows how
+// widely an extent is shared, and still counts an extent that is only partly
+// shared after a ranged dedupe. On non-btrfs filesystems, or without root,
+// a note is printed instead.
+func inspectRefs(filePath string, flags uint32) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return fmt.Errorf("failed to open file: %v", err)
+	}
+	defer file.Close()
+
+	isBtrfs, err := fstools.IsBtrfs(file)
+	if err != nil {
+		return fmt.Errorf("failed to stat filesystem: %v", err)
+	}
+	if !isBtrfs {
+		fmt.Fprintln(out, "References: unavailable, not a btrfs filesystem")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "Extent-Index\tPhysical-Start\tLength\tRefs\tFiles")
+	var refsErr error
+	err = fstools.FiemapWalk(file, flags, func(index int, extent *fstools.FiemapExtent) bool {
+		if extent.Flags&(fstools.FIEMAP_EXTENT_UNKNOWN|fstools.FIEMAP_EXTENT_DATA_INLINE) != 0 {
+			fmt.Fprintf(w, "%d\t%d\t%d\tn/a\tn/a\n", index, extent.Physical, extent.Length)
+			return false
+		}
+		refs, err := fstools.BtrfsLogicalIno(int(file.Fd()), extent.Physical)
+		if err != nil {
+			refsErr = err
+			return true
+		}
+		type fileID struct{ root, inode uint64 }
+		files := make(map[fileID]struct{})
+		for _, r := range refs {
+			files[fileID{r.Root, r.Inode}] = struct{}{}
+		}
+		fmt.Fprintf(w, "%d\t%d\t%d\t%d\t%d\n", index, extent.Physical, extent.Length, len(refs), len(files))
+		return false
+	})
+	w.Flush()
+	if refsErr == unix.EPERM {
+		fmt.Fprintln(out, "References: unavailable, resolving extent references requires root")
+		return nil
+	}
+	if refsErr != nil {
+		return fmt.Errorf("failed to resolve extent references: %v", refsErr)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to walk fiemap: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/linux4life798/btrfs-optimize/fstools"
+)
+
+// printFiemapStats prints the fragmentation statistics of each of paths,
+// in place of the extent table.
+func printFiemapStats(paths []string, flags uint32) {
+	for _, filePath := range paths {
+		s, err := fiemapStats(filePath, flags)
+		if err != nil {
+			printErrorf("Error collecting extent statistics for %s: %v\n", filePath, err)
+			continue
+		}
+		fmt.Fprintln(out, "File:", filePath)
+		fmt.Fprintln(out, "Extents                :", s.Extents)
+		fmt.Fprintln(out, "Mapped          (Bytes):", s.MappedBytes)
+		fmt.Fprintln(out, "Shared Extents         :", s.SharedExtents)
+		fmt.Fprintln(out, "Holes                  :", s.Holes)
+		fmt.Fprintln(out, "Largest Extent  (Bytes):", s.LargestExtent)
+		fmt.Fprintln(out, "Smallest Extent (Bytes):", s.SmallestExtent)
+		fmt.Fprintln(out)
+	}
+}
+
+func fiemapStats(filePath string, flags uint32) (fstools.Stats, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return fstools.Stats{}, fmt.Errorf("failed to open file: %v", err)
+	}
+	defer file.Close()
+	return fstools.FiemapStats(file, flags)
+}
+
+// printSharing prints the shared and exclusive bytes of each of paths, in
+// place of the extent table, prefixed by the path when there are several.
+// With FIEMAP_FLAG_SYNC in flags, each file is synced first.
+func printSharing(paths []string, flags uint32) {
+	for _, filePath := range paths {
+		shared, exclusive, err := sharedExclusiveBytes(filePath, flags)
+		if err != nil {
+			printErrorf("Error reading extents of %s: %v\n", filePath, err)
+			continue
+		}
+		var ratio float64
+		if total := shared + exclusive; total > 0 {
+			ratio = float64(shared) / float64(total) * 100
+		}
+		if len(paths) > 1 {
+			fmt.Fprintf(out, "%s: ", filePath)
+		}
+		fmt.Fprintf(out, "Shared: %d, Exclusive: %d, Ratio: %.1f%%\n", shared, exclusive, ratio)
+	}
+}
+
+func sharedExclusiveBytes(filePath string, flags uint32) (shared, exclusive uint64, err error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to open file: %v", err)
+	}
+	defer file.Close()
+	if flags&fstools.FIEMAP_FLAG_SYNC != 0 {
+		if err := file.Sync(); err != nil {
+			return 0, 0, err
+		}
+	}
+	return fstools.SharedExclusiveBytes(file)
+}
+
+// printCompression prints the number of encoded (compressed) and plain
+// extents of each of paths, and the logical bytes they cover, in place of
+// the extent table. With more than one file, a combined total follows.
+func printCompression(paths []string, flags uint32) {
+	var total fstools.CompressionStats
+	for _, filePath := range paths {
+		s, err := compressionStats(filePath, flags)
+		if err != nil {
+			printErrorf("Error reading extents of %s: %v\n", filePath, err)
+			continue
+		}
+		total.Add(s)
+		fmt.Fprintln(out, "File:", filePath)
+		printCompressionStats(s)
+		fmt.Fprintln(out)
+	}
+	if len(paths) > 1 {
+		fmt.Fprintln(out, "Total:")
+		printCompressionStats(total)
+		fmt.Fprintln(out)
+	}
+	fmt.Fprintln(out, "Encoded lengths are logical (uncompressed) Bytes, since FIEMAP doesn't report the compressed size on disk.")
+}
+
+func printCompressionStats(s fstools.CompressionStats) {
+	var ratio float64
+	if extents := s.EncodedExtents + s.PlainExtents; extents > 0 {
+		ratio = float64(s.EncodedExtents) / float64(extents) * 100
+	}
+	fmt.Fprintln(out, "Encoded Extents        :", s.EncodedExtents)
+	fmt.Fprintln(out, "Plain Extents          :", s.PlainExtents)
+	fmt.Fprintf(out, "Encoded Ratio          : %.1f%%\n", ratio)
+	fmt.Fprintln(out, "Encoded Logical (Bytes):", s.EncodedBytes)
+	fmt.Fprintln(out, "Plain Logical   (Bytes):", s.PlainBytes)
+}
+
+func compressionStats(filePath string, flags uint32) (fstools.CompressionStats, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return fstools.CompressionStats{}, fmt.Errorf("failed to open file: %v", err)
+	}
+	defer file.Close()
+	return fstools.FiemapCompressionStats(file, flags)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"html"
+	"os"
+
+	"github.com/linux4life798/btrfs-optimize/fstools"
+)
+
+const (
+	svgWidth     = 1000
+	svgMargin    = 10
+	svgRowHeight = 40
+	svgBarHeight = 16
+)
+
+const (
+	svgColorUnshared  = "#3b82f6"
+	svgColorShared    = "#f59e0b"
+	svgColorUnwritten = "#9ca3af"
+)
+
+// svgExtentColor returns the fill color of an extent.
+func svgExtentColor(e *fstools.FiemapExtent) string {
+	switch {
+	case e.Flags&fstools.FIEMAP_EXTENT_UNWRITTEN != 0:
+		return svgColorUnwritten
+	case e.Flags&fstools.FIEMAP_EXTENT_SHARED != 0:
+		return svgColorShared
+	default:
+		return svgColorUnshared
+	}
+}
+
+// writeExtentSVG renders the extents of all filePaths to svgPath, with one
+// horizontal bar per file. Each extent is drawn at its physical offset,
+// using the same scale for all files, so that sharing and fragmentation
+// line up across files. Extents without a physical location are omitted.
+func writeExtentSVG(svgPath string, filePaths []string, flags uint32) {
+	type fileExtents struct {
+		path    string
+		extents []fstools.FiemapExtent
+	}
+
+	var files []fileExtents
+	var lo, hi uint64
+	first := true
+	for _, filePath := range filePaths {
+		extents, err := collectFileExtents(filePath, flags)
+		if err != nil {
+			printErrorf("Error reading extents of %s: %v\n", filePath, err)
+			continue
+		}
+		var located []fstools.FiemapExtent
+		for _, e := range extents {
+			if e.Flags&(fstools.FIEMAP_EXTENT_UNKNOWN|fstools.FIEMAP_EXTENT_DATA_INLINE) != 0 {
+				continue
+			}
+			located = append(located, e)
+			if first || e.Physical < lo {
+				lo = e.Physical
+			}
+			if first || e.Physical+e.Length > hi {
+				hi = e.Physical + e.Length
+			}
+			first = false
+		}
+		files = append(files, fileExtents{path: filePath, extents: located})
+	}
+
+	f, err := os.Create(svgPath)
+	if err != nil {
+		printErrorf("Error creating %s: %v\n", svgPath, err)
+		return
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+
+	barWidth := float64(svgWidth - 2*svgMargin)
+	scale := 0.0
+	if hi > lo {
+		scale = barWidth / float64(hi-lo)
+	}
+	height := svgRowHeight*(len(files)+1) + svgMargin
+
+	fmt.Fprintf(w, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" font-family="monospace" font-size="12">`+"\n", svgWidth, height)
+	for i, file := range files {
+		y := svgMargin + i*svgRowHeight
+		fmt.Fprintf(w, `<text x="%d" y="%d">%s</text>`+"\n", svgMargin, y+12, html.EscapeString(file.path))
+		fmt.Fprintf(w, `<rect x="%d" y="%d" width="%g" height="%d" fill="none" stroke="#e5e7eb"/>`+"\n", svgMargin, y+16, barWidth, svgBarHeight)
+		for _, e := range file.extents {
+			x := svgMargin + float64(e.Physical-lo)*scale
+			width := max(float64(e.Length)*scale, 1)
+			fmt.Fprintf(w,
+				`<rect x="%.2f" y="%d" width="%.2f" height="%d" fill="%s"><title>logical %d, physical %d, length %d</title></rect>`+"\n",
+				x, y+16, width, svgBarHeight, svgExtentColor(&e),
+				e.Logical, e.Physical, e.Length,
+			)
+		}
+	}
+
+	legendY := svgMargin + len(files)*svgRowHeight + 12
+	legend := []struct{ label, color string }{
+		{"unshared", svgColorUnshared},
+		{"shared", svgColorShared},
+		{"unwritten", svgColorUnwritten},
+	}
+	for i, l := range legend {
+		x := svgMargin + i*120
+		fmt.Fprintf(w, `<rect x="%d" y="%d" width="12" height="12" fill="%s"/>`+"\n", x, legendY-10, l.color)
+		fmt.Fprintf(w, `<text x="%d" y="%d">%s</text>`+"\n", x+16, legendY, l.label)
+	}
+	fmt.Fprintf(w, `<text x="%d" y="%d" text-anchor="end">physical %d - %d</text>`+"\n", svgWidth-svgMargin, legendY, lo, hi)
+	fmt.Fprintln(w, "</svg>")
+
+	if err := w.Flush(); err != nil {
+		printErrorf("Error writing %s: %v\n", svgPath, err)
+		return
+	}
+	fmt.Fprintf(out, "Wrote extent layout of %d files to %s\n", len(files), svgPath)
+}
@@ -7,23 +7,25 @@ package main
 // sudo btrfs filesystem du -s <file_path>
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"os/signal"
+	"runtime"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/linux4life798/btrfs-optimize/fstools"
+	"github.com/linux4life798/btrfs-optimize/hashcache"
 	"github.com/schollz/progressbar/v3"
 	"github.com/spf13/cobra"
 	"golang.org/x/sys/unix"
 )
 
-// Future SubCommands:
-//
-// hashcache build <path>  - Walk the path dir/file structure, hash files, and add them to cache, if needed.
-// hashcache prune         - Iterate through all items in cache and check if they exist and if the timestamp is valid.
-// hashcache purge         - Delete cache file.
-//
-// defrag <path>           - Defrag each file, but rebuild the shared/deduped file connections
-
 const (
 	Kibibyte uint64 = 1024
 	Mebibyte        = 1024 * Kibibyte
@@ -35,45 +37,491 @@ func fileSize(file *os.File) int64 {
 	// Get file stats to determine file size for deduplication
 	info, err := file.Stat()
 	if err != nil {
-		fmt.Printf("failed to get source file stat: %v", err)
+		fmt.Fprintf(os.Stderr, "failed to get source file stat: %v", err)
 	}
 	return info.Size()
 }
 
+// out is where all informational output is written.
+// It is discarded when the --quiet flag is given, leaving only errors,
+// which are always written to os.Stderr.
+var out io.Writer = os.Stdout
+
+// exitCode is the status the process exits with once the command finishes.
+var exitCode int
+
+// errorCount is the number of errors reported with printErrorf.
+var errorCount int
+
+// printErrorf writes an error message to os.Stderr and marks the run as
+// failed, so that the process exits with a non-zero status.
+// It is safe to call from multiple goroutines.
+func printErrorf(format string, a ...any) {
+	errorMu.Lock()
+	defer errorMu.Unlock()
+	fmt.Fprintf(os.Stderr, format, a...)
+	exitCode = 1
+	errorCount++
+}
+
+var errorMu sync.Mutex
+
+// ignoreErrors is set by the global --ignore-errors flag.
+var ignoreErrors bool
+
+// quiet is set by the global --quiet flag.
+var quiet bool
+
+// isTerminal reports whether f refers to a terminal.
+func isTerminal(f *os.File) bool {
+	_, err := unix.IoctlGetTermios(int(f.Fd()), unix.TCGETS)
+	return err == nil
+}
+
+// timeout is set by the global --timeout flag.
+var timeout time.Duration
+
+// timeoutCtx is the context of the running command when --timeout is given,
+// and cancelTimeout releases it.
+var timeoutCtx context.Context
+var cancelTimeout context.CancelFunc
+
+// exitTimeout is the status the process exits with when --timeout expires,
+// the same as timeout(1) uses.
+const exitTimeout = 124
+
+// interrupted reports whether err is the result of the command's context
+// ending, either by a signal or by --timeout.
+func interrupted(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// ioctlLogPath is set by the global --ioctl-log flag.
+var ioctlLogPath string
+var ioctlLogFile *os.File
+
 var rootCmd = &cobra.Command{
 	Use:   "btrfs-optimize",
 	Short: "A tool for file deduplication operations",
 	Long:  `A CLI tool that performs various file deduplication operations including deduplication and checking.`,
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		if quiet {
+			out = io.Discard
+		}
+		if timeout > 0 {
+			timeoutCtx, cancelTimeout = context.WithTimeout(cmd.Context(), timeout)
+			cmd.SetContext(timeoutCtx)
+		}
+		if ioctlLogPath != "" {
+			f, err := os.OpenFile(ioctlLogPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+			if err != nil {
+				return fmt.Errorf("failed to open ioctl log: %v", err)
+			}
+			ioctlLogFile = f
+			fstools.SetIoctlLogger(fstools.NewIoctlLogger(f))
+		}
+		return startProfiling()
+	},
+	PersistentPostRun: func(cmd *cobra.Command, args []string) {
+		if cancelTimeout != nil {
+			cancelTimeout()
+		}
+		if ioctlLogFile != nil {
+			ioctlLogFile.Close()
+		}
+		stopProfiling()
+	},
 }
 
 var dedupeCmd = &cobra.Command{
 	Use:   "dedupe <source-file> <target-file> [target-file...]",
 	Short: "Dedupe performs block deduplication between files",
-	Long:  `Dedupe is a subcommand that performs block deduplication between a source file and multiple target files.`,
-	Args:  cobra.MinimumNArgs(2),
-	Run:   runDedupe,
+	Long: `Dedupe is a subcommand that performs block deduplication between a source file and multiple target files.
+
+With --store, every file given is instead deduped against a single holding
+file that accumulates one copy of each unique block.
+
+With --manifest, no files are given on the command line. Instead, the
+source, target, offsets, and length of each range to dedupe are read from a
+JSON manifest of the form:
+
+  {"entries": [{"source": "a", "target": "b", "src_offset": 0, "dest_offset": 0, "length": 4096}]}
+
+With --mirror (or --recursive), a source and destination directory are given
+instead, and each file under the source directory is deduped against the
+file with the same relative path under the destination directory, if its
+size matches. Empty files are skipped, and so are source files missing from
+the destination directory, with a warning.
+
+With --auto, one or more directories are given instead. Every file under them
+is hashed with the --hash algorithm, xxhash by default, and each group of
+files with the same size and hash is deduped against the first file of the
+group, in sorted order. The kernel
+still compares the bytes, so a hash collision can't corrupt anything.
+
+With --src-offset and --length, only that range of the source is deduped,
+against the same range of each destination, or the range starting at
+--dest-offset, when given.`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if store, _ := cmd.Flags().GetString("store"); store != "" {
+			return cobra.MinimumNArgs(1)(cmd, args)
+		}
+		if manifest, _ := cmd.Flags().GetString("manifest"); manifest != "" {
+			return cobra.NoArgs(cmd, args)
+		}
+		if mirrorMode(cmd) {
+			return cobra.ExactArgs(2)(cmd, args)
+		}
+		if auto, _ := cmd.Flags().GetBool("auto"); auto {
+			return cobra.MinimumNArgs(1)(cmd, args)
+		}
+		return cobra.MinimumNArgs(2)(cmd, args)
+	},
+	Run: runDedupe,
 }
 
 var inspectCmd = &cobra.Command{
 	Use:   "inspect <file-path> [file-path...]",
 	Short: "Inspect deduplication status of files",
-	Long:  `Inspect is a subcommand that checks the deduplication status of one or more files.`,
-	Args:  cobra.MinimumNArgs(1),
-	Run:   runInspect,
+	Long: `Inspect is a subcommand that checks the deduplication status of one or more files.
+
+With --record, the extents and metadata of the files are saved to a JSON
+file instead, which --replay renders later without any files given, even on
+another machine.`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if replay, _ := cmd.Flags().GetString("replay"); replay != "" {
+			return cobra.NoArgs(cmd, args)
+		}
+		return cobra.MinimumNArgs(1)(cmd, args)
+	},
+	Run: runInspect,
 }
 
 func init() {
+	rootCmd.PersistentFlags().BoolVarP(&quiet, "quiet", "q", false, "Only print errors")
+	rootCmd.PersistentFlags().BoolVar(&ignoreErrors, "ignore-errors", false, "Keep walking directories past unreadable paths and summarize the errors at the end (exits 0 when combined with --quiet)")
+	rootCmd.PersistentFlags().DurationVar(&timeout, "timeout", 0, fmt.Sprintf("Stop the command cleanly once this much time has passed (e.g. 2h), exiting with status %d", exitTimeout))
+	rootCmd.PersistentFlags().StringVar(&ioctlLogPath, "ioctl-log", "", "Append a JSON line describing every FIEMAP, FIDEDUPERANGE, and FICLONERANGE ioctl to this file")
+
+	dedupeCmd.Flags().String("store", "", "Dedupe all files against this holding file, appending unique blocks to it")
+	dedupeCmd.Flags().Uint64("store-block-size", 128*Kibibyte, "Block size in Bytes used to hash and store blocks with --store, which must be a multiple of the filesystem block size")
+	dedupeCmd.Flags().String("max-rate", "", "Limit the average dedupe rate to this many Bytes per second (e.g. 50MiB)")
+	dedupeCmd.Flags().String("chunk-size", "", "Limit the number of Bytes requested by each dedupe ioctl (e.g. 16MiB), rounded down to a multiple of the block size")
+	dedupeCmd.Flags().String("checkpoint", "", "Save progress to this file periodically and if the dedupe is interrupted, and delete it once the dedupe completes")
+	dedupeCmd.Flags().Bool("resume", false, "Continue an interrupted dedupe from the --checkpoint file")
+	dedupeCmd.Flags().String("snapshot", "", "Dedupe against a temporary read-only snapshot of this subvolume, which must contain the source file")
+	dedupeCmd.Flags().Bool("allow-differs", false, "Don't treat destinations whose contents differ from the source as failures")
+	dedupeCmd.Flags().Bool("include-zero", false, "Punch holes over block aligned zero filled regions of all files before deduping")
+	dedupeCmd.Flags().Bool("mirror", false, "Dedupe each file under the first directory against the same relative path under the second")
+	dedupeCmd.Flags().BoolP("recursive", "r", false, "Same as --mirror")
+	dedupeCmd.Flags().Bool("auto", false, "Hash every file under the given directories and dedupe each group of identical files against its first member")
+	dedupeCmd.Flags().String("hash", fstools.DefaultHashAlgorithm, "With --auto, hash the files with this algorithm to find likely identical ones: "+hashAlgorithmList)
+	dedupeCmd.Flags().String("cache", hashcache.DefaultPath(), "With --auto, reuse the hashes of unchanged files from this hash cache file and add the new ones (empty to disable)")
+	dedupeCmd.Flags().Int("workers", runtime.NumCPU(), "With --auto, hash up to N files at once (the dedupes still run one at a time)")
+	dedupeCmd.Flags().Int("concurrency-per-device", 0, "With --mirror, dedupe up to N files at once on each device (0 = one file at a time overall)")
+	dedupeCmd.Flags().Bool("dry-run", false, "Compare the source and destinations in user space and report which would succeed, without deduping")
+	dedupeCmd.Flags().Bool("estimate", false, "Only estimate how many Bytes deduping would reclaim, from the extents of the files, without deduping")
+	dedupeCmd.Flags().Bool("largest-first", false, "Compare the files block by block and dedupe the longest matching ranges first, to keep shared extents large")
+	dedupeCmd.Flags().String("manifest", "", "Dedupe the ranges listed in this JSON manifest instead of whole files")
+	dedupeCmd.Flags().Duration("min-age", 0, "Skip destinations modified less than this long ago (e.g. 10m), since they may still be being written")
+	dedupeCmd.Flags().String("min-savings", "", "Skip destinations estimated to reclaim less than this many Bytes (e.g. 1MiB), to avoid extra metadata for tiny gains")
+	dedupeCmd.Flags().String("sync-mode", syncModeNone, syncModeUsage)
+	dedupeCmd.Flags().Bool("skip-holes", false, "Only request dedupe over the source's data extents, skipping its holes and unwritten extents, which are then not compared with the destinations")
+	dedupeCmd.Flags().Bool("trim-trailing-holes", false, "Only dedupe up to the end of the source's last data extent, skipping a sparse or preallocated tail")
+	dedupeCmd.Flags().BoolVar(&followSymlinks, "follow-symlinks", false, "Dedupe the files that symlinked source and destination paths point to, instead of refusing them")
+	dedupeCmd.Flags().Bool("preserve-timestamps", false, "Restore the access and modification times of the source and destination files after deduping")
+	dedupeCmd.Flags().Bool("report-sharing", false, "Print how many Bytes of each destination were shared with the source before and after deduping")
+	dedupeCmd.Flags().Bool("json", false, "Print the --report-sharing results as JSON, instead of any other output")
+	dedupeCmd.Flags().String("batch-report", "", "Write a CSV row summarizing each deduped source and its targets to this file, as the run progresses")
+	dedupeCmd.Flags().Bool("no-shared-check", false, "Always issue the dedupe, even for destinations whose extents are already shared with the source")
+	dedupeCmd.Flags().String("src-offset", "0", "Offset in Bytes of the range of the source to dedupe, which must be block aligned (e.g. 1GiB)")
+	dedupeCmd.Flags().String("length", "0", "Length in Bytes of the range to dedupe, or 0 for up to the end of the source")
+	dedupeCmd.Flags().String("dest-offset", "", "Offset in Bytes to dedupe the range at in every destination, which must be block aligned (default is --src-offset)")
+	dedupeCmd.Flags().Bool("auto-align", false, "Shrink misaligned ranges, given by the range flags or --manifest, to their block aligned portion instead of rejecting them")
 	rootCmd.AddCommand(dedupeCmd)
 
 	inspectCmd.Flags().BoolP("sync", "s", false, "Sync the file to disk before requeting the extents map")
+	inspectCmd.Flags().String("sync-mode", syncModeNone, syncModeUsage+" (--sync is the same as file)")
 	inspectCmd.Flags().BoolP("bytes", "b", false, "Print offsets and lengths in Bytes instead of Blocks")
 	inspectCmd.Flags().BoolP("fast", "f", false, "Disable pretty print features to speed up runtime")
+	inspectCmd.Flags().String("raw", "", "Dump every field of each extent unprocessed, as text (--raw) or json (--raw=json)")
+	inspectCmd.Flags().Lookup("raw").NoOptDefVal = "text"
+	inspectCmd.Flags().Bool("json", false, "Print the extents of all files as a JSON array, with offsets and lengths in Bytes (cannot be combined with --bytes or --fast)")
+	inspectCmd.Flags().Bool("csv", false, "Print the extents of all files as CSV rows of file, extent_index, logical, physical, length, flags, and the unit (blocks, or bytes with --bytes or for unaligned extents)")
+	inspectCmd.Flags().Bool("count", false, "Only print the number of extents of each file, prefixed by its path when there are several")
+	inspectCmd.Flags().Bool("stats", false, "Print the extent count, mapped and shared extents, holes, and largest and smallest extent of each file instead of the extent table")
+	inspectCmd.Flags().Bool("sharing", false, "Print the Bytes of each file in shared and in exclusive extents, and the shared ratio, instead of the extent table")
+	inspectCmd.Flags().Bool("compression", false, "Print the number of encoded (compressed) and plain extents of each file, their ratio, and the logical Bytes each covers, instead of the extent table")
+	inspectCmd.Flags().Bool("shared-only", false, "Only list the extents flagged as shared in the extent table or --csv, keeping their indices (cannot be combined with --head or --tail)")
+	inspectCmd.Flags().Bool("summary", false, "Print a summary of each file instead of the extent table")
+	inspectCmd.Flags().Bool("devices", false, "Map each extent to its btrfs device and on-device offset (requires root)")
+	inspectCmd.Flags().Bool("refs", false, "Count the references to each extent, which also reveals partial sharing (btrfs only, requires root)")
+	inspectCmd.Flags().Bool("xattr", false, "Include the extents of extended attributes in --summary and --total (not supported by btrfs)")
+	inspectCmd.Flags().Bool("group-by-flags", false, "Print the number and total length of extents for each combination of flags")
+	inspectCmd.Flags().Bool("gaps", false, "Print a histogram of the physical seek distances between consecutive extents")
+	inspectCmd.Flags().Bool("total", false, "Print a combined summary of all files when more than one is given")
+	inspectCmd.Flags().String("save-baseline", "", "Save the extents of all files to this JSON file for later use with --delta")
+	inspectCmd.Flags().String("record", "", "Save the extents and metadata of all files to this JSON file, for rendering later with --replay")
+	inspectCmd.Flags().String("replay", "", "Render the extent table, --summary, or --total from a file saved with --record, instead of inspecting files")
+	inspectCmd.Flags().String("delta", "", "Compare the current extents against a baseline saved with --save-baseline")
+	inspectCmd.Flags().String("offset", "", "Only show extents from this logical offset on, in Blocks (or Bytes with --bytes) unless a unit like 1G is given")
+	inspectCmd.Flags().String("length", "", "Only show extents within this many Blocks (or Bytes with --bytes) of --offset, unless a unit like 1G is given")
+	inspectCmd.Flags().Int("head", 0, "Only print the first N extents of each file")
+	inspectCmd.Flags().Int("tail", 0, "Only print the last N extents of each file")
+	inspectCmd.Flags().String("svg", "", "Render the physical layout of the extents of all files to this SVG file")
+	inspectCmd.Flags().BoolP("recursive", "r", false, "Inspect all regular files found under the given directories")
+	inspectCmd.Flags().Int("max-depth", -1, "Limit how many directories below each path --recursive descends (0 = only top directory, -1 = unlimited)")
 	rootCmd.AddCommand(inspectCmd)
 }
 
+// noSpaceHint explains the ENOSPC that btrfs returns when it has no
+// metadata space left to record deduped extents.
+const noSpaceHint = "Dedupe needs free btrfs metadata space, even though it frees data space. " +
+	"Check \"btrfs filesystem usage\", and free up chunks for metadata with a filtered balance, like \"btrfs balance start -dusage=10 <mount>\"."
+
+// mirrorMode reports whether dedupe was given --mirror, or its alias
+// --recursive.
+func mirrorMode(cmd *cobra.Command) bool {
+	mirror, _ := cmd.Flags().GetBool("mirror")
+	recursive, _ := cmd.Flags().GetBool("recursive")
+	return mirror || recursive
+}
+
+// dedupeMode returns the name of the flag selecting a dedupe mode other
+// than deduping a source into its destinations, in the order runDedupe
+// checks them, or "" for none.
+func dedupeMode(cmd *cobra.Command) string {
+	if store, _ := cmd.Flags().GetString("store"); store != "" {
+		return "store"
+	}
+	if manifest, _ := cmd.Flags().GetString("manifest"); manifest != "" {
+		return "manifest"
+	}
+	if auto, _ := cmd.Flags().GetBool("auto"); auto {
+		return "auto"
+	}
+	if mirrorMode(cmd) {
+		return "mirror"
+	}
+	if largestFirst, _ := cmd.Flags().GetBool("largest-first"); largestFirst {
+		return "largest-first"
+	}
+	return ""
+}
+
 func runDedupe(cmd *cobra.Command, args []string) {
+	// A dry run or an estimate must never issue a dedupe, so the modes that
+	// don't support them are rejected before any of them runs.
+	mode := dedupeMode(cmd)
+	dryRun, _ := cmd.Flags().GetBool("dry-run")
+	if dryRun && mode != "" {
+		printErrorf("Error: --dry-run cannot be combined with --%s\n", mode)
+		return
+	}
+	estimate, _ := cmd.Flags().GetBool("estimate")
+	if estimate && mode != "" && mode != "mirror" {
+		printErrorf("Error: --estimate cannot be combined with --%s\n", mode)
+		return
+	}
+
+	if store, _ := cmd.Flags().GetString("store"); store != "" {
+		blockSize, _ := cmd.Flags().GetUint64("store-block-size")
+		runDedupeStore(store, blockSize, args)
+		return
+	}
+
+	var opts fstools.FileDedupeRangeOptions
+	if maxRate, _ := cmd.Flags().GetString("max-rate"); maxRate != "" {
+		rate, err := ParseSize(maxRate)
+		if err != nil {
+			printErrorf("Error parsing --max-rate: %v\n", err)
+			return
+		}
+		opts.MaxRate = rate
+	}
+	if chunkSize, _ := cmd.Flags().GetString("chunk-size"); chunkSize != "" {
+		size, err := ParseSize(chunkSize)
+		if err != nil {
+			printErrorf("Error parsing --chunk-size: %v\n", err)
+			return
+		}
+		if size == 0 {
+			printErrorf("Error: --chunk-size must be greater than zero\n")
+			return
+		}
+		opts.ChunkSize = size
+	}
+
+	ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var report *batchReport
+	if reportPath, _ := cmd.Flags().GetString("batch-report"); reportPath != "" {
+		var err error
+		report, err = openBatchReport(reportPath)
+		if err != nil {
+			printErrorf("Error creating batch report: %v\n", err)
+			return
+		}
+		defer report.Close()
+	}
+
+	if manifest, _ := cmd.Flags().GetString("manifest"); manifest != "" {
+		autoAlign, _ := cmd.Flags().GetBool("auto-align")
+		runDedupeManifest(ctx, manifest, autoAlign, opts, report)
+		return
+	}
+	if auto, _ := cmd.Flags().GetBool("auto"); auto {
+		noSharedCheck, _ := cmd.Flags().GetBool("no-shared-check")
+		algorithm, _ := cmd.Flags().GetString("hash")
+		cachePath, _ := cmd.Flags().GetString("cache")
+		workers, _ := cmd.Flags().GetInt("workers")
+		runDedupeAuto(ctx, args, algorithm, cachePath, workers, fstools.DedupeOptions{
+			MaxRate:       opts.MaxRate,
+			ChunkSize:     opts.ChunkSize,
+			NoSharedCheck: noSharedCheck,
+		}, report)
+		return
+	}
+	if mirrorMode(cmd) {
+		noSharedCheck, _ := cmd.Flags().GetBool("no-shared-check")
+		perDevice, _ := cmd.Flags().GetInt("concurrency-per-device")
+		runDedupeMirror(ctx, args[0], args[1], fstools.DedupeOptions{
+			MaxRate:       opts.MaxRate,
+			ChunkSize:     opts.ChunkSize,
+			NoSharedCheck: noSharedCheck,
+		}, perDevice, estimate, report)
+		return
+	}
+
 	sourceFile := args[0]
 	destinationFiles := args[1:]
+	if estimate {
+		runDedupeEstimate(sourceFile, destinationFiles)
+		return
+	}
+	if largestFirst, _ := cmd.Flags().GetBool("largest-first"); largestFirst {
+		runDedupeLargestFirst(ctx, sourceFile, destinationFiles, opts)
+		return
+	}
+
+	// With --json, only the sharing report is written to the output.
+	reportSharing, _ := cmd.Flags().GetBool("report-sharing")
+	asJSON, _ := cmd.Flags().GetBool("json")
+	if asJSON && !reportSharing {
+		printErrorf("Error: --json requires --report-sharing\n")
+		return
+	}
+	reportOut := out
+	if asJSON {
+		out = io.Discard
+	}
+
+	checkpointPath, _ := cmd.Flags().GetString("checkpoint")
+	resume, _ := cmd.Flags().GetBool("resume")
+
+	var rangeArgs [3]uint64
+	for i, name := range []string{"src-offset", "length", "dest-offset"} {
+		if !cmd.Flags().Changed(name) {
+			continue
+		}
+		if resume {
+			printErrorf("Error: --%s cannot be combined with --resume, since the checkpoint records the range\n", name)
+			return
+		}
+		str, _ := cmd.Flags().GetString(name)
+		n, err := ParseSize(str)
+		if err != nil {
+			printErrorf("Error parsing --%s: %v\n", name, err)
+			return
+		}
+		rangeArgs[i] = n
+	}
+	srcOffset, length, destOffset := rangeArgs[0], rangeArgs[1], rangeArgs[2]
+	if !cmd.Flags().Changed("dest-offset") {
+		destOffset = srcOffset
+	}
+	allowDiffers, _ := cmd.Flags().GetBool("allow-differs")
+	if resume && checkpointPath == "" {
+		printErrorf("Error: --resume requires --checkpoint\n")
+		return
+	}
+
+	// A dry run takes the same steps as the dedupe, but only compares the
+	// ranges, so nothing that changes the files may be combined with it.
+	if dryRun && checkpointPath != "" {
+		printErrorf("Error: --dry-run cannot be combined with --checkpoint\n")
+		return
+	}
+	opts.DryRun = dryRun
+
+	// The timestamps are restored after everything else, including closing
+	// the files and deleting any snapshot.
+	if preserve, _ := cmd.Flags().GetBool("preserve-timestamps"); preserve {
+		saved, err := saveFileTimes(args)
+		if err != nil {
+			printErrorf("Error saving timestamps: %v\n", err)
+			return
+		}
+		defer restoreFileTimes(saved)
+	}
+
+	snapshot, _ := cmd.Flags().GetString("snapshot")
+	if snapshot != "" && checkpointPath != "" {
+		printErrorf("Error: --snapshot cannot be combined with --checkpoint, since the snapshot is deleted afterwards\n")
+		return
+	}
+
+	includeZero, _ := cmd.Flags().GetBool("include-zero")
+	if includeZero && dryRun {
+		printErrorf("Error: --include-zero cannot be combined with --dry-run, since punching holes modifies the files\n")
+		return
+	}
+	if includeZero && resume {
+		printErrorf("Error: --include-zero cannot be combined with --resume, since punching holes modifies the files\n")
+		return
+	}
+	// Holes are punched before switching to any snapshot, since its copy of
+	// the source is read-only. The snapshot then captures the punched file.
+	var bytesPunched uint64
+	if includeZero {
+		for _, filePath := range append([]string{sourceFile}, destinationFiles...) {
+			punched, err := punchZeroRanges(filePath)
+			if err != nil {
+				printErrorf("Error punching zero filled holes in %s: %v\n", filePath, err)
+			}
+			bytesPunched += punched
+		}
+	}
+
+	if snapshot != "" {
+		snapshotSource, cleanup, err := createSourceSnapshot(snapshot, sourceFile)
+		if err != nil {
+			printErrorf("Error: %v\n", err)
+			return
+		}
+		defer cleanup()
+		fmt.Fprintln(out, "Using read-only snapshot source:", snapshotSource)
+		sourceFile = snapshotSource
+	}
+
+	syncMode, _ := cmd.Flags().GetString("sync-mode")
+	if err := validateSyncMode(syncMode); err != nil {
+		printErrorf("Error: %v\n", err)
+		return
+	}
+	allFiles := append([]string{sourceFile}, destinationFiles...)
+	var err error
+	switch syncMode {
+	case syncModeFile:
+		err = syncFiles(allFiles)
+	case syncModeFS:
+		err = syncFilesystems(allFiles)
+	}
+	if err != nil {
+		printErrorf("Error syncing: %v\n", err)
+		return
+	}
 
 	// Testing shows that when you call the ioctl teh max deduped file size
 	// in bytes is 1GiB, but you can still ask for the whole file.
@@ -81,88 +529,412 @@ func runDedupe(cmd *cobra.Command, args []string) {
 	//  log.Fatalf("Error: %v\n", err)
 	// }
 
-	srcFile, err := os.Open(sourceFile)
+	srcFile, err := openSource(sourceFile)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error opening source file: %v\n", err)
+		printErrorf("Error opening source file: %v\n", err)
 		return
 	}
 	defer srcFile.Close()
 
-	srcInfo, err := srcFile.Stat()
+	srcState, err := fdFileState(sourceFile, int(srcFile.Fd()))
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error getting source file info: %v\n", err)
+		printErrorf("Error getting source file info: %v\n", err)
+		return
+	}
+	// The kernel only reports EINVAL for inline files, so they are
+	// rejected up front with a clearer message.
+	if inline, err := fstools.HasInlineData(srcFile, 0); err == nil && inline {
+		printErrorf("Error: source %s: %v\n", sourceFile, fstools.ErrInlineData)
 		return
 	}
 
+	srcSize := uint64(srcState.Size)
+	if length == 0 && srcOffset <= srcSize {
+		length = srcSize - srcOffset
+	}
+
+	blkSize, err := fstools.FileBlockSize(srcFile)
+	if err != nil {
+		printErrorf("Error getting source block size: %v\n", err)
+		return
+	}
+	if autoAlign, _ := cmd.Flags().GetBool("auto-align"); autoAlign {
+		var skipped uint64
+		srcOffset, destOffset, length, skipped, err = fstools.AutoAlignRange(srcOffset, destOffset, length, srcSize, blkSize)
+		if err != nil {
+			printErrorf("Error: %v\n", err)
+			return
+		}
+		if skipped > 0 {
+			fmt.Fprintf(out, "Aligned the range to source offset %d and length %d Bytes, skipping %d misaligned Bytes.\n", srcOffset, length, skipped)
+		}
+	}
+	// Misaligned ranges are rejected up front, since the kernel only
+	// reports them with a generic EINVAL.
+	if err := fstools.CheckRangeAlignment(srcOffset, destOffset, length, srcSize, blkSize); err != nil {
+		printErrorf("Error: %v\n", err)
+		return
+	}
+	checkpoint := &dedupeCheckpoint{
+		Source:    srcState,
+		SrcOffset: srcOffset,
+		SrcLength: length,
+		Targets:   make([]checkpointTarget, len(destinationFiles)),
+	}
+	if trim, _ := cmd.Flags().GetBool("trim-trailing-holes"); trim && !resume {
+		dataEnd, err := fstools.DataEnd(srcFile, 0)
+		if err != nil {
+			printErrorf("Error finding the end of the source data: %v\n", err)
+			return
+		}
+		// The data end is block aligned, so it is only used when it ends
+		// before the range does.
+		if end := checkpoint.SrcOffset + checkpoint.SrcLength; dataEnd < end {
+			trimmed := dataEnd - min(dataEnd, checkpoint.SrcOffset)
+			fmt.Fprintf(out, "Trimmed source length from %d to %d Bytes, skipping its trailing hole.\n", checkpoint.SrcLength, trimmed)
+			checkpoint.SrcLength = trimmed
+		}
+	}
+	if skipHoles, _ := cmd.Flags().GetBool("skip-holes"); skipHoles {
+		ranges, err := fstools.DataRanges(srcFile, 0)
+		if err != nil {
+			printErrorf("Error finding the data ranges of the source: %v\n", err)
+			return
+		}
+		// A nil list would dedupe everything, instead of nothing.
+		if ranges == nil {
+			ranges = []fstools.Range{}
+		}
+		opts.DataRanges = ranges
+	}
+	if resume {
+		checkpoint, err = loadDedupeCheckpoint(checkpointPath)
+		if err != nil {
+			printErrorf("Error loading checkpoint: %v\n", err)
+			return
+		}
+		if err := checkpoint.Source.matches(srcState); err != nil {
+			printErrorf("Error resuming: %v\n", err)
+			return
+		}
+		if len(checkpoint.Targets) != len(destinationFiles) {
+			printErrorf("Error resuming: checkpoint has a different number of destination files\n")
+			return
+		}
+	}
+
+	// The source length is set to the longest of the destination lengths
+	// below.
 	value := &unix.FileDedupeRange{
-		Src_offset: 0,
-		Src_length: uint64(srcInfo.Size()),
-		Info:       make([]unix.FileDedupeRangeInfo, len(destinationFiles)),
+		Src_offset: checkpoint.SrcOffset,
+	}
+
+	// Destinations that already share all of their extents with the source
+	// are skipped, unless the check is disabled, which is useful when
+	// FIEMAP's view can't be trusted.
+	var srcExtents []fstools.FiemapExtent
+	if noSharedCheck, _ := cmd.Flags().GetBool("no-shared-check"); !noSharedCheck {
+		srcExtents, err = fstools.CollectExtents(srcFile, 0)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: skipping the already shared check: %v\n", err)
+			srcExtents = nil
+		}
 	}
 
+	// The active list maps each entry of value.Info back to its index in
+	// destinationFiles, since destinations that already failed before a
+	// resume are not retried.
+	var active []int
+	dests := make([]*os.File, len(destinationFiles))
+	minAge, _ := cmd.Flags().GetDuration("min-age")
+	var skippedForAge int
+	var minSavings uint64
+	if minSavingsStr, _ := cmd.Flags().GetString("min-savings"); minSavingsStr != "" {
+		minSavings, err = ParseSize(minSavingsStr)
+		if err != nil {
+			printErrorf("Error parsing --min-savings: %v\n", err)
+			return
+		}
+	}
+	var skippedForSavings int
 	for i, destFile := range destinationFiles {
-		destFd, err := unix.Open(destFile, unix.O_RDONLY, 0)
+		dest, err := openTarget(destFile, dedupeTargetAccess)
+		if err != nil {
+			printErrorf("Error opening destination file %s: %v\n", destFile, err)
+			return
+		}
+		defer dest.Close()
+		dests[i] = dest
+		destFd := int(dest.Fd())
+
+		destState, err := fdFileState(destFile, destFd)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error opening destination file %s: %v\n", destFile, err)
+			printErrorf("Error getting destination file info %s: %v\n", destFile, err)
 			return
 		}
-		defer unix.Close(destFd)
+		if resume {
+			if err := checkpoint.Targets[i].matches(destState); err != nil {
+				printErrorf("Error resuming: %v\n", err)
+				return
+			}
+			if checkpoint.Targets[i].Status != unix.FILE_DEDUPE_RANGE_SAME {
+				checkpoint.Targets[i].Skipped = fstools.SkipPreviouslyFailed
+				continue
+			}
+			if checkpoint.Targets[i].Skipped != fstools.SkipNone || checkpoint.Targets[i].DestOffset >= checkpoint.Targets[i].DestEnd {
+				// Skipped by the interrupted run, or a shorter
+				// destination whose common prefix with the source was
+				// already deduped.
+				continue
+			}
+		} else {
+			checkpoint.Targets[i].checkpointFile = destState
+			checkpoint.Targets[i].DestOffset = destOffset
+		}
+
+		if minAge > 0 && time.Since(time.Unix(0, destState.MtimeNs)) < minAge {
+			fmt.Fprintf(out, "Destination %s was modified less than %v ago, skipped.\n", destFile, minAge)
+			checkpoint.Targets[i].Skipped = fstools.SkipTooRecent
+			skippedForAge++
+			continue
+		}
+
+		if inline, err := fstools.HasInlineData(dest, 0); err == nil && inline {
+			fmt.Fprintf(out, "Destination %s: %v, skipped.\n", destFile, fstools.ErrInlineData)
+			checkpoint.Targets[i].Skipped = fstools.SkipInline
+			continue
+		}
 
-		value.Info[i] = unix.FileDedupeRangeInfo{
+		if srcExtents != nil {
+			destExtents, err := fstools.CollectExtents(dest, 0)
+			if err == nil && fstools.AlreadySharedRange(srcExtents, checkpoint.SrcOffset, destExtents, checkpoint.Targets[i].DestOffset, checkpoint.SrcLength) {
+				fmt.Fprintf(out, "Destination %s is already shared with the source, skipped.\n", destFile)
+				checkpoint.Targets[i].Skipped = fstools.SkipAlreadyShared
+				continue
+			}
+		}
+
+		// Only the prefix that the source and destination have in common
+		// is deduped. It must be block aligned, unless it runs to the end
+		// of both files. A resume continues up to the end recorded by the
+		// interrupted run.
+		destOffset := checkpoint.Targets[i].DestOffset
+		destLength := checkpoint.SrcLength
+		if resume {
+			destLength = min(destLength, checkpoint.Targets[i].DestEnd-destOffset)
+		} else {
+			if destSize := uint64(destState.Size); destOffset+destLength > destSize {
+				destLength = destSize - min(destOffset, destSize)
+			}
+			if checkpoint.SrcOffset+destLength != uint64(srcState.Size) || destOffset+destLength != uint64(destState.Size) {
+				destLength = fstools.AlignDown(destLength, blkSize)
+			}
+			checkpoint.Targets[i].DestEnd = destOffset + destLength
+		}
+		if destLength == 0 {
+			fmt.Fprintf(out, "Destination %s has no whole block in common with the source, nothing to dedupe.\n", destFile)
+			continue
+		}
+		if destLength != checkpoint.SrcLength {
+			fmt.Fprintf(out, "Destination %s differs in size from the source, deduping only the first %d Bytes.\n", destFile, destLength)
+		}
+
+		if minSavings > 0 {
+			e, err := estimateFileSavings(srcFile, dest)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: can't estimate the savings for %s, deduping anyway: %v\n", destFile, err)
+			} else if e.Reclaimable < minSavings {
+				fmt.Fprintf(out, "Destination %s would only reclaim %d Bytes, skipped.\n", destFile, e.Reclaimable)
+				checkpoint.Targets[i].Skipped = fstools.SkipLowSavings
+				skippedForSavings++
+				continue
+			}
+		}
+
+		active = append(active, i)
+		opts.DestLengths = append(opts.DestLengths, destLength)
+		value.Src_length = max(value.Src_length, destLength)
+		value.Info = append(value.Info, unix.FileDedupeRangeInfo{
 			Dest_fd:     int64(destFd),
-			Dest_offset: 0,
+			Dest_offset: checkpoint.Targets[i].DestOffset,
+		})
+	}
+
+	if skippedForAge > 0 {
+		fmt.Fprintf(out, "Skipped %d destinations modified less than %v ago.\n", skippedForAge, minAge)
+	}
+	if skippedForSavings > 0 {
+		fmt.Fprintf(out, "Skipped %d destinations that would reclaim less than %d Bytes.\n", skippedForSavings, minSavings)
+	}
+
+	var sharing []sharingChange
+	if reportSharing {
+		sharing = make([]sharingChange, len(destinationFiles))
+		for i := range sharing {
+			sharing[i].Path = destinationFiles[i]
 		}
+		measureSharing(sharing, srcFile, dests, false)
 	}
 
-	progressBar := progressbar.DefaultBytes(
-		srcInfo.Size(),
-		"deduping",
-	)
-	progress := func(bytesDeduped, bytesLength uint64, exit bool) {
-		if exit {
-			progressBar.Exit()
-			return
+	needsDedupe := len(value.Info) > 0 && value.Src_length > 0
+	if !quiet && !asJSON && needsDedupe {
+		description := "deduping"
+		if dryRun {
+			description = "comparing"
+		}
+		progressBar := progressbar.DefaultBytes(
+			int64(value.Src_length),
+			description,
+		)
+		opts.Progress = func(bytesDeduped, bytesLength uint64, exit bool) {
+			if exit {
+				progressBar.Exit()
+				return
+			}
+			progressBar.Set64(int64(bytesDeduped))
+			// fmt.Printf("Deduped %d of %d bytes (%.2f%%)\n", bytesDeduped, bytesLength, float64(bytesDeduped)/float64(bytesLength)*100)
 		}
-		progressBar.Set64(int64(bytesDeduped))
-		// fmt.Printf("Deduped %d of %d bytes (%.2f%%)\n", bytesDeduped, bytesLength, float64(bytesDeduped)/float64(bytesLength)*100)
 	}
 
-	err = fstools.FileDedupeRangeFull(int(srcFile.Fd()), value, progress)
+	// Skipped holes are tracked, so that they aren't reported as deduped.
+	if opts.DataRanges != nil {
+		opts.BytesSkipped = make([]uint64, len(value.Info))
+	}
+	if needsDedupe && checkpointPath != "" {
+		opts.Checkpoint = checkpoint.periodicSaver(checkpointPath, active, value, opts.BytesSkipped)
+	}
+	if needsDedupe {
+		err = fstools.FileDedupeRangeFullWithOptions(ctx, int(srcFile.Fd()), value, opts)
+	}
+	if interrupted(err) {
+		checkpoint.update(active, value.Info, opts.BytesSkipped)
+		if checkpointPath == "" {
+			printErrorf("Deduplication interrupted.\n")
+			return
+		}
+		if err := checkpoint.save(checkpointPath); err != nil {
+			printErrorf("Deduplication interrupted, but saving the checkpoint failed: %v\n", err)
+			return
+		}
+		printErrorf(
+			"Deduplication interrupted at source offset %d. Rerun with --resume to continue.\n",
+			checkpoint.SrcOffset,
+		)
+		return
+	}
+	var noSpace *fstools.NoSpaceError
+	if errors.As(err, &noSpace) {
+		checkpoint.update(active, value.Info, opts.BytesSkipped)
+		printErrorf(
+			"Error: the filesystem ran out of space after deduping %d of %d Bytes.\n%s\n",
+			noSpace.Deduped,
+			value.Src_length,
+			noSpaceHint,
+		)
+		if checkpointPath != "" {
+			if err := checkpoint.save(checkpointPath); err != nil {
+				printErrorf("Saving the checkpoint failed: %v\n", err)
+				return
+			}
+			printErrorf("Rerun with --resume to continue from source offset %d.\n", checkpoint.SrcOffset)
+		}
+		return
+	}
 	if err == unix.EOPNOTSUPP {
+		printErrorf("deduplication not supported on this filesystem\n")
+		return
+	}
+	if err == unix.EINVAL {
+		// could be that the offsets are not block size aligned
+		printErrorf("arguments are incompatible or deduplication not supported on this filesystem\n")
+		return
+	}
+	if err != nil {
+		printErrorf("Error during deduplication: %v\n", err)
+		return
+	}
+	checkpoint.update(active, value.Info, opts.BytesSkipped)
+	// Nothing is left to resume, so a checkpoint saved along the way, or by
+	// an earlier interrupted run, is removed.
+	if checkpointPath != "" {
+		if err := os.Remove(checkpointPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			printErrorf("Error removing checkpoint: %v\n", err)
+		}
+	}
+
+	// Deduplication against a source that is being written to is likely to
+	// fail part way through with DIFFERS or dedupe stale data.
+	if state, err := fdFileState(sourceFile, int(srcFile.Fd())); err == nil && srcState.matches(state) != nil {
 		fmt.Fprintln(
 			os.Stderr,
-			"deduplication not supported on this filesystem",
+			"Warning: the source file changed during deduplication. Consider using a read-only snapshot as the source (see --snapshot).",
 		)
-		return
 	}
-	if err == unix.EINVAL {
+	// Everything above only used the open source fd, so unlinking the source
+	// part way through is harmless, but it is worth pointing out.
+	var srcStat unix.Stat_t
+	if err := unix.Fstat(int(srcFile.Fd()), &srcStat); err == nil && srcStat.Nlink == 0 {
 		fmt.Fprintln(
 			os.Stderr,
-			// could be that the offsets are not block size aligned
-			"arguments are incompatible or deduplication not supported on this filesystem",
+			"Warning: the source file was deleted during deduplication. The dedupe completed against the still open file.",
 		)
-		return
 	}
-	if err != nil {
-		fmt.Fprintln(os.Stderr, "Error during deduplication:", err)
+
+	if dryRun {
+		printDryRun(destinationFiles, checkpoint.Targets, allowDiffers)
 		return
 	}
 
+	if reportSharing {
+		measureSharing(sharing, srcFile, dests, true)
+		printSharingChanges(reportOut, sharing, asJSON)
+	}
+
+	row := batchReportRow{Source: sourceFile, Targets: len(checkpoint.Targets)}
 	var errorSeen bool
-	for i, info := range value.Info {
-		if info.Status != unix.FILE_DEDUPE_RANGE_SAME {
-			fmt.Fprintf(
-				os.Stderr,
+	var deduped int
+	for i := range checkpoint.Targets {
+		target := &checkpoint.Targets[i]
+		row.BytesDeduped += target.BytesDeduped
+		// Targets that differ or fail part way through keep what was
+		// deduped before they stopped, so that is reported too.
+		if target.Skipped == fstools.SkipNone {
+			deduped++
+			fmt.Fprintf(out, "Destination %s: deduped %s\n", destinationFiles[i], FormatSizeFixed(target.BytesDeduped))
+		}
+		if target.Status == unix.FILE_DEDUPE_RANGE_DIFFERS && allowDiffers {
+			fmt.Fprintf(out, "Destination %s differs, skipped.\n", destinationFiles[i])
+			target.Skipped = fstools.SkipDiffers
+		}
+		switch {
+		case target.Skipped != fstools.SkipNone:
+			row.Skipped++
+		case target.Status != unix.FILE_DEDUPE_RANGE_SAME:
+			printErrorf(
 				"Destination %s failed with %s.\n",
 				destinationFiles[i],
-				fstools.FileDedupeRangeStatusToString(info.Status),
+				fstools.FileDedupeRangeStatusToString(target.Status),
 			)
+			if target.Status == -int32(unix.ENOSPC) {
+				printErrorf("%s\n", noSpaceHint)
+			}
 			errorSeen = true
+			row.Failed++
+		default:
+			row.Deduped++
 		}
 	}
+	if err := report.Add(row); err != nil {
+		printErrorf("Error writing batch report: %v\n", err)
+	}
+
+	if includeZero {
+		fmt.Fprintln(out, "Punched (Bytes):", bytesPunched)
+	}
+	fmt.Fprintf(out, "Deduped %s (%d Bytes) across %d destinations.\n", FormatSizeFixed(row.BytesDeduped), row.BytesDeduped, deduped)
 
 	if !errorSeen {
-		fmt.Println("Deduplication completed successfully.")
+		fmt.Fprintln(out, "Deduplication completed successfully.")
 	}
 }
 
@@ -170,19 +942,348 @@ func runInspect(cmd *cobra.Command, args []string) {
 	syncFirst, _ := cmd.Flags().GetBool("sync")
 	useBytes, _ := cmd.Flags().GetBool("bytes")
 	faster, _ := cmd.Flags().GetBool("fast")
+	summary, _ := cmd.Flags().GetBool("summary")
+	total, _ := cmd.Flags().GetBool("total")
+	devices, _ := cmd.Flags().GetBool("devices")
+	refs, _ := cmd.Flags().GetBool("refs")
+	gaps, _ := cmd.Flags().GetBool("gaps")
+	groupByFlags, _ := cmd.Flags().GetBool("group-by-flags")
+	offsetStr, _ := cmd.Flags().GetString("offset")
+	lengthStr, _ := cmd.Flags().GetString("length")
+	recursive, _ := cmd.Flags().GetBool("recursive")
+	maxDepth, _ := cmd.Flags().GetInt("max-depth")
+	xattrs, _ := cmd.Flags().GetBool("xattr")
+	head, _ := cmd.Flags().GetInt("head")
+	tail, _ := cmd.Flags().GetInt("tail")
+	if head < 0 || tail < 0 {
+		printErrorf("Error: --head and --tail must not be negative\n")
+		return
+	}
+	if head > 0 && tail > 0 {
+		printErrorf("Error: --head cannot be combined with --tail\n")
+		return
+	}
+	// The head and tail are picked before filtering, so they could show
+	// any number of shared extents.
+	var match uint32
+	if sharedOnly, _ := cmd.Flags().GetBool("shared-only"); sharedOnly {
+		if head > 0 || tail > 0 {
+			printErrorf("Error: --shared-only cannot be combined with --head or --tail\n")
+			return
+		}
+		match = fstools.FIEMAP_EXTENT_SHARED
+	}
+
+	if replayPath, _ := cmd.Flags().GetString("replay"); replayPath != "" {
+		replayRecording(replayPath, head, tail, useBytes, faster, summary, total)
+		return
+	}
 
+	syncMode, _ := cmd.Flags().GetString("sync-mode")
+	if syncFirst && !cmd.Flags().Changed("sync-mode") {
+		syncMode = syncModeFile
+	}
+	if err := validateSyncMode(syncMode); err != nil {
+		printErrorf("Error: %v\n", err)
+		return
+	}
+	syncFirst = syncMode == syncModeFile
+
+	var flags uint32
+	if syncFirst {
+		flags |= fstools.FIEMAP_FLAG_SYNC
+	}
+
+	args, err := expandPaths(cmd.Context(), args, recursive, maxDepth)
+	if err != nil {
+		printErrorf("Error walking directory: %v\n", err)
+		return
+	}
+	if syncMode == syncModeFS {
+		if err := syncFilesystems(args); err != nil {
+			printErrorf("Error syncing: %v\n", err)
+			return
+		}
+	}
+	total = total && len(args) > 1
+
+	if raw, _ := cmd.Flags().GetString("raw"); raw != "" {
+		if raw != "text" && raw != "json" {
+			printErrorf("Error: --raw must be text or json, not %q\n", raw)
+			return
+		}
+		for _, filePath := range args {
+			if err := inspectRaw(filePath, flags, raw); err != nil {
+				printErrorf("Error dumping extents of %s: %v\n", filePath, err)
+			}
+		}
+		return
+	}
+	if count, _ := cmd.Flags().GetBool("count"); count {
+		printExtentCounts(args, flags)
+		return
+	}
+	if stats, _ := cmd.Flags().GetBool("stats"); stats {
+		printFiemapStats(args, flags)
+		return
+	}
+	if sharing, _ := cmd.Flags().GetBool("sharing"); sharing {
+		printSharing(args, flags)
+		return
+	}
+	if compression, _ := cmd.Flags().GetBool("compression"); compression {
+		printCompression(args, flags)
+		return
+	}
+	if asJSON, _ := cmd.Flags().GetBool("json"); asJSON {
+		if useBytes || faster {
+			printErrorf("Error: --json always uses Bytes and can't be combined with --bytes or --fast\n")
+			return
+		}
+		// The JSON records have no index, so filtered extents couldn't be
+		// told apart from consecutive ones.
+		if match != 0 {
+			printErrorf("Error: --shared-only cannot be combined with --json; filter the shared flag instead\n")
+			return
+		}
+		printExtentReports(args, offsetStr, lengthStr, head, tail, flags)
+		return
+	}
+	if asCSV, _ := cmd.Flags().GetBool("csv"); asCSV {
+		printExtentCSV(args, offsetStr, lengthStr, head, tail, useBytes, match, flags)
+		return
+	}
+	if recordPath, _ := cmd.Flags().GetString("record"); recordPath != "" {
+		recordExtents(recordPath, args, flags)
+		return
+	}
+	if baselinePath, _ := cmd.Flags().GetString("save-baseline"); baselinePath != "" {
+		saveBaseline(baselinePath, args, flags)
+		return
+	}
+	if baselinePath, _ := cmd.Flags().GetString("delta"); baselinePath != "" {
+		printDeltas(baselinePath, args, flags)
+		return
+	}
+	if svgPath, _ := cmd.Flags().GetString("svg"); svgPath != "" {
+		writeExtentSVG(svgPath, args, flags)
+		return
+	}
+
+	var totalSummary fstools.ExtentSummary
+	var spinner *progressbar.ProgressBar
+	if summary || total {
+		spinner = newExtentSpinner(faster)
+	}
 	for _, filePath := range args {
-		err := fstools.FileFragDumpExtents(filePath, syncFirst, useBytes, faster)
+		if info, err := os.Stat(filePath); err != nil {
+			printErrorf("Error inspecting %s: %v\n", filePath, err)
+			continue
+		} else if err := fstools.CheckFiemapMode(info.Mode()); err != nil {
+			printErrorf("Error inspecting %s: %v\n", filePath, err)
+			continue
+		}
+		if !summary {
+			start, length, err := inspectWindow(filePath, offsetStr, lengthStr, useBytes)
+			if err == nil {
+				if match != 0 {
+					err = fstools.FileFragDumpExtentsMatching(out, filePath, start, length, match, syncFirst, useBytes, faster)
+				} else {
+					err = fstools.FileFragDumpExtentsWindow(out, filePath, start, length, head, tail, syncFirst, useBytes, faster)
+				}
+			}
+			if err != nil {
+				printErrorf("Error showing extents for %s: %v\n", filePath, err)
+			}
+		}
+		if devices {
+			if err := inspectDevices(filePath, flags); err != nil {
+				printErrorf("Error mapping devices for %s: %v\n", filePath, err)
+			}
+		}
+		if groupByFlags {
+			if err := inspectFlagGroups(filePath, flags, useBytes); err != nil {
+				printErrorf("Error grouping extents by flags for %s: %v\n", filePath, err)
+			}
+		}
+		if gaps {
+			if err := inspectGaps(filePath, flags); err != nil {
+				printErrorf("Error measuring seek distances for %s: %v\n", filePath, err)
+			}
+		}
+		if refs {
+			if err := inspectRefs(filePath, flags); err != nil {
+				printErrorf("Error counting extent references for %s: %v\n", filePath, err)
+			}
+		}
+		if summary || total {
+			s, err := summarizeFilePath(filePath, flags, xattrs, spinner)
+			if err != nil {
+				printErrorf("Error summarizing extents for %s: %v\n", filePath, err)
+			} else {
+				totalSummary.Add(s)
+				if summary {
+					fmt.Fprintln(out, "File:", filePath)
+					printExtentSummary(s, xattrs)
+				}
+			}
+		}
+		fmt.Fprintln(out)
+	}
+
+	if total {
+		fmt.Fprintln(out, "Total Files:", totalSummary.Files)
+		printExtentSummary(totalSummary, xattrs)
+	}
+}
+
+// printExtentCounts prints the number of extents of each file, using a
+// FIEMAP request that only counts them. When there is more than one file,
+// each count is prefixed with the file's path.
+func printExtentCounts(paths []string, flags uint32) {
+	for _, filePath := range paths {
+		file, err := os.Open(filePath)
+		if err != nil {
+			printErrorf("Error counting extents of %s: %v\n", filePath, err)
+			continue
+		}
+		count, err := fstools.FiemapExtentCount(file, 0, fstools.FIEMAP_MAX_OFFSET, flags)
+		file.Close()
 		if err != nil {
-			fmt.Printf("Error showing extents for %s: %v\n", filePath, err)
+			printErrorf("Error counting extents of %s: %v\n", filePath, err)
+			continue
+		}
+		if len(paths) > 1 {
+			fmt.Fprintf(out, "%s: %d\n", filePath, count)
+		} else {
+			fmt.Fprintln(out, count)
+		}
+	}
+}
+
+// inspectWindow converts the --offset and --length flags to a logical byte
+// range of filePath. Plain numbers are in the file's blocks, unless useBytes
+// is set, while numbers with a unit suffix are always sizes in bytes.
+func inspectWindow(filePath, offsetStr, lengthStr string, useBytes bool) (start, length uint64, err error) {
+	length = fstools.FIEMAP_MAX_OFFSET
+	if offsetStr == "" && lengthStr == "" {
+		return 0, length, nil
+	}
+
+	blockSize := uint64(1)
+	if !useBytes {
+		file, err := os.Open(filePath)
+		if err != nil {
+			return 0, 0, fmt.Errorf("failed to open file: %v", err)
+		}
+		blockSize, err = fstools.FileBlockSize(file)
+		file.Close()
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	parse := func(s string) (uint64, error) {
+		if n, err := strconv.ParseUint(s, 10, 64); err == nil {
+			return n * blockSize, nil
+		}
+		return ParseSize(s)
+	}
+
+	if offsetStr != "" {
+		if start, err = parse(offsetStr); err != nil {
+			return 0, 0, fmt.Errorf("invalid --offset: %v", err)
 		}
-		fmt.Println()
+	}
+	if lengthStr != "" {
+		if length, err = parse(lengthStr); err != nil {
+			return 0, 0, fmt.Errorf("invalid --length: %v", err)
+		}
+	}
+	return start, length, nil
+}
+
+// newExtentSpinner returns a spinner that counts the extents collected so
+// far, or nil if progress shouldn't be shown. It is drawn on stderr and
+// cleared before anything is printed, so the output is unchanged.
+func newExtentSpinner(faster bool) *progressbar.ProgressBar {
+	if quiet || faster || !isTerminal(os.Stderr) {
+		return nil
+	}
+	return progressbar.NewOptions64(
+		-1,
+		progressbar.OptionSetDescription("collecting extents"),
+		progressbar.OptionSetWriter(os.Stderr),
+		progressbar.OptionSetWidth(10),
+		progressbar.OptionThrottle(65*time.Millisecond),
+		progressbar.OptionShowCount(),
+		progressbar.OptionShowIts(),
+		progressbar.OptionSetItsString("extents"),
+		progressbar.OptionSpinnerType(14),
+		progressbar.OptionClearOnFinish(),
+	)
+}
+
+// summarizeFilePath summarizes the extents of filePath, adding each one to
+// spinner if it isn't nil.
+// If xattrs is set, the extents of the file's extended attributes are
+// summarized too, with a second walk.
+func summarizeFilePath(filePath string, flags uint32, xattrs bool, spinner *progressbar.ProgressBar) (fstools.ExtentSummary, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return fstools.ExtentSummary{}, fmt.Errorf("failed to open file: %v", err)
+	}
+	defer file.Close()
+
+	var s fstools.ExtentSummary
+	if spinner == nil {
+		s, err = fstools.SummarizeFile(file, flags)
+	} else {
+		s, err = fstools.SummarizeFileProgress(file, flags, func(int) {
+			spinner.Add(1)
+		})
+		spinner.Clear()
+	}
+	if err != nil || !xattrs {
+		return s, err
+	}
+	if err := s.AddXattrExtents(file, flags); err != nil {
+		if err == unix.EBADR {
+			return s, fmt.Errorf("the filesystem can't map extended attribute extents")
+		}
+		return s, err
+	}
+	return s, nil
+}
+
+// printExtentSummary prints s, including the extended attribute extents if
+// xattrs is set.
+func printExtentSummary(s fstools.ExtentSummary, xattrs bool) {
+	fmt.Fprintln(out, "Size           (Bytes):", s.Size)
+	fmt.Fprintln(out, "Extents               :", s.Extents)
+	fmt.Fprintln(out, "Mapped         (Bytes):", s.MappedBytes)
+	fmt.Fprintln(out, "Shared Extents        :", s.SharedExtents)
+	fmt.Fprintln(out, "Shared         (Bytes):", s.SharedBytes)
+	fmt.Fprintln(out, "Mergeable Extent Pairs:", s.MergeableExtents)
+	if xattrs {
+		fmt.Fprintln(out, "Xattr Extents         :", s.XattrExtents)
+		fmt.Fprintln(out, "Xattr          (Bytes):", s.XattrBytes)
 	}
 }
 
 func main() {
 	if err := rootCmd.Execute(); err != nil {
-		fmt.Println(err)
+		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
+	if ignoreErrors && errorCount > 0 {
+		fmt.Fprintf(os.Stderr, "Ignored %d errors.\n", errorCount)
+		if quiet {
+			exitCode = 0
+		}
+	}
+	if timeoutCtx != nil && timeoutCtx.Err() == context.DeadlineExceeded {
+		fmt.Fprintf(os.Stderr, "Timed out after %v.\n", timeout)
+		exitCode = exitTimeout
+	}
+	os.Exit(exitCode)
 }
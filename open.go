@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// The access modes each operation needs on its target files.
+const (
+	// dedupeTargetAccess is all that FIDEDUPERANGE needs on the
+	// destination, so that read-only files can be deduped.
+	dedupeTargetAccess = os.O_RDONLY
+	// cloneTargetAccess is needed by FICLONERANGE, since the destination's
+	// contents are replaced.
+	cloneTargetAccess = os.O_WRONLY
+)
+
+// followSymlinks is set by the --follow-symlinks flag.
+var followSymlinks bool
+
+// openTarget opens path as the target of an operation, with the access mode
+// that operation needs. Unless --follow-symlinks is given, a symlink is not
+// followed, so that a path can't silently redirect the operation to
+// another file.
+func openTarget(path string, access int) (*os.File, error) {
+	return openNoFollow(path, access, "target")
+}
+
+// openSource opens path read-only as the source of an operation, with the
+// same symlink handling as openTarget.
+func openSource(path string) (*os.File, error) {
+	return openNoFollow(path, os.O_RDONLY, "source")
+}
+
+func openNoFollow(path string, flags int, role string) (*os.File, error) {
+	if !followSymlinks {
+		flags |= unix.O_NOFOLLOW
+	}
+	f, err := os.OpenFile(path, flags, 0)
+	if !followSymlinks && errors.Is(err, unix.ELOOP) {
+		return nil, fmt.Errorf("%s %s is a symlink; use --follow-symlinks", role, path)
+	}
+	return f, err
+}
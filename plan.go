@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/linux4life798/btrfs-optimize/fstools"
+	"github.com/spf13/cobra"
+)
+
+var planCmd = &cobra.Command{
+	Use:   "plan <path> [path...]",
+	Short: "Plan block level deduplication across files",
+	Long: `Plan hashes every file found under the given paths in fixed size blocks and
+writes a manifest that dedupes every block against the first block seen with
+the same content. Unlike whole file deduplication, this also finds identical
+regions shared between files that otherwise differ.
+
+Runs of consecutive matching blocks are merged into a single manifest entry.
+Zero filled blocks and the partial block at the end of each file are skipped.
+
+Deduping against compressed source extents can interact poorly with btrfs
+compression. With --encoded=skip, entries whose source range overlaps an
+extent flagged as encoded are left out of the manifest, and with
+--encoded=warn they are kept, but counted.
+
+The manifest is executed with "dedupe --manifest".`,
+	Args: cobra.MinimumNArgs(1),
+	Run:  runPlan,
+}
+
+func init() {
+	planCmd.Flags().StringP("output", "o", "", "Write the dedupe manifest to this file")
+	planCmd.Flags().String("block-size", "128KiB", "Size of the blocks to hash and match, which must be a multiple of the filesystem block size")
+	planCmd.Flags().String("max-memory", "", "Move the block index to a temporary on-disk database when it grows beyond this size (e.g. 2GiB)")
+	planCmd.Flags().String("spill-dir", "", "Directory for the on-disk block index used with --max-memory (default is the system temporary directory)")
+	planCmd.Flags().String("encoded", encodedInclude, "How to handle entries whose source extents are encoded (compressed): include, warn, or skip")
+	planCmd.MarkFlagRequired("output")
+	rootCmd.AddCommand(planCmd)
+}
+
+// The values of the plan --encoded flag.
+const (
+	encodedInclude = "include"
+	encodedWarn    = "warn"
+	encodedSkip    = "skip"
+)
+
+// blockHash is the content hash of a single block.
+type blockHash [sha256.Size]byte
+
+// blockLocation identifies a block by the index of its file in the plan and
+// its offset within that file.
+type blockLocation struct {
+	file   int
+	offset uint64
+}
+
+// blockIndex records the first location each block hash was seen at.
+type blockIndex interface {
+	// LookupOrInsert returns the location recorded for hash and true, or
+	// records loc for hash and returns false.
+	LookupOrInsert(hash blockHash, loc blockLocation) (blockLocation, bool, error)
+}
+
+// memoryBlockIndex is a blockIndex that is held entirely in memory.
+type memoryBlockIndex map[blockHash]blockLocation
+
+func (m memoryBlockIndex) LookupOrInsert(hash blockHash, loc blockLocation) (blockLocation, bool, error) {
+	if first, ok := m[hash]; ok {
+		return first, true, nil
+	}
+	m[hash] = loc
+	return loc, false, nil
+}
+
+// dedupePlanner builds a dedupe manifest by hashing files block by block.
+type dedupePlanner struct {
+	blockSize uint64
+	index     blockIndex
+	files     []string
+	entries   []dedupeManifestEntry
+
+	uniqueBlocks    int
+	duplicateBlocks int
+	zeroBlocks      int
+}
+
+func newDedupePlanner(blockSize uint64, index blockIndex) *dedupePlanner {
+	return &dedupePlanner{
+		blockSize: blockSize,
+		index:     index,
+	}
+}
+
+// addFile hashes every full block of the file at path, adding a manifest
+// entry for each block that was already seen earlier.
+func (p *dedupePlanner) addFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	fsBlockSize, err := fstools.FileBlockSize(file)
+	if err != nil {
+		return err
+	}
+	if !fstools.IsAligned(p.blockSize, fsBlockSize) {
+		return fmt.Errorf("block size %d is not a multiple of the filesystem block size %d", p.blockSize, fsBlockSize)
+	}
+
+	fileIndex := len(p.files)
+	p.files = append(p.files, path)
+
+	buf := make([]byte, p.blockSize)
+	zero := make([]byte, p.blockSize)
+	// current is the index of the entry that the next matching block may
+	// extend, or -1.
+	current := -1
+	for offset := uint64(0); ; offset += p.blockSize {
+		if _, err := io.ReadFull(file, buf); err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if bytes.Equal(buf, zero) {
+			p.zeroBlocks++
+			current = -1
+			continue
+		}
+
+		first, found, err := p.index.LookupOrInsert(sha256.Sum256(buf), blockLocation{fileIndex, offset})
+		if err != nil {
+			return fmt.Errorf("block index: %v", err)
+		}
+		if !found {
+			p.uniqueBlocks++
+			current = -1
+			continue
+		}
+		p.duplicateBlocks++
+
+		source := p.files[first.file]
+		if current >= 0 && p.canExtend(&p.entries[current], source, first.offset, offset) {
+			p.entries[current].Length += p.blockSize
+			continue
+		}
+		p.entries = append(p.entries, dedupeManifestEntry{
+			Source:     source,
+			Target:     path,
+			SrcOffset:  first.offset,
+			DestOffset: offset,
+			Length:     p.blockSize,
+		})
+		current = len(p.entries) - 1
+	}
+}
+
+// canExtend reports whether the block at destOffset, matching source at
+// srcOffset, directly continues entry.
+func (p *dedupePlanner) canExtend(entry *dedupeManifestEntry, source string, srcOffset, destOffset uint64) bool {
+	if entry.Source != source ||
+		entry.SrcOffset+entry.Length != srcOffset ||
+		entry.DestOffset+entry.Length != destOffset {
+		return false
+	}
+	// The kernel rejects overlapping ranges within the same file.
+	// The source always comes first, since it was seen first.
+	if entry.Source == entry.Target && srcOffset+p.blockSize > entry.DestOffset {
+		return false
+	}
+	return true
+}
+
+// encodedEntries finds the entries whose source range overlaps an encoded
+// extent of the source, returning the remaining entries if skip is set, or
+// all of them otherwise, along with the number found. Sources whose extents
+// can't be read are reported and their entries kept.
+func encodedEntries(entries []dedupeManifestEntry, skip bool) (kept []dedupeManifestEntry, encoded int) {
+	extents := make(map[string][]fstools.FiemapExtent)
+	for _, entry := range entries {
+		srcExtents, ok := extents[entry.Source]
+		if !ok {
+			var err error
+			srcExtents, err = collectFileExtents(entry.Source, 0)
+			if err != nil {
+				printErrorf("Error reading extents of %s: %v\n", entry.Source, err)
+			}
+			extents[entry.Source] = srcExtents
+		}
+		if fstools.RangeHasExtentFlags(srcExtents, entry.SrcOffset, entry.Length, fstools.FIEMAP_EXTENT_ENCODED) {
+			encoded++
+			if skip {
+				continue
+			}
+		}
+		kept = append(kept, entry)
+	}
+	return kept, encoded
+}
+
+func runPlan(cmd *cobra.Command, args []string) {
+	outputPath, _ := cmd.Flags().GetString("output")
+	blockSizeStr, _ := cmd.Flags().GetString("block-size")
+	encodedMode, _ := cmd.Flags().GetString("encoded")
+	if encodedMode != encodedInclude && encodedMode != encodedWarn && encodedMode != encodedSkip {
+		printErrorf("Error: --encoded must be include, warn, or skip, not %q\n", encodedMode)
+		return
+	}
+
+	blockSize, err := ParseSize(blockSizeStr)
+	if err != nil || blockSize == 0 {
+		printErrorf("Error: invalid --block-size %q\n", blockSizeStr)
+		return
+	}
+
+	var index blockIndex = make(memoryBlockIndex)
+	var spilling *spillingBlockIndex
+	if maxMemoryStr, _ := cmd.Flags().GetString("max-memory"); maxMemoryStr != "" {
+		maxMemory, err := ParseSize(maxMemoryStr)
+		if err != nil {
+			printErrorf("Error parsing --max-memory: %v\n", err)
+			return
+		}
+		spillDir, _ := cmd.Flags().GetString("spill-dir")
+		spilling = newSpillingBlockIndex(maxMemory, spillDir)
+		defer spilling.Close()
+		index = spilling
+	}
+
+	planner := newDedupePlanner(blockSize, index)
+	for _, f := range scanFiles(cmd.Context(), args, -1) {
+		if err := planner.addFile(f.path); err != nil {
+			printErrorf("Error hashing %s: %v\n", f.path, err)
+		}
+	}
+
+	manifest := dedupeManifest{Entries: planner.entries}
+	var encoded int
+	if encodedMode != encodedInclude {
+		manifest.Entries, encoded = encodedEntries(manifest.Entries, encodedMode == encodedSkip)
+		if encodedMode == encodedWarn && encoded > 0 {
+			fmt.Fprintf(os.Stderr, "Warning: %d manifest entries dedupe against encoded (compressed) source extents.\n", encoded)
+		}
+	}
+	if manifest.Entries == nil {
+		manifest.Entries = []dedupeManifestEntry{}
+	}
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		printErrorf("Error encoding manifest: %v\n", err)
+		return
+	}
+	if err := os.WriteFile(outputPath, data, 0644); err != nil {
+		printErrorf("Error writing manifest: %v\n", err)
+		return
+	}
+
+	fmt.Fprintln(out, "Files                    :", len(planner.files))
+	fmt.Fprintln(out, "Unique Blocks            :", planner.uniqueBlocks)
+	fmt.Fprintln(out, "Duplicate Blocks         :", planner.duplicateBlocks)
+	fmt.Fprintln(out, "Zero Blocks              :", planner.zeroBlocks)
+	fmt.Fprintln(out, "Manifest Entries         :", len(manifest.Entries))
+	switch encodedMode {
+	case encodedSkip:
+		fmt.Fprintln(out, "Encoded Entries Skipped  :", encoded)
+	case encodedWarn:
+		fmt.Fprintln(out, "Encoded Entries          :", encoded)
+	}
+	var savings uint64
+	for _, entry := range manifest.Entries {
+		savings += entry.Length
+	}
+	fmt.Fprintln(out, "Estimated Savings (Bytes):", savings)
+	if spilling != nil {
+		fmt.Fprintln(out, "Peak Index Memory (Bytes):", spilling.peakEntries*blockIndexEntrySize)
+		fmt.Fprintln(out, "Index Spills             :", spilling.spills)
+	}
+	fmt.Fprintln(out, "Wrote manifest to", outputPath)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/binary"
+	"os"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// blockIndexEntrySize is the estimated memory used by each entry of a
+// memoryBlockIndex, including the map's overhead.
+const blockIndexEntrySize = 96
+
+var spillBucket = []byte("blocks")
+
+// spillingBlockIndex is a blockIndex that holds entries in memory until they
+// exceed a budget, and then moves them to an on-disk bbolt database.
+type spillingBlockIndex struct {
+	maxEntries int
+	mem        memoryBlockIndex
+	dir        string
+	db         *bolt.DB
+	dbPath     string
+
+	// peakEntries is the largest number of entries held in memory.
+	peakEntries int
+	// spills is the number of times the in-memory entries were moved to
+	// the database.
+	spills int
+}
+
+// newSpillingBlockIndex returns a blockIndex that keeps roughly maxMemory
+// bytes of entries in memory. The database is created in dir, or the default
+// temporary directory if dir is empty, once it is first needed.
+func newSpillingBlockIndex(maxMemory uint64, dir string) *spillingBlockIndex {
+	return &spillingBlockIndex{
+		maxEntries: max(int(maxMemory/blockIndexEntrySize), 1),
+		mem:        make(memoryBlockIndex),
+		dir:        dir,
+	}
+}
+
+func (s *spillingBlockIndex) LookupOrInsert(hash blockHash, loc blockLocation) (blockLocation, bool, error) {
+	if first, ok := s.mem[hash]; ok {
+		return first, true, nil
+	}
+	if s.db != nil {
+		var first blockLocation
+		var found bool
+		err := s.db.View(func(tx *bolt.Tx) error {
+			if v := tx.Bucket(spillBucket).Get(hash[:]); v != nil {
+				first = decodeBlockLocation(v)
+				found = true
+			}
+			return nil
+		})
+		if err != nil || found {
+			return first, found, err
+		}
+	}
+
+	s.mem[hash] = loc
+	s.peakEntries = max(s.peakEntries, len(s.mem))
+	if len(s.mem) >= s.maxEntries {
+		if err := s.spill(); err != nil {
+			return loc, false, err
+		}
+	}
+	return loc, false, nil
+}
+
+// spill moves all in-memory entries to the database.
+func (s *spillingBlockIndex) spill() error {
+	if s.db == nil {
+		f, err := os.CreateTemp(s.dir, "btrfs-optimize-plan-*.db")
+		if err != nil {
+			return err
+		}
+		s.dbPath = f.Name()
+		f.Close()
+		s.db, err = bolt.Open(s.dbPath, 0600, &bolt.Options{NoSync: true})
+		if err != nil {
+			return err
+		}
+	}
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(spillBucket)
+		if err != nil {
+			return err
+		}
+		for hash, loc := range s.mem {
+			if err := b.Put(hash[:], encodeBlockLocation(loc)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.mem = make(memoryBlockIndex)
+	s.spills++
+	return nil
+}
+
+// Close deletes the database, if one was created.
+func (s *spillingBlockIndex) Close() error {
+	if s.db == nil {
+		return nil
+	}
+	err := s.db.Close()
+	if rerr := os.Remove(s.dbPath); err == nil {
+		err = rerr
+	}
+	return err
+}
+
+func encodeBlockLocation(loc blockLocation) []byte {
+	v := make([]byte, 16)
+	binary.LittleEndian.PutUint64(v[0:], uint64(loc.file))
+	binary.LittleEndian.PutUint64(v[8:], loc.offset)
+	return v
+}
+
+func decodeBlockLocation(v []byte) blockLocation {
+	return blockLocation{
+		file:   int(binary.LittleEndian.Uint64(v[0:])),
+		offset: binary.LittleEndian.Uint64(v[8:]),
+	}
+}
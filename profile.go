@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/pprof"
+)
+
+// cpuProfilePath and memProfilePath are set by the hidden global
+// --cpuprofile and --memprofile flags.
+var cpuProfilePath string
+var memProfilePath string
+var cpuProfileFile *os.File
+
+func init() {
+	rootCmd.PersistentFlags().StringVar(&cpuProfilePath, "cpuprofile", "", "Write a pprof CPU profile of the command to this file")
+	rootCmd.PersistentFlags().StringVar(&memProfilePath, "memprofile", "", "Write a pprof heap profile to this file once the command finishes")
+	rootCmd.PersistentFlags().MarkHidden("cpuprofile")
+	rootCmd.PersistentFlags().MarkHidden("memprofile")
+}
+
+// startProfiling starts the CPU profile, if requested.
+func startProfiling() error {
+	if cpuProfilePath == "" {
+		return nil
+	}
+	f, err := os.Create(cpuProfilePath)
+	if err != nil {
+		return fmt.Errorf("failed to create CPU profile: %v", err)
+	}
+	if err := pprof.StartCPUProfile(f); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to start CPU profile: %v", err)
+	}
+	cpuProfileFile = f
+	return nil
+}
+
+// stopProfiling stops the CPU profile and writes the heap profile, if
+// requested.
+func stopProfiling() {
+	if cpuProfileFile != nil {
+		pprof.StopCPUProfile()
+		cpuProfileFile.Close()
+	}
+	if memProfilePath != "" {
+		f, err := os.Create(memProfilePath)
+		if err != nil {
+			printErrorf("Error creating memory profile: %v\n", err)
+			return
+		}
+		defer f.Close()
+		runtime.GC()
+		if err := pprof.WriteHeapProfile(f); err != nil {
+			printErrorf("Error writing memory profile: %v\n", err)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// scannedFile is a regular file found while walking a tree, along with the
+// file info captured at that time.
+type scannedFile struct {
+	path string
+	info fs.FileInfo
+}
+
+// scanFiles walks each of roots and returns every regular file found, with
+// absolute paths. Files that can't be stat'ed and roots that can't be walked
+// are reported and skipped. Once ctx is done, the files found so far are
+// returned.
+func scanFiles(ctx context.Context, roots []string, maxDepth int) []scannedFile {
+	var files []scannedFile
+	for _, root := range roots {
+		err := walkRegularFiles(ctx, root, maxDepth, func(path string) error {
+			abs, err := filepath.Abs(path)
+			if err != nil {
+				return err
+			}
+			info, err := os.Stat(abs)
+			if err != nil {
+				printErrorf("Error getting file info for %s: %v\n", path, err)
+				return nil
+			}
+			files = append(files, scannedFile{path: abs, info: info})
+			return nil
+		})
+		if interrupted(err) {
+			break
+		}
+		if err != nil {
+			printErrorf("Error walking %s: %v\n", root, err)
+		}
+	}
+	return files
+}
+
+// filterUniqueSizes drops every file whose size is not shared by any other
+// file in the set, since such a file can't have a duplicate. The number of
+// files eliminated is returned along with the remaining files, which keep
+// their original order.
+func filterUniqueSizes(files []scannedFile) (kept []scannedFile, eliminated int) {
+	sizeCounts := make(map[int64]int)
+	for _, f := range files {
+		sizeCounts[f.info.Size()]++
+	}
+	for _, f := range files {
+		if sizeCounts[f.info.Size()] < 2 {
+			eliminated++
+			continue
+		}
+		kept = append(kept, f)
+	}
+	return kept, eliminated
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// deviceScheduler runs jobs concurrently, but at most limit at a time for
+// each backing device, so that parallel I/O doesn't thrash a single disk
+// while jobs on other devices still make progress.
+//
+// Devices are told apart by st_dev. On btrfs that identifies the subvolume's
+// filesystem rather than the physical disk, so all devices of a multi-device
+// btrfs filesystem share one limit.
+type deviceScheduler struct {
+	limit int
+
+	mu     sync.Mutex
+	queues map[uint64]chan func()
+	wg     sync.WaitGroup
+}
+
+func newDeviceScheduler(limit int) *deviceScheduler {
+	return &deviceScheduler{
+		limit:  limit,
+		queues: make(map[uint64]chan func()),
+	}
+}
+
+// deviceOf returns the st_dev of path, or 0 if it can't be stat'ed, in which
+// case the job will most likely fail quickly on its own.
+func deviceOf(path string) uint64 {
+	var stat unix.Stat_t
+	if err := unix.Stat(path, &stat); err != nil {
+		return 0
+	}
+	return uint64(stat.Dev)
+}
+
+// Go queues job to run on one of dev's workers, starting them on first use.
+// It only blocks while dev's queue is full.
+func (s *deviceScheduler) Go(dev uint64, job func()) {
+	s.mu.Lock()
+	queue, ok := s.queues[dev]
+	if !ok {
+		queue = make(chan func(), s.limit)
+		s.queues[dev] = queue
+		for i := 0; i < s.limit; i++ {
+			s.wg.Add(1)
+			go func() {
+				defer s.wg.Done()
+				for job := range queue {
+					job()
+				}
+			}()
+		}
+	}
+	s.mu.Unlock()
+	queue <- job
+}
+
+// Wait waits for all queued jobs to finish. No jobs may be queued after.
+func (s *deviceScheduler) Wait() {
+	s.mu.Lock()
+	for _, queue := range s.queues {
+		close(queue)
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"os"
+
+	"github.com/linux4life798/btrfs-optimize/fstools"
+	"github.com/spf13/cobra"
+)
+
+// selftestFileSize is the size of the files deduped by selftest, which is
+// a multiple of any reasonable filesystem block size.
+const selftestFileSize = 1 * Mebibyte
+
+var selftestCmd = &cobra.Command{
+	Use:   "selftest [dir]",
+	Short: "Check that dedupe works on the filesystem of a directory",
+	Long: `Selftest creates two identical temporary files in dir (default is the
+current directory), dedupes them, and verifies with FIEMAP that they now
+share their physical extents. The files are deleted afterwards.
+
+Prints PASS or FAIL, and exits with a non-zero status on failure.`,
+	Args: cobra.MaximumNArgs(1),
+	Run:  runSelftest,
+}
+
+func init() {
+	rootCmd.AddCommand(selftestCmd)
+}
+
+func runSelftest(cmd *cobra.Command, args []string) {
+	dir := "."
+	if len(args) > 0 {
+		dir = args[0]
+	}
+	if err := selftest(dir); err != nil {
+		printErrorf("FAIL: %v\n", err)
+		return
+	}
+	fmt.Fprintln(out, "PASS")
+}
+
+func selftest(dir string) error {
+	data := make([]byte, selftestFileSize)
+	if _, err := rand.Read(data); err != nil {
+		return err
+	}
+
+	var paths []string
+	defer func() {
+		for _, path := range paths {
+			os.Remove(path)
+		}
+	}()
+	for i := 0; i < 2; i++ {
+		f, err := os.CreateTemp(dir, ".btrfs-optimize-selftest-")
+		if err != nil {
+			return fmt.Errorf("failed to create test file: %v", err)
+		}
+		paths = append(paths, f.Name())
+		_, err = f.Write(data)
+		if err == nil {
+			err = f.Sync()
+		}
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return fmt.Errorf("failed to write test file: %v", err)
+		}
+	}
+	fmt.Fprintln(out, "Created test files:", paths[0], paths[1])
+
+	result, err := fstools.DedupeFiles(paths[0], paths[1:], fstools.DedupeOptions{NoSharedCheck: true})
+	if err != nil {
+		return fmt.Errorf("dedupe failed: %v", err)
+	}
+	target := result.Targets[0]
+	if err := target.Err(); err != nil {
+		return fmt.Errorf("dedupe failed: %v", err)
+	}
+	fmt.Fprintln(out, "Deduped (Bytes):", target.BytesDeduped)
+
+	a, err := collectFileExtents(paths[0], fstools.FIEMAP_FLAG_SYNC)
+	if err != nil {
+		return fmt.Errorf("failed to read extents: %v", err)
+	}
+	b, err := collectFileExtents(paths[1], fstools.FIEMAP_FLAG_SYNC)
+	if err != nil {
+		return fmt.Errorf("failed to read extents: %v", err)
+	}
+	r := fstools.CompareSharing(a, b)
+	fmt.Fprintln(out, "Shared  (Bytes):", r.TotalShared())
+	if r.TotalShared() != selftestFileSize {
+		return fmt.Errorf("only %d of %d Bytes are shared after dedupe", r.TotalShared(), selftestFileSize)
+	}
+	return nil
+}
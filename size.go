@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ParseSize parses a size in bytes with an optional binary unit suffix,
+// like "4096", "64K", "1.5GiB", or "2T".
+// Both the short (K, M, G, T) and IEC (KiB, MiB, GiB, TiB) suffixes are
+// interpreted as powers of 1024.
+func ParseSize(s string) (uint64, error) {
+	str := strings.TrimSpace(s)
+	units := []struct {
+		suffix     string
+		multiplier uint64
+	}{
+		{"TiB", Tebibyte}, {"GiB", Gibibyte}, {"MiB", Mebibyte}, {"KiB", Kibibyte},
+		{"T", Tebibyte}, {"G", Gibibyte}, {"M", Mebibyte}, {"K", Kibibyte},
+		{"B", 1},
+	}
+
+	multiplier := uint64(1)
+	for _, u := range units {
+		if strings.HasSuffix(strings.ToUpper(str), strings.ToUpper(u.suffix)) {
+			multiplier = u.multiplier
+			str = strings.TrimSpace(str[:len(str)-len(u.suffix)])
+			break
+		}
+	}
+
+	if n, err := strconv.ParseUint(str, 10, 64); err == nil {
+		if n != 0 && n*multiplier/multiplier != n {
+			return 0, fmt.Errorf("size %q overflows", s)
+		}
+		return n * multiplier, nil
+	}
+	f, err := strconv.ParseFloat(str, 64)
+	if err != nil || f < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return uint64(f * float64(multiplier)), nil
+}
+
+// sizeUnits are the binary units used to format sizes, largest first.
+var sizeUnits = []struct {
+	suffix     string
+	multiplier uint64
+}{
+	{"TiB", Tebibyte}, {"GiB", Gibibyte}, {"MiB", Mebibyte}, {"KiB", Kibibyte},
+}
+
+// FormatSize formats a size in bytes using the largest binary unit that
+// keeps the value at least 1, with up to two decimals, like "4KiB" or
+// "1.5GiB".
+func FormatSize(n uint64) string {
+	for _, u := range sizeUnits {
+		if n >= u.multiplier {
+			v := strconv.FormatFloat(float64(n)/float64(u.multiplier), 'f', 2, 64)
+			return strings.TrimSuffix(strings.TrimRight(v, "0"), ".") + u.suffix
+		}
+	}
+	return strconv.FormatUint(n, 10) + "B"
+}
+
+// FormatSizeFixed formats a size in bytes like FormatSize, but always with
+// two decimals and a space before the unit, like "1.50 GiB", so that
+// summary lines read the same for every size.
+func FormatSizeFixed(n uint64) string {
+	for _, u := range sizeUnits {
+		if n >= u.multiplier {
+			return strconv.FormatFloat(float64(n)/float64(u.multiplier), 'f', 2, 64) + " " + u.suffix
+		}
+	}
+	return strconv.FormatUint(n, 10) + " B"
+}
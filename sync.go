@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/linux4life798/btrfs-optimize/fstools"
+	"golang.org/x/sys/unix"
+)
+
+// Values of the --sync-mode flag.
+const (
+	syncModeNone = "none" // don't sync
+	syncModeFile = "file" // sync each file involved
+	syncModeFS   = "fs"   // sync the filesystems of the files involved once
+)
+
+const syncModeUsage = "Sync dirty data before reading extents: none, file (each file), or fs (syncfs once per filesystem)"
+
+func validateSyncMode(mode string) error {
+	switch mode {
+	case syncModeNone, syncModeFile, syncModeFS:
+		return nil
+	}
+	return fmt.Errorf("invalid --sync-mode %q, must be none, file, or fs", mode)
+}
+
+// syncFilesystems calls syncfs once for each distinct filesystem that
+// contains one of paths.
+func syncFilesystems(paths []string) error {
+	synced := make(map[uint64]bool)
+	for _, path := range paths {
+		var stat unix.Stat_t
+		if err := unix.Stat(path, &stat); err != nil {
+			return err
+		}
+		// Dev is only 32 bits on some architectures, like mips.
+		dev := uint64(stat.Dev)
+		if synced[dev] {
+			continue
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		err = fstools.Syncfs(file)
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("syncfs %s: %v", path, err)
+		}
+		synced[dev] = true
+	}
+	return nil
+}
+
+// syncFiles calls fsync on each of paths.
+func syncFiles(paths []string) error {
+	for _, path := range paths {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		err = file.Sync()
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("fsync %s: %v", path, err)
+		}
+	}
+	return nil
+}
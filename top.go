@@ -0,0 +1,176 @@
+package main
+
+import (
+	"container/heap"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/linux4life798/btrfs-optimize/fstools"
+	"github.com/spf13/cobra"
+)
+
+var topCmd = &cobra.Command{
+	Use:   "top <dir> [dir...]",
+	Short: "List the most fragmented files in directory trees",
+	Long: `Top walks the given directories and lists the files with the most extents,
+most fragmented first, to answer what is worth defragmenting.
+
+By default, files are ranked by their extent count, which is found with a
+FIEMAP request that only counts extents and is fast even on huge trees.
+With --by score, the fragmentation score used by defrag is computed instead,
+which needs every extent to be read.
+
+Use --paths-only to feed the result into defrag:
+
+  btrfs-optimize top --paths-only /data | xargs -d '\n' btrfs-optimize defrag`,
+	Args: cobra.MinimumNArgs(1),
+	Run:  runTop,
+}
+
+func init() {
+	topCmd.Flags().Int("count", 10, "Number of files to list")
+	topCmd.Flags().String("by", "extents", "Rank files by extents or score")
+	topCmd.Flags().Bool("json", false, "Print the files as JSON")
+	topCmd.Flags().Bool("paths-only", false, "Only print the paths of the files, one per line")
+	topCmd.Flags().Int("max-depth", -1, "Limit how deep the walk descends, or -1 for no limit")
+	rootCmd.AddCommand(topCmd)
+}
+
+// topFile is a file ranked by top.
+type topFile struct {
+	Path    string  `json:"path"`
+	Size    int64   `json:"size"`
+	Extents int     `json:"extents"`
+	Score   float64 `json:"score,omitempty"`
+
+	rank float64
+}
+
+// topHeap is a min-heap by rank, so the least fragmented of the files kept
+// so far is the one evicted when a more fragmented file is found.
+type topHeap []topFile
+
+func (h topHeap) Len() int           { return len(h) }
+func (h topHeap) Less(i, j int) bool { return h[i].rank < h[j].rank }
+func (h topHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *topHeap) Push(x any)        { *h = append(*h, x.(topFile)) }
+func (h *topHeap) Pop() any {
+	old := *h
+	f := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return f
+}
+
+// rankFile measures the fragmentation of the file at path, either by its
+// extent count alone or by its fragmentation score.
+func rankFile(path string, byScore bool) (topFile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return topFile{}, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return topFile{}, err
+	}
+
+	f := topFile{Path: path, Size: info.Size()}
+	if !byScore {
+		f.Extents, err = fstools.FiemapExtentCount(file, 0, fstools.FIEMAP_MAX_OFFSET, 0)
+		f.rank = float64(f.Extents)
+		return f, err
+	}
+	extents, err := fstools.CollectExtents(file, 0)
+	if err != nil {
+		return topFile{}, err
+	}
+	frag := fstools.FragmentationScore(extents)
+	f.Extents = len(extents)
+	f.Score = frag.Score
+	f.rank = frag.Score
+	return f, nil
+}
+
+func runTop(cmd *cobra.Command, args []string) {
+	count, _ := cmd.Flags().GetInt("count")
+	by, _ := cmd.Flags().GetString("by")
+	asJSON, _ := cmd.Flags().GetBool("json")
+	pathsOnly, _ := cmd.Flags().GetBool("paths-only")
+	maxDepth, _ := cmd.Flags().GetInt("max-depth")
+
+	if by != "extents" && by != "score" {
+		printErrorf("Error: --by must be extents or score, not %q\n", by)
+		return
+	}
+	if count < 1 {
+		printErrorf("Error: --count must be at least 1\n")
+		return
+	}
+	byScore := by == "score"
+
+	// Only the top files are kept, so memory use doesn't grow with the
+	// size of the tree.
+	h := make(topHeap, 0, count+1)
+	for _, root := range args {
+		err := walkRegularFiles(cmd.Context(), root, maxDepth, func(path string) error {
+			f, err := rankFile(path, byScore)
+			if err != nil {
+				printErrorf("Error reading extents of %s: %v\n", path, err)
+				return nil
+			}
+			if h.Len() < count {
+				heap.Push(&h, f)
+			} else if f.rank > h[0].rank {
+				h[0] = f
+				heap.Fix(&h, 0)
+			}
+			return nil
+		})
+		// The files ranked before an interruption are still listed.
+		if interrupted(err) {
+			printErrorf("Walk interrupted, listing the files seen so far.\n")
+			break
+		}
+		if err != nil {
+			printErrorf("Error walking %s: %v\n", root, err)
+		}
+	}
+
+	files := []topFile(h)
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].rank != files[j].rank {
+			return files[i].rank > files[j].rank
+		}
+		return files[i].Path < files[j].Path
+	})
+
+	switch {
+	case asJSON:
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(files); err != nil {
+			printErrorf("Error encoding JSON: %v\n", err)
+		}
+	case pathsOnly:
+		for _, f := range files {
+			fmt.Fprintln(out, f.Path)
+		}
+	default:
+		w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		if byScore {
+			fmt.Fprintln(w, "SCORE\tEXTENTS\tSIZE\tPATH")
+		} else {
+			fmt.Fprintln(w, "EXTENTS\tSIZE\tPATH")
+		}
+		for _, f := range files {
+			if byScore {
+				fmt.Fprintf(w, "%.2f\t", f.Score)
+			}
+			fmt.Fprintf(w, "%d\t%d\t%s\n", f.Extents, f.Size, f.Path)
+		}
+		w.Flush()
+	}
+}
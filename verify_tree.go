@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/linux4life798/btrfs-optimize/fstools"
+	"github.com/linux4life798/btrfs-optimize/hashcache"
+	"github.com/spf13/cobra"
+)
+
+var verifyTreeCmd = &cobra.Command{
+	Use:   "verify-tree <dir> [dir...]",
+	Short: "Verify that files with identical content share their physical extents",
+	Long: `Verify-tree walks the given directories, groups the files by content hash,
+and checks that the members of each group share their physical extents, in
+the same way as verify does for two files. This confirms that an earlier
+dedupe took full effect across a tree.
+
+Every member of a group is compared with the first member, in sorted order.
+Groups where any member is not fully shared with it are reported.
+
+Only files whose size matches another file are hashed, and empty files are
+skipped, since they have no extents to share.
+
+Exits with a non-zero status if any group is not fully shared.`,
+	Args: cobra.MinimumNArgs(1),
+	Run:  runVerifyTree,
+}
+
+func init() {
+	verifyTreeCmd.Flags().BoolP("sync", "s", false, "Sync the files to disk before requeting the extents map")
+	verifyTreeCmd.Flags().Int("max-depth", -1, "Limit how many directories below each path is searched (0 = only top directory, -1 = unlimited)")
+	verifyTreeCmd.Flags().Bool("json", false, "Print the groups that are not fully shared as JSON")
+	rootCmd.AddCommand(verifyTreeCmd)
+}
+
+// underSharedGroup is a group of files with identical content that don't
+// all share their extents with the first file of the group.
+type underSharedGroup struct {
+	Hash    string              `json:"hash"`
+	Size    int64               `json:"size"`
+	Path    string              `json:"path"`
+	Members []underSharedMember `json:"members"`
+}
+
+// underSharedMember is a member of a group that is not fully shared with the
+// group's first file.
+type underSharedMember struct {
+	Path          string `json:"path"`
+	SharedBytes   uint64 `json:"shared_bytes"`
+	UnsharedBytes uint64 `json:"unshared_bytes"`
+}
+
+func runVerifyTree(cmd *cobra.Command, args []string) {
+	syncFirst, _ := cmd.Flags().GetBool("sync")
+	maxDepth, _ := cmd.Flags().GetInt("max-depth")
+	asJSON, _ := cmd.Flags().GetBool("json")
+	var flags uint32
+	if syncFirst {
+		flags |= fstools.FIEMAP_FLAG_SYNC
+	}
+
+	files, _ := filterUniqueSizes(scanFiles(cmd.Context(), args, maxDepth))
+	groups := make(map[string][]scannedFile)
+	for _, f := range files {
+		if err := cmd.Context().Err(); err != nil {
+			printErrorf("Verification interrupted while hashing.\n")
+			return
+		}
+		if f.info.Size() == 0 {
+			continue
+		}
+		hash, err := hashcache.HashFile(f.path, fstools.DefaultHashAlgorithm)
+		if err != nil {
+			printErrorf("Error hashing %s: %v\n", f.path, err)
+			continue
+		}
+		groups[hash] = append(groups[hash], f)
+	}
+
+	hashes := make([]string, 0, len(groups))
+	for hash, members := range groups {
+		if len(members) > 1 {
+			hashes = append(hashes, hash)
+		}
+	}
+	sort.Strings(hashes)
+
+	offenders := []underSharedGroup{}
+	for _, hash := range hashes {
+		members := groups[hash]
+		sort.Slice(members, func(i, j int) bool {
+			return members[i].path < members[j].path
+		})
+		group, err := verifyGroup(hash, members, flags)
+		if err != nil {
+			printErrorf("Error verifying the group of %s: %v\n", members[0].path, err)
+			continue
+		}
+		if group != nil {
+			offenders = append(offenders, *group)
+		}
+	}
+	if len(offenders) > 0 {
+		exitCode = 1
+	}
+
+	if asJSON {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(offenders); err != nil {
+			printErrorf("Error encoding JSON: %v\n", err)
+		}
+		return
+	}
+	for _, g := range offenders {
+		fmt.Fprintf(out, "Not fully shared with %s (%d Bytes):\n", g.Path, g.Size)
+		for _, m := range g.Members {
+			fmt.Fprintf(out, "  %s: %d Bytes unshared\n", m.Path, m.UnsharedBytes)
+		}
+	}
+	fmt.Fprintln(out, "Identical Groups   :", len(hashes))
+	fmt.Fprintln(out, "Fully Shared Groups:", len(hashes)-len(offenders))
+	fmt.Fprintln(out, "Under-Shared Groups:", len(offenders))
+}
+
+// verifyGroup compares the extents of every member with the first, and
+// returns the members that are not fully shared with it, or nil if they all
+// are.
+func verifyGroup(hash string, members []scannedFile, flags uint32) (*underSharedGroup, error) {
+	first, err := collectFileExtents(members[0].path, flags)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read extents of %s: %v", members[0].path, err)
+	}
+	group := &underSharedGroup{
+		Hash: hash,
+		Size: members[0].info.Size(),
+		Path: members[0].path,
+	}
+	for _, m := range members[1:] {
+		extents, err := collectFileExtents(m.path, flags)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read extents of %s: %v", m.path, err)
+		}
+		r := fstools.CompareSharing(first, extents)
+		unshared := r.UnsharedBytes + r.FlagOnlyBytes + r.UnmatchedBytes
+		if r.TotalShared() != 0 && unshared == 0 {
+			continue
+		}
+		group.Members = append(group.Members, underSharedMember{
+			Path:          m.path,
+			SharedBytes:   r.TotalShared(),
+			UnsharedBytes: unshared,
+		})
+	}
+	if len(group.Members) == 0 {
+		return nil, nil
+	}
+	return group, nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"io/fs"
+	"path/filepath"
+	"strings"
+)
+
+// walkRegularFiles calls fn for every regular file found under root,
+// descending at most maxDepth directories below root, where 0 only visits
+// the files directly inside root and -1 is unlimited.
+// If root is itself a regular file, fn is only called for it.
+// Symlinks and special files are never visited.
+// Paths that can't be read stop the walk, unless --ignore-errors is given,
+// in which case they are reported and skipped.
+// The walk stops with ctx.Err() once ctx is done.
+func walkRegularFiles(ctx context.Context, root string, maxDepth int, fn func(path string) error) error {
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		if err != nil {
+			if ignoreErrors {
+				printErrorf("Error walking %s: %v\n", path, err)
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			if path != root && maxDepth >= 0 && pathDepth(root, path) > maxDepth {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		return fn(path)
+	})
+}
+
+// pathDepth returns the number of path components of path below root.
+func pathDepth(root, path string) int {
+	rel, err := filepath.Rel(root, path)
+	if err != nil || rel == "." {
+		return 0
+	}
+	return strings.Count(rel, string(filepath.Separator)) + 1
+}
+
+// expandPaths returns the regular files found under each of paths when
+// recursive is set, otherwise paths is returned unchanged.
+func expandPaths(ctx context.Context, paths []string, recursive bool, maxDepth int) ([]string, error) {
+	if !recursive {
+		return paths, nil
+	}
+	var files []string
+	for _, root := range paths {
+		err := walkRegularFiles(ctx, root, maxDepth, func(path string) error {
+			files = append(files, path)
+			return nil
+		})
+		if err != nil {
+			return files, err
+		}
+	}
+	return files, nil
+}